@@ -4,7 +4,11 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"regexp"
+	"strings"
+	"text/template"
 
 	"code.cloudfoundry.org/cflager"
 	"code.cloudfoundry.org/clock"
@@ -76,12 +80,246 @@ var dbCACert = flag.String(
 	"(optional) CA Cert to verify SSL connection",
 )
 
+var dbPasswordFile = flag.String(
+	"dbPasswordFile",
+	"",
+	"(optional) file holding the database password, used instead of DB_PASSWORD when set",
+)
+
+var indentStateFile = flag.Bool(
+	"indentStateFile",
+	false,
+	"(optional) write the state file as indented JSON, which is easier to read than the default compact JSON",
+)
+
+var dbQueryTimeout = flag.Duration(
+	"dbQueryTimeout",
+	0,
+	"(optional) maximum time a database read, a broker lock statement, or a save waiting for a pooled connection, may take, e.g. 5s; zero disables the limit",
+)
+
+var dbTablePrefix = flag.String(
+	"dbTablePrefix",
+	"",
+	"(optional) prefix for the broker's table names, so that several brokers can share one database, e.g. nfs_",
+)
+
 var cfServiceName = flag.String(
 	"cfServiceName",
 	"",
 	"(optional) For CF pushed apps, the service name in VCAP_SERVICES where we should find database credentials.  dbDriver must be defined if this option is set, but all other db parameters will be extracted from the service binding.",
 )
 
+var sessionLogLevels = flag.String(
+	"sessionLogLevels",
+	"",
+	"(optional) comma separated session:level pairs overriding logLevel for those broker sessions, e.g. bind:debug,provision:error",
+)
+
+var deviceName = flag.String(
+	"deviceName",
+	"",
+	"(optional) template for a device name given to the driver with every binding, e.g. nfs-{{.BindingID}}",
+)
+
+var syslogDrainURL = flag.String(
+	"syslogDrainURL",
+	"",
+	"(optional) template for a syslog drain url returned with every binding, e.g. syslog://logs.example.com/{{.SpaceGUID}}/{{.AppGUID}}",
+)
+
+var bindTimeout = flag.Duration(
+	"bindTimeout",
+	0,
+	"(optional) maximum time a single bind may take before failing, e.g. 30s; zero disables the limit",
+)
+
+var preflightTimeout = flag.Duration(
+	"preflightTimeout",
+	0,
+	"(optional) when set, bind dials the nfs server with this timeout and fails if it is unreachable, e.g. 2s",
+)
+
+var provisionPreflightTimeout = flag.Duration(
+	"provisionPreflightTimeout",
+	0,
+	"(optional) when set, provision dials the nfs server with this timeout and fails if it is unreachable, e.g. 2s",
+)
+
+var lenientDeprovision = flag.Bool(
+	"lenientDeprovision",
+	false,
+	"(optional) report success when deprovisioning an instance that no longer exists",
+)
+
+var maxVolumeIDLength = flag.Int(
+	"maxVolumeIDLength",
+	0,
+	"(optional) maximum length of generated volume ids, for volume drivers that limit it; zero means unlimited",
+)
+
+var seedFromFile = flag.String(
+	"seedFromFile",
+	"",
+	"(optional) state file from a file store to load into the database at startup, used only when the database holds no instances or bindings",
+)
+
+var maxInstances = flag.Int(
+	"maxInstances",
+	0,
+	"(optional) maximum number of service instances the broker will provision; zero means unlimited",
+)
+
+var nfsTLSCert = flag.String(
+	"nfsTLSCert",
+	"",
+	"(optional) client certificate file handed to the driver for shares behind a tls proxy",
+)
+
+var nfsTLSKey = flag.String(
+	"nfsTLSKey",
+	"",
+	"(optional) client key file handed to the driver for shares behind a tls proxy",
+)
+
+var nfsTLSCA = flag.String(
+	"nfsTLSCA",
+	"",
+	"(optional) CA certificate file handed to the driver for shares behind a tls proxy",
+)
+
+var nfsTLSInline = flag.Bool(
+	"nfsTLSInline",
+	false,
+	"(optional) hand the driver the contents of the nfsTLS files rather than their paths",
+)
+
+var defaultTimeo = flag.Int(
+	"defaultTimeo",
+	0,
+	"(optional) nfs timeo, in tenths of a second, for binds that do not set their own",
+)
+
+var defaultRetrans = flag.Int(
+	"defaultRetrans",
+	0,
+	"(optional) nfs retrans for binds that do not set their own",
+)
+
+var defaultRsize = flag.Int(
+	"defaultRsize",
+	0,
+	"(optional) nfs rsize, in bytes, for binds that do not set their own",
+)
+
+var defaultWsize = flag.Int(
+	"defaultWsize",
+	0,
+	"(optional) nfs wsize, in bytes, for binds that do not set their own",
+)
+
+var strictBlockSizes = flag.Bool(
+	"strictBlockSizes",
+	false,
+	"(optional) reject binds whose rsize or wsize is not a power of two, instead of logging them",
+)
+
+var plansFile = flag.String(
+	"plansFile",
+	"",
+	"(optional) JSON file listing the plans to offer, e.g. [{\"id\":\"Existing\",\"name\":\"Existing\",\"description\":\"A preexisting filesystem\",\"default_readonly\":false}]",
+)
+
+var allowedOrgs = flag.String(
+	"allowedOrgs",
+	"",
+	"(optional) comma separated org guids allowed to provision; with allowedSpaces empty too, any org may provision",
+)
+
+var allowedSpaces = flag.String(
+	"allowedSpaces",
+	"",
+	"(optional) comma separated space guids allowed to provision, in addition to those in allowedOrgs",
+)
+
+var unknownProvisionFields = flag.String(
+	"unknownProvisionFields",
+	"ignore",
+	"(optional) what to do with unknown provision parameters: ignore, reject, or store them with the instance",
+)
+
+var duplicateShares = flag.String(
+	"duplicateShares",
+	"allow",
+	"(optional) what to do when an instance is provisioned for a share another instance already uses: allow, warn or reject",
+)
+
+var containerPathAllow = flag.String(
+	"containerPathAllow",
+	"",
+	"(optional) regular expression a container path requested with the mount bind parameter must match, for example ^/var/vcap/data/",
+)
+
+var containerPathDeny = flag.String(
+	"containerPathDeny",
+	"",
+	"(optional) regular expression a container path requested with the mount bind parameter must not match",
+)
+
+var maxMountConfigSize = flag.Int(
+	"maxMountConfigSize",
+	0,
+	"(optional) maximum size in bytes of the serialized mount config a bind may produce; zero means unlimited",
+)
+
+var caseSensitiveShares = flag.Bool(
+	"caseSensitiveShares",
+	false,
+	"(optional) treat shares whose export paths differ only by case as different shares",
+)
+
+var forcedBindParameters = flag.String(
+	"forcedBindParameters",
+	"",
+	"(optional) JSON object of bind parameters that override those given by binds and instance defaults, for example {\"readonly\":true}",
+)
+
+var defaultPlan = flag.String(
+	"defaultPlan",
+	"",
+	"(optional) id of the plan to provision when a request names none; it must be one of the offered plans",
+)
+
+var exclusiveBindParameters = flag.String(
+	"exclusiveBindParameters",
+	"",
+	"(optional) comma separated groups of bind parameters that cannot be used together, the parameters of a group separated by |, e.g. soft|hard",
+)
+
+var checkVolumeIDs = flag.Bool(
+	"checkVolumeIDs",
+	false,
+	"(optional) on startup, log bindings whose recorded volume id no longer matches the one they would get today",
+)
+
+var repairVolumeIDs = flag.Bool(
+	"repairVolumeIDs",
+	false,
+	"(optional) with checkVolumeIDs, also update the recorded volume ids that drifted",
+)
+
+var orgRateInterval = flag.Duration(
+	"orgRateInterval",
+	0,
+	"(optional) how often each organization gains another provision or bind request, e.g. 10s; zero means no rate limit",
+)
+
+var orgRateBurst = flag.Int(
+	"orgRateBurst",
+	10,
+	"(optional) how many provision and bind requests an organization may make at once when orgRateInterval is set",
+)
+
 var (
 	username   string
 	password   string
@@ -95,7 +333,7 @@ func main() {
 
 	checkParams()
 
-	logger, logSink := cflager.New("nfsbroker")
+	logger, logSink := newLogger()
 	logger.Info("starting")
 	defer logger.Info("ends")
 
@@ -119,6 +357,30 @@ func parseCommandLine() {
 	flag.Parse()
 }
 
+func newLogger() (lager.Logger, *lager.ReconfigurableSink) {
+	if *sessionLogLevels == "" {
+		return cflager.New("nfsbroker")
+	}
+
+	minLevel, err := nfsbroker.ParseLogLevel(flag.Lookup("logLevel").Value.String())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\nERROR: %s\n\n", err)
+		os.Exit(1)
+	}
+
+	sessionLevels, err := nfsbroker.ParseSessionLogLevels(*sessionLogLevels)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\nERROR: %s\n\n", err)
+		os.Exit(1)
+	}
+
+	logger := lager.NewLogger("nfsbroker")
+	sink := lager.NewReconfigurableSink(nfsbroker.NewSessionLevelSink(lager.NewWriterSink(os.Stdout, lager.DEBUG), minLevel, sessionLevels), lager.DEBUG)
+	logger.RegisterSink(sink)
+
+	return logger, sink
+}
+
 func parseEnvironment() {
 	username, _ = os.LookupEnv("USERNAME")
 	password, _ = os.LookupEnv("PASSWORD")
@@ -176,16 +438,177 @@ func createServer(logger lager.Logger) ifrit.Runner {
 		parseVcapServices(logger)
 	}
 
-	store := nfsbroker.NewStore(logger, *dbDriver, dbUsername, dbPassword, *dbHostname, *dbPort, *dbName, *dbCACert, fileName)
+	store := nfsbroker.NewStore(logger, nfsbroker.StoreConfig{
+		DBDriver:        *dbDriver,
+		DBUsername:      dbUsername,
+		DBPassword:      dbPassword,
+		DBPasswordFile:  *dbPasswordFile,
+		DBHostname:      *dbHostname,
+		DBPort:          *dbPort,
+		DBName:          *dbName,
+		DBCACert:        *dbCACert,
+		DBTablePrefix:   *dbTablePrefix,
+		DBQueryTimeout:  *dbQueryTimeout,
+		SeedFromFile:    *seedFromFile,
+		FileName:        fileName,
+		IndentFileStore: *indentStateFile,
+	})
+
+	var options []nfsbroker.Option
+	if *syslogDrainURL != "" {
+		tmpl, err := template.New("syslogDrainURL").Parse(*syslogDrainURL)
+		if err != nil {
+			logger.Fatal("invalid-syslog-drain-url", err)
+		}
+		options = append(options, nfsbroker.WithSyslogDrainURL(tmpl))
+	}
+	if *deviceName != "" {
+		tmpl, err := template.New("deviceName").Parse(*deviceName)
+		if err != nil {
+			logger.Fatal("invalid-device-name", err)
+		}
+		options = append(options, nfsbroker.WithDeviceName(tmpl))
+	}
+	if *bindTimeout > 0 {
+		options = append(options, nfsbroker.WithBindTimeout(*bindTimeout))
+	}
+	if *preflightTimeout > 0 {
+		options = append(options, nfsbroker.WithSharePreflight(*preflightTimeout))
+	}
+	if *provisionPreflightTimeout > 0 {
+		options = append(options, nfsbroker.WithProvisionPreflight(*provisionPreflightTimeout))
+	}
+	if *lenientDeprovision {
+		options = append(options, nfsbroker.WithLenientDeprovision())
+	}
+	if *maxVolumeIDLength > 0 {
+		options = append(options, nfsbroker.WithMaxVolumeIDLength(*maxVolumeIDLength))
+	}
+	if *maxInstances > 0 {
+		options = append(options, nfsbroker.WithMaxInstances(*maxInstances))
+	}
+	if *maxMountConfigSize > 0 {
+		options = append(options, nfsbroker.WithMaxMountConfigSize(*maxMountConfigSize))
+	}
+	if *plansFile != "" {
+		data, err := ioutil.ReadFile(*plansFile)
+		if err != nil {
+			logger.Fatal("failed-reading-plans-file", err, lager.Data{"plansFile": *plansFile})
+		}
+		plans, err := nfsbroker.ParsePlans(data)
+		if err != nil {
+			logger.Fatal("invalid-plans-file", err, lager.Data{"plansFile": *plansFile})
+		}
+		options = append(options, nfsbroker.WithPlans(plans))
+	}
+	if *defaultPlan != "" {
+		options = append(options, nfsbroker.WithDefaultPlan(*defaultPlan))
+	}
+	if *allowedOrgs != "" || *allowedSpaces != "" {
+		options = append(options, nfsbroker.WithProvisionAllowlist(splitList(*allowedOrgs), splitList(*allowedSpaces)))
+	}
+	unknownFieldsMode, err := nfsbroker.ParseUnknownFieldsMode(*unknownProvisionFields)
+	if err != nil {
+		logger.Fatal("invalid-unknown-provision-fields", err)
+	}
+	options = append(options, nfsbroker.WithUnknownProvisionFields(unknownFieldsMode))
+	duplicateSharesMode, err := nfsbroker.ParseDuplicateSharesMode(*duplicateShares)
+	if err != nil {
+		logger.Fatal("invalid-duplicate-shares", err)
+	}
+	options = append(options, nfsbroker.WithDuplicateShares(duplicateSharesMode))
+	if *caseSensitiveShares {
+		options = append(options, nfsbroker.WithShareNormalizer(nfsbroker.CaseSensitiveShareNormalizer))
+	}
+	if *containerPathAllow != "" || *containerPathDeny != "" {
+		options = append(options, nfsbroker.WithContainerPathPatterns(containerPathPattern(logger, *containerPathAllow), containerPathPattern(logger, *containerPathDeny)))
+	}
+	if *defaultTimeo < 0 || *defaultRetrans < 0 {
+		logger.Fatal("invalid-retry-defaults", errors.New("defaultTimeo and defaultRetrans must not be negative"))
+	}
+	if *defaultTimeo > 0 || *defaultRetrans > 0 {
+		options = append(options, nfsbroker.WithRetryDefaults(*defaultTimeo, *defaultRetrans))
+	}
+	if *defaultRsize < 0 || *defaultWsize < 0 {
+		logger.Fatal("invalid-block-size-defaults", errors.New("defaultRsize and defaultWsize must not be negative"))
+	}
+	if *strictBlockSizes && (*defaultRsize&(*defaultRsize-1) != 0 || *defaultWsize&(*defaultWsize-1) != 0) {
+		logger.Fatal("invalid-block-size-defaults", errors.New("strictBlockSizes requires defaultRsize and defaultWsize to be powers of two"))
+	}
+	if *defaultRsize > 0 || *defaultWsize > 0 {
+		options = append(options, nfsbroker.WithBlockSizeDefaults(*defaultRsize, *defaultWsize))
+	}
+	if *strictBlockSizes {
+		options = append(options, nfsbroker.WithStrictBlockSizes())
+	}
+	if *orgRateInterval < 0 {
+		logger.Fatal("invalid-org-rate-interval", errors.New("orgRateInterval must not be negative"))
+	}
+	if *orgRateInterval > 0 {
+		if *orgRateBurst < 1 {
+			logger.Fatal("invalid-org-rate-burst", errors.New("orgRateBurst must be at least 1"))
+		}
+		options = append(options, nfsbroker.WithOrgRateLimit(*orgRateInterval, *orgRateBurst))
+	}
+	if *checkVolumeIDs {
+		options = append(options, nfsbroker.WithVolumeIDCheck(*repairVolumeIDs))
+	}
+	if *exclusiveBindParameters != "" {
+		groups, err := nfsbroker.ParseExclusiveParameterGroups(*exclusiveBindParameters)
+		if err != nil {
+			logger.Fatal("invalid-exclusive-bind-parameters", err)
+		}
+		options = append(options, nfsbroker.WithExclusiveBindParameters(groups))
+	}
+	if *forcedBindParameters != "" {
+		var parameters map[string]interface{}
+		if err := json.Unmarshal([]byte(*forcedBindParameters), &parameters); err != nil {
+			logger.Fatal("invalid-forced-bind-parameters", err)
+		}
+		options = append(options, nfsbroker.WithForcedBindParameters(parameters))
+	}
+	if *nfsTLSCert != "" || *nfsTLSKey != "" || *nfsTLSCA != "" {
+		options = append(options, nfsbroker.WithTLSClientCredentials(tlsCredentials(logger)))
+	}
 
 	serviceBroker := nfsbroker.New(logger,
 		*serviceName, *serviceId,
-		*dataDir, &osshim.OsShim{}, clock.NewClock(), store)
+		*dataDir, &osshim.OsShim{}, clock.NewClock(), store, options...)
 
 	credentials := brokerapi.BrokerCredentials{Username: username, Password: password}
 	handler := brokerapi.New(serviceBroker, logger.Session("broker-api"), credentials)
 
-	return http_server.New(*atAddress, handler)
+	return http_server.New(*atAddress, nfsbroker.RequestIdentityHandler(handler))
+}
+
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func tlsCredentials(logger lager.Logger) nfsbroker.TLSCredentials {
+	credentials := nfsbroker.TLSCredentials{Cert: *nfsTLSCert, Key: *nfsTLSKey, CA: *nfsTLSCA}
+	if !*nfsTLSInline {
+		return credentials
+	}
+
+	for _, field := range []*string{&credentials.Cert, &credentials.Key, &credentials.CA} {
+		if *field == "" {
+			continue
+		}
+		contents, err := ioutil.ReadFile(*field)
+		if err != nil {
+			logger.Fatal("failed-reading-tls-credential", err, lager.Data{"path": *field})
+		}
+		*field = string(contents)
+	}
+	credentials.Inline = true
+	return credentials
 }
 
 func ConvertPostgresError(err *pq.Error) string {
@@ -195,3 +618,16 @@ func ConvertPostgresError(err *pq.Error) string {
 func ConvertMySqlError(err mysql.MySQLError) string {
 	return ""
 }
+
+// containerPathPattern compiles a container path flag, leaving an empty one unset
+func containerPathPattern(logger lager.Logger, pattern string) *regexp.Regexp {
+	if pattern == "" {
+		return nil
+	}
+
+	compiled, err := regexp.Compile(pattern)
+	if err != nil {
+		logger.Fatal("invalid-container-path-pattern", err, lager.Data{"pattern": pattern})
+	}
+	return compiled
+}
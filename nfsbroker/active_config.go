@@ -0,0 +1,103 @@
+package nfsbroker
+
+import (
+	"text/template"
+	"time"
+)
+
+// Redacted replaces secrets in the configuration ActiveConfig reports
+const Redacted = "[REDACTED]"
+
+// ActiveConfig describes the options a broker is running with, for operators
+// confirming what is live. Secrets are replaced with Redacted.
+type ActiveConfig struct {
+	Plans         []Plan `json:"plans"`
+	DefaultPlanID string `json:"default_plan_id,omitempty"`
+
+	AllowedOrgs            []string            `json:"allowed_orgs,omitempty"`
+	AllowedSpaces          []string            `json:"allowed_spaces,omitempty"`
+	UnknownProvisionFields UnknownFieldsMode   `json:"unknown_provision_fields,omitempty"`
+	DuplicateShares        DuplicateSharesMode `json:"duplicate_shares,omitempty"`
+	MaxInstances           int                 `json:"max_instances,omitempty"`
+	LenientDeprovision     bool                `json:"lenient_deprovision"`
+
+	ForcedBindParameters    map[string]interface{} `json:"forced_bind_parameters,omitempty"`
+	ExclusiveBindParameters [][]string             `json:"exclusive_bind_parameters,omitempty"`
+	ContainerPathAllow      string                 `json:"container_path_allow,omitempty"`
+	ContainerPathDeny       string                 `json:"container_path_deny,omitempty"`
+	Timeo                   int                    `json:"timeo,omitempty"`
+	Retrans                 int                    `json:"retrans,omitempty"`
+	Rsize                   int                    `json:"rsize,omitempty"`
+	Wsize                   int                    `json:"wsize,omitempty"`
+	StrictBlockSizes        bool                   `json:"strict_block_sizes"`
+	MaxMountConfigSize      int                    `json:"max_mount_config_size,omitempty"`
+	MaxVolumeIDLength       int                    `json:"max_volume_id_length,omitempty"`
+	TLSCredentials          TLSCredentials         `json:"tls_credentials"`
+	SyslogDrainURL          string                 `json:"syslog_drain_url,omitempty"`
+	DeviceName              string                 `json:"device_name,omitempty"`
+
+	BindTimeout               time.Duration `json:"bind_timeout,omitempty"`
+	PreflightTimeout          time.Duration `json:"preflight_timeout,omitempty"`
+	ProvisionPreflightTimeout time.Duration `json:"provision_preflight_timeout,omitempty"`
+	OrgRateInterval           time.Duration `json:"org_rate_interval,omitempty"`
+	OrgRateBurst              int           `json:"org_rate_burst,omitempty"`
+}
+
+// ActiveConfig returns a copy of the options the broker was built with
+func (b *Broker) ActiveConfig() ActiveConfig {
+	c := b.config
+	active := ActiveConfig{
+		Plans:                     append([]Plan(nil), c.plans...),
+		DefaultPlanID:             c.defaultPlanID,
+		AllowedOrgs:               append([]string(nil), c.allowedOrgs...),
+		AllowedSpaces:             append([]string(nil), c.allowedSpaces...),
+		UnknownProvisionFields:    c.unknownFields,
+		DuplicateShares:           c.duplicateShares,
+		MaxInstances:              c.maxInstances,
+		LenientDeprovision:        c.lenientDeprovision,
+		Timeo:                     c.timeo,
+		Retrans:                   c.retrans,
+		Rsize:                     c.rsize,
+		Wsize:                     c.wsize,
+		StrictBlockSizes:          c.strictBlockSizes,
+		MaxMountConfigSize:        c.maxMountConfigSize,
+		MaxVolumeIDLength:         c.maxVolumeIDLength,
+		TLSCredentials:            c.tlsCredentials,
+		SyslogDrainURL:            templateText(c.syslogDrainURL),
+		DeviceName:                templateText(c.deviceName),
+		BindTimeout:               c.bindTimeout,
+		PreflightTimeout:          c.preflightTimeout,
+		ProvisionPreflightTimeout: c.provisionPreflightTimeout,
+		OrgRateInterval:           c.orgRateInterval,
+		OrgRateBurst:              c.orgRateBurst,
+	}
+
+	for _, group := range c.exclusiveParameters {
+		active.ExclusiveBindParameters = append(active.ExclusiveBindParameters, append([]string(nil), group...))
+	}
+	if c.forcedBindParameters != nil {
+		active.ForcedBindParameters = copyValue(c.forcedBindParameters).(map[string]interface{})
+		if _, ok := active.ForcedBindParameters[Secret]; ok {
+			active.ForcedBindParameters[Secret] = Redacted
+		}
+	}
+	if c.containerPathAllow != nil {
+		active.ContainerPathAllow = c.containerPathAllow.String()
+	}
+	if c.containerPathDeny != nil {
+		active.ContainerPathDeny = c.containerPathDeny.String()
+	}
+	// inline credentials hold the key itself rather than a path to it
+	if c.tlsCredentials.Inline && c.tlsCredentials.Key != "" {
+		active.TLSCredentials.Key = Redacted
+	}
+
+	return active
+}
+
+func templateText(tmpl *template.Template) string {
+	if tmpl == nil || tmpl.Tree == nil {
+		return ""
+	}
+	return tmpl.Tree.Root.String()
+}
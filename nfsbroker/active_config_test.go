@@ -0,0 +1,78 @@
+package nfsbroker_test
+
+import (
+	"regexp"
+	"text/template"
+	"time"
+
+	"code.cloudfoundry.org/clock/fakeclock"
+	"code.cloudfoundry.org/goshims/osshim/os_fake"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/nfsbroker/nfsbroker"
+	"code.cloudfoundry.org/nfsbroker/nfsbrokerfakes"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ActiveConfig", func() {
+	var broker *nfsbroker.Broker
+
+	newBroker := func(options ...nfsbroker.Option) *nfsbroker.Broker {
+		return nfsbroker.New(
+			lagertest.NewTestLogger("test-broker"),
+			"service-name", "service-id", "/fake-dir",
+			&os_fake.FakeOs{},
+			fakeclock.NewFakeClock(time.Date(2017, time.June, 1, 12, 0, 0, 0, time.UTC)),
+			&nfsbrokerfakes.FakeStore{},
+			options...,
+		)
+	}
+
+	BeforeEach(func() {
+		broker = newBroker(
+			nfsbroker.WithDefaultPlan("Existing"),
+			nfsbroker.WithProvisionAllowlist([]string{"org-guid"}, nil),
+			nfsbroker.WithForcedBindParameters(map[string]interface{}{"readonly": true, nfsbroker.Secret: "forced keytab"}),
+			nfsbroker.WithRetryDefaults(600, 3),
+			nfsbroker.WithContainerPathPatterns(regexp.MustCompile(`^/data/`), nil),
+			nfsbroker.WithSyslogDrainURL(template.Must(template.New("syslogDrainURL").Parse("syslog://logs.example.com/{{.AppGUID}}"))),
+			nfsbroker.WithTLSClientCredentials(nfsbroker.TLSCredentials{Cert: "cert pem", Key: "key pem", CA: "ca pem", Inline: true}),
+			nfsbroker.WithBindTimeout(30*time.Second),
+			nfsbroker.WithSharePreflight(time.Second),
+			nfsbroker.WithProvisionPreflight(2*time.Second),
+		)
+	})
+
+	It("reports the options the broker was built with", func() {
+		config := broker.ActiveConfig()
+		Expect(config.Plans).To(Equal(nfsbroker.DefaultPlans))
+		Expect(config.DefaultPlanID).To(Equal("Existing"))
+		Expect(config.AllowedOrgs).To(Equal([]string{"org-guid"}))
+		Expect(config.Timeo).To(Equal(600))
+		Expect(config.Retrans).To(Equal(3))
+		Expect(config.ContainerPathAllow).To(Equal(`^/data/`))
+		Expect(config.SyslogDrainURL).To(Equal("syslog://logs.example.com/{{.AppGUID}}"))
+		Expect(config.BindTimeout).To(Equal(30 * time.Second))
+		Expect(config.PreflightTimeout).To(Equal(time.Second))
+		Expect(config.ProvisionPreflightTimeout).To(Equal(2 * time.Second))
+		Expect(config.ForcedBindParameters).To(HaveKeyWithValue("readonly", true))
+	})
+
+	It("redacts secrets", func() {
+		config := broker.ActiveConfig()
+		Expect(config.ForcedBindParameters).To(HaveKeyWithValue(nfsbroker.Secret, nfsbroker.Redacted))
+		Expect(config.TLSCredentials).To(Equal(nfsbroker.TLSCredentials{Cert: "cert pem", Key: nfsbroker.Redacted, CA: "ca pem", Inline: true}))
+	})
+
+	It("returns a copy that does not affect the broker", func() {
+		config := broker.ActiveConfig()
+		config.ForcedBindParameters["readonly"] = false
+		Expect(broker.ActiveConfig().ForcedBindParameters).To(HaveKeyWithValue("readonly", true))
+	})
+
+	It("leaves key paths alone", func() {
+		broker = newBroker(nfsbroker.WithTLSClientCredentials(nfsbroker.TLSCredentials{Cert: "/certs/cert.pem", Key: "/certs/key.pem"}))
+		Expect(broker.ActiveConfig().TLSCredentials.Key).To(Equal("/certs/key.pem"))
+	})
+})
@@ -0,0 +1,19 @@
+package nfsbroker
+
+import "github.com/pivotal-cf/brokerapi"
+
+//go:generate counterfeiter -o ../nfsbrokerfakes/fake_idresolver.go . IDResolver
+
+// IDResolver supplies the uid and gid for binds still missing one after
+// instance defaults and forced parameters apply, for platforms that can derive
+// them from the app or space. Ids the bind has are kept, and an empty id
+// leaves that id missing.
+type IDResolver interface {
+	ResolveIDs(instance ServiceInstance, details brokerapi.BindDetails) (uid, gid string, err error)
+}
+
+type noopIDResolver struct{}
+
+func (noopIDResolver) ResolveIDs(ServiceInstance, brokerapi.BindDetails) (string, string, error) {
+	return "", "", nil
+}
@@ -0,0 +1,174 @@
+package nfsbroker
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/clock"
+	"code.cloudfoundry.org/lager"
+)
+
+const (
+	DefaultLockLease         = time.Minute
+	DefaultLockRetryInterval = 100 * time.Millisecond
+
+	// DefaultLockErrorLimit is how many store errors in a row acquiring the
+	// lock gives up after
+	DefaultLockErrorLimit = 10
+)
+
+// ErrLockLost is reported by StoreLock.Err when a renewal found the lease
+// taken by another broker
+var ErrLockLost = errors.New("the lock expired and another broker took it")
+
+type StoreLock struct {
+	logger lager.Logger
+	locker Locker
+	clock  clock.Clock
+	owner  string
+	local  sync.Mutex
+
+	stopRenewing chan struct{}
+	renewing     sync.WaitGroup
+
+	errMutex sync.Mutex
+	err      error
+}
+
+func NewStoreLock(logger lager.Logger, locker Locker, clock clock.Clock, owner string) *StoreLock {
+	return &StoreLock{
+		logger: logger.Session("store-lock", lager.Data{"owner": owner}),
+		locker: locker,
+		clock:  clock,
+		owner:  owner,
+	}
+}
+
+// LockContext blocks until the lock is held both within this process and in
+// the backing store, so critical sections are serialized across brokers. It
+// fails when ctx is done first, or when the store fails DefaultLockErrorLimit
+// times in a row. The lease is renewed until Unlock.
+func (l *StoreLock) LockContext(ctx context.Context) error {
+	if err := lockContext(ctx, &l.local); err != nil {
+		return err
+	}
+
+	failures := 0
+	for {
+		acquired, err := l.locker.TryLock(l.logger, l.owner, l.clock.Now(), DefaultLockLease)
+		if err != nil {
+			failures++
+			l.logger.Error("failed-to-acquire-lock", err, lager.Data{"failures": failures})
+			if failures >= DefaultLockErrorLimit {
+				l.local.Unlock()
+				return err
+			}
+		} else if acquired {
+			l.setErr(nil)
+			l.startRenewing()
+			return nil
+		} else {
+			failures = 0
+		}
+
+		select {
+		case <-l.clock.After(DefaultLockRetryInterval):
+		case <-ctx.Done():
+			l.local.Unlock()
+			return ctx.Err()
+		}
+	}
+}
+
+func (l *StoreLock) Unlock() {
+	defer l.local.Unlock()
+
+	close(l.stopRenewing)
+	l.renewing.Wait()
+
+	if err := l.locker.ReleaseLock(l.logger, l.owner); err != nil {
+		l.logger.Error("failed-to-release-lock", err)
+	}
+}
+
+// startRenewing extends the lease every third of it, so that a critical
+// section outlasting one lease does not let another broker in
+func (l *StoreLock) startRenewing() {
+	l.stopRenewing = make(chan struct{})
+	l.renewing.Add(1)
+
+	go func(stop <-chan struct{}) {
+		defer l.renewing.Done()
+
+		ticker := l.clock.NewTicker(DefaultLockLease / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C():
+				held, err := l.locker.RenewLock(l.logger, l.owner, l.clock.Now(), DefaultLockLease)
+				if err == nil && !held {
+					err = ErrLockLost
+				}
+				if err != nil {
+					l.setErr(err)
+					l.logger.Error("failed-to-renew-lock", err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}(l.stopRenewing)
+}
+
+// Err returns why the lock may no longer be held, when renewing its lease
+// failed since it was acquired. Nothing should be saved once it is set.
+func (l *StoreLock) Err() error {
+	l.errMutex.Lock()
+	defer l.errMutex.Unlock()
+	return l.err
+}
+
+func (l *StoreLock) setErr(err error) {
+	l.errMutex.Lock()
+	defer l.errMutex.Unlock()
+	l.err = err
+}
+
+// lockContext acquires l unless ctx is done first. An abandoned acquisition
+// releases the lock again as soon as it completes.
+func lockContext(ctx context.Context, l sync.Locker) error {
+	if ctx.Done() == nil {
+		l.Lock()
+		return nil
+	}
+
+	acquired := make(chan struct{})
+	go func() {
+		l.Lock()
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+		return nil
+	case <-ctx.Done():
+		go func() {
+			<-acquired
+			l.Unlock()
+		}()
+		return ctx.Err()
+	}
+}
+
+func newLockOwner() string {
+	bytes := make([]byte, 16)
+	if _, err := rand.Read(bytes); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(bytes)
+}
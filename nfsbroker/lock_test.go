@@ -0,0 +1,217 @@
+package nfsbroker_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/clock/fakeclock"
+	"code.cloudfoundry.org/goshims/osshim/os_fake"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/nfsbroker/nfsbroker"
+	"code.cloudfoundry.org/nfsbroker/nfsbrokerfakes"
+	"github.com/pivotal-cf/brokerapi"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+)
+
+var _ = Describe("StoreLock", func() {
+	var (
+		logger    lager.Logger
+		fakeClock *fakeclock.FakeClock
+
+		tableMutex sync.Mutex
+		holder     string
+
+		lockerA, lockerB *nfsbrokerfakes.FakeLocker
+		lockA, lockB     *nfsbroker.StoreLock
+	)
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("test-store-lock")
+		fakeClock = fakeclock.NewFakeClock(time.Now())
+		holder = ""
+
+		// both fake stores share one lock row, as two brokers sharing a database would
+		tryLock := func(logger lager.Logger, owner string, now time.Time, lease time.Duration) (bool, error) {
+			tableMutex.Lock()
+			defer tableMutex.Unlock()
+			if holder != "" && holder != owner {
+				return false, nil
+			}
+			holder = owner
+			return true, nil
+		}
+		releaseLock := func(logger lager.Logger, owner string) error {
+			tableMutex.Lock()
+			defer tableMutex.Unlock()
+			if holder == owner {
+				holder = ""
+			}
+			return nil
+		}
+
+		lockerA = &nfsbrokerfakes.FakeLocker{TryLockStub: tryLock, ReleaseLockStub: releaseLock}
+		lockerB = &nfsbrokerfakes.FakeLocker{TryLockStub: tryLock, ReleaseLockStub: releaseLock}
+
+		lockA = nfsbroker.NewStoreLock(logger, lockerA, fakeClock, "broker-a")
+		lockB = nfsbroker.NewStoreLock(logger, lockerB, fakeClock, "broker-b")
+	})
+
+	It("acquires the lock in the store", func() {
+		Expect(lockA.LockContext(context.Background())).To(Succeed())
+		Expect(lockerA.TryLockCallCount()).To(Equal(1))
+		_, owner, _, lease := lockerA.TryLockArgsForCall(0)
+		Expect(owner).To(Equal("broker-a"))
+		Expect(lease).To(Equal(nfsbroker.DefaultLockLease))
+
+		lockA.Unlock()
+		Expect(lockerA.ReleaseLockCallCount()).To(Equal(1))
+	})
+
+	Context("when two brokers contend for the lock", func() {
+		var acquired chan struct{}
+
+		BeforeEach(func() {
+			acquired = make(chan struct{})
+
+			Expect(lockA.LockContext(context.Background())).To(Succeed())
+			go func() {
+				defer GinkgoRecover()
+				Expect(lockB.LockContext(context.Background())).To(Succeed())
+				close(acquired)
+			}()
+		})
+
+		It("blocks the second broker until the first releases", func() {
+			// the first broker's lease renewal is watching the clock too
+			fakeClock.WaitForNWatchersAndIncrement(nfsbroker.DefaultLockRetryInterval, 2)
+			Consistently(acquired).ShouldNot(BeClosed())
+
+			lockA.Unlock()
+			fakeClock.WaitForWatcherAndIncrement(nfsbroker.DefaultLockRetryInterval)
+			Eventually(acquired).Should(BeClosed())
+			Expect(holder).To(Equal("broker-b"))
+
+			lockB.Unlock()
+			Expect(holder).To(BeEmpty())
+		})
+	})
+
+	It("renews the lease until released", func() {
+		Expect(lockA.LockContext(context.Background())).To(Succeed())
+
+		fakeClock.WaitForWatcherAndIncrement(nfsbroker.DefaultLockLease / 3)
+		Eventually(lockerA.RenewLockCallCount).Should(Equal(1))
+		_, owner, _, lease := lockerA.RenewLockArgsForCall(0)
+		Expect(owner).To(Equal("broker-a"))
+		Expect(lease).To(Equal(nfsbroker.DefaultLockLease))
+
+		lockA.Unlock()
+		fakeClock.Increment(nfsbroker.DefaultLockLease)
+		Consistently(lockerA.RenewLockCallCount).Should(Equal(1))
+	})
+
+	Context("when a renewal finds the lock taken", func() {
+		BeforeEach(func() {
+			lockerA.RenewLockReturns(false, nil)
+		})
+
+		It("reports the lock lost until it is acquired again", func() {
+			Expect(lockA.LockContext(context.Background())).To(Succeed())
+			Expect(lockA.Err()).NotTo(HaveOccurred())
+
+			fakeClock.WaitForWatcherAndIncrement(nfsbroker.DefaultLockLease / 3)
+			Eventually(lockA.Err).Should(MatchError(nfsbroker.ErrLockLost))
+			lockA.Unlock()
+
+			Expect(lockA.LockContext(context.Background())).To(Succeed())
+			Expect(lockA.Err()).NotTo(HaveOccurred())
+			lockA.Unlock()
+		})
+	})
+
+	It("gives up when the context is done", func() {
+		Expect(lockA.LockContext(context.Background())).To(Succeed())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		errs := make(chan error)
+		go func() {
+			errs <- lockB.LockContext(ctx)
+		}()
+
+		Eventually(lockerB.TryLockCallCount).Should(Equal(1))
+		cancel()
+		Eventually(errs).Should(Receive(Equal(context.Canceled)))
+	})
+
+	Context("when the store keeps failing", func() {
+		BeforeEach(func() {
+			lockerA.TryLockStub = nil
+			lockerA.TryLockReturns(false, errors.New("connection refused"))
+		})
+
+		It("gives up after DefaultLockErrorLimit attempts", func() {
+			errs := make(chan error)
+			go func() {
+				errs <- lockA.LockContext(context.Background())
+			}()
+
+			for i := 1; i < nfsbroker.DefaultLockErrorLimit; i++ {
+				fakeClock.WaitForWatcherAndIncrement(nfsbroker.DefaultLockRetryInterval)
+			}
+			Eventually(errs).Should(Receive(MatchError("connection refused")))
+			Expect(lockerA.TryLockCallCount()).To(Equal(nfsbroker.DefaultLockErrorLimit))
+
+			// the local lock is released again
+			lockerA.TryLockReturns(true, nil)
+			Expect(lockA.LockContext(context.Background())).To(Succeed())
+		})
+	})
+})
+
+var _ = Describe("Broker with a store lock", func() {
+	var (
+		logger     *lagertest.TestLogger
+		fakeClock  *fakeclock.FakeClock
+		fakeStore  *nfsbrokerfakes.FakeStore
+		fakeLocker *nfsbrokerfakes.FakeLocker
+		broker     *nfsbroker.Broker
+	)
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("test-broker-store-lock")
+		fakeClock = fakeclock.NewFakeClock(time.Now())
+		fakeStore = &nfsbrokerfakes.FakeStore{}
+		fakeLocker = &nfsbrokerfakes.FakeLocker{}
+		fakeLocker.TryLockReturns(true, nil)
+
+		broker = nfsbroker.New(logger, "service-name", "service-id", "/fake-dir", &os_fake.FakeOs{}, fakeClock, &lockingStore{FakeStore: fakeStore, FakeLocker: fakeLocker})
+	})
+
+	Context("when renewing the lease finds the lock taken during a change", func() {
+		BeforeEach(func() {
+			fakeLocker.RenewLockReturns(false, nil)
+
+			// reloading under the lock outlasts a renewal
+			fakeStore.RestoreStub = func(lager.Logger, *nfsbroker.DynamicState) error {
+				fakeClock.WaitForWatcherAndIncrement(nfsbroker.DefaultLockLease / 3)
+				Eventually(fakeLocker.RenewLockCallCount).Should(Equal(1))
+				Eventually(logger.Buffer()).Should(gbytes.Say("failed-to-renew-lock"))
+				return nil
+			}
+		})
+
+		It("refuses to save the change", func() {
+			details := brokerapi.ProvisionDetails{PlanID: "Existing", RawParameters: json.RawMessage(`{"share":"server:/some-share"}`)}
+			_, err := broker.Provision(context.Background(), "some-instance-id", details, false)
+			Expect(err).To(MatchError(nfsbroker.ErrLockLost))
+			Expect(fakeStore.SaveCallCount()).To(BeZero())
+		})
+	})
+})
@@ -0,0 +1,82 @@
+package nfsbroker
+
+import (
+	"fmt"
+	"strings"
+
+	"code.cloudfoundry.org/lager"
+)
+
+// ParseLogLevel accepts debug, info, error or fatal, in any case
+func ParseLogLevel(level string) (lager.LogLevel, error) {
+	switch strings.ToLower(strings.TrimSpace(level)) {
+	case "debug":
+		return lager.DEBUG, nil
+	case "info":
+		return lager.INFO, nil
+	case "error":
+		return lager.ERROR, nil
+	case "fatal":
+		return lager.FATAL, nil
+	default:
+		return lager.INFO, fmt.Errorf("unknown log level: %s", level)
+	}
+}
+
+// ParseSessionLogLevels parses "session:level" pairs separated by commas, e.g. "bind:debug,provision:error"
+func ParseSessionLogLevels(levels string) (map[string]lager.LogLevel, error) {
+	sessionLevels := map[string]lager.LogLevel{}
+	for _, pair := range strings.Split(levels, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("invalid session log level: %s", pair)
+		}
+
+		level, err := ParseLogLevel(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		sessionLevels[strings.TrimSpace(parts[0])] = level
+	}
+	return sessionLevels, nil
+}
+
+type sessionLevelSink struct {
+	sink          lager.Sink
+	minLevel      lager.LogLevel
+	sessionLevels map[string]lager.LogLevel
+}
+
+// NewSessionLevelSink forwards logs at or above minLevel, except that logs
+// emitted within a session named in sessionLevels use that session's level
+// instead. The most deeply nested named session wins.
+func NewSessionLevelSink(sink lager.Sink, minLevel lager.LogLevel, sessionLevels map[string]lager.LogLevel) lager.Sink {
+	return &sessionLevelSink{
+		sink:          sink,
+		minLevel:      minLevel,
+		sessionLevels: sessionLevels,
+	}
+}
+
+func (s *sessionLevelSink) Log(log lager.LogFormat) {
+	if log.LogLevel >= s.levelFor(log.Message) {
+		s.sink.Log(log)
+	}
+}
+
+func (s *sessionLevelSink) levelFor(message string) lager.LogLevel {
+	level := s.minLevel
+
+	// messages look like "component.session.subsession.action"
+	segments := strings.Split(message, ".")
+	for _, segment := range segments[:len(segments)-1] {
+		if sessionLevel, ok := s.sessionLevels[segment]; ok {
+			level = sessionLevel
+		}
+	}
+	return level
+}
@@ -0,0 +1,70 @@
+package nfsbroker_test
+
+import (
+	"errors"
+
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/nfsbroker/nfsbroker"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Log levels", func() {
+	Describe("ParseSessionLogLevels", func() {
+		It("parses session and level pairs", func() {
+			levels, err := nfsbroker.ParseSessionLogLevels("bind:debug, provision:ERROR")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(levels).To(Equal(map[string]lager.LogLevel{"bind": lager.DEBUG, "provision": lager.ERROR}))
+		})
+
+		It("errors on an unknown level", func() {
+			_, err := nfsbroker.ParseSessionLogLevels("bind:loud")
+			Expect(err).To(MatchError("unknown log level: loud"))
+		})
+
+		It("errors on a pair without a level", func() {
+			_, err := nfsbroker.ParseSessionLogLevels("bind")
+			Expect(err).To(MatchError("invalid session log level: bind"))
+		})
+	})
+
+	Describe("SessionLevelSink", func() {
+		var (
+			testSink *lagertest.TestSink
+			logger   lager.Logger
+		)
+
+		BeforeEach(func() {
+			testSink = lagertest.NewTestSink()
+			logger = lager.NewLogger("nfsbroker")
+			logger.RegisterSink(nfsbroker.NewSessionLevelSink(testSink, lager.ERROR, map[string]lager.LogLevel{
+				"bind":       lager.DEBUG,
+				"save-state": lager.ERROR,
+			}))
+		})
+
+		It("suppresses logs below the minimum level", func() {
+			logger.Session("provision").Info("start")
+			logger.Session("provision").Debug("details")
+			Expect(testSink.Logs()).To(BeEmpty())
+		})
+
+		It("emits logs at or above the minimum level", func() {
+			logger.Session("provision").Error("failed", errors.New("badness"))
+			Expect(testSink.LogMessages()).To(Equal([]string{"nfsbroker.provision.failed"}))
+		})
+
+		It("uses the level of a named session", func() {
+			logger.Session("bind").Debug("details")
+			Expect(testSink.LogMessages()).To(Equal([]string{"nfsbroker.bind.details"}))
+		})
+
+		It("uses the level of the most deeply nested named session", func() {
+			logger.Session("bind").Session("save-state").Info("start")
+			logger.Session("bind").Session("other").Info("start")
+			Expect(testSink.LogMessages()).To(Equal([]string{"nfsbroker.bind.other.start"}))
+		})
+	})
+})
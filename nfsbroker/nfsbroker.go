@@ -6,9 +6,16 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
+	"net/http"
 	"path"
 	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"crypto/md5"
 
@@ -20,7 +27,22 @@ import (
 
 const (
 	PermissionVolumeMount = brokerapi.RequiredPermission("volume_mount")
+	PermissionSyslogDrain = brokerapi.RequiredPermission("syslog_drain")
 	DefaultContainerPath  = "/var/vcap/data"
+	DefaultNFSPort        = 2049
+
+	// DefaultNFSProto is the transport used when a bind does not set proto; it
+	// is left out of the mount source
+	DefaultNFSProto = "tcp"
+
+	// AccessModeReadWriteOnce promises a single writer, so the share is
+	// mounted without network locking
+	AccessModeReadWriteOnce = "read-write-once"
+	// AccessModeReadWriteMany allows concurrent writers, which rely on locking
+	AccessModeReadWriteMany = "read-write-many"
+
+	// MinVolumeIDLength leaves room for a hash suffix and one prefix character
+	MinVolumeIDLength = 2*md5.Size + 2
 )
 
 const (
@@ -28,6 +50,59 @@ const (
 	Secret   string = "kerberosKeytab"
 )
 
+const (
+	ScopeSpace string = "space"
+	ScopeApp   string = "app"
+)
+
+var errInvalidPort = invalidParameters(errors.New("port must be an integer between 1 and 65535"), "invalid-port")
+
+var permissionBitsPattern = regexp.MustCompile(`^0?[0-7]{3}$`)
+
+var volumeIDUnsafeChars = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// securityFlavors are the NFS sec options an instance may be provisioned with
+var securityFlavors = []string{"sys", "krb5", "krb5i", "krb5p"}
+
+// nfsVersions are the NFS protocol versions an instance or bind may select
+var nfsVersions = []string{"3", "4.0", "4.1", "4.2"}
+
+var errInvalidNFSVersion = invalidParameters(errors.New(`version must be one of "3", "4.0", "4.1" or "4.2"`), "invalid-version")
+
+var accessModes = []string{AccessModeReadWriteOnce, AccessModeReadWriteMany}
+var errInvalidAccessMode = fmt.Errorf("access_mode must be %q or %q", AccessModeReadWriteOnce, AccessModeReadWriteMany)
+
+// knownProvisionFields are the provision parameters Provision understands
+var knownProvisionFields = []string{"share", "sec", "version", "bind_defaults"}
+
+var errTLSCredentialsMisconfigured = errors.New("the broker's tls client credentials are misconfigured")
+
+// ErrProvisionNotAllowed is returned from Provision when neither the org nor
+// the space is on the configured allowlist
+var ErrProvisionNotAllowed = brokerapi.NewFailureResponse(errors.New("this org and space are not allowed to provision this service"), http.StatusForbidden, "provision-not-allowed")
+
+// ErrDuplicateShare is returned from Provision when duplicate shares are
+// rejected and another instance already uses the share
+var ErrDuplicateShare = brokerapi.NewFailureResponse(errors.New("another service instance already uses this share"), http.StatusConflict, "duplicate-share")
+
+// ErrContainerPathNotAllowed is returned from Bind when the mount parameter
+// asks for a container path the configured patterns rule out
+var ErrContainerPathNotAllowed = invalidParameters(errors.New("the requested container path is not allowed"), "container-path-not-allowed")
+
+var errShareUnreachable = errors.New("nfs server for this share is not reachable")
+
+// ErrShareUnreachable is returned from Bind when the preflight check cannot
+// connect to the NFS server
+var ErrShareUnreachable = brokerapi.NewFailureResponse(errShareUnreachable, http.StatusUnprocessableEntity, "share-unreachable")
+
+// ErrProvisionShareUnreachable is returned from Provision when the preflight
+// check is enabled for provisioning and cannot connect to the NFS server
+var ErrProvisionShareUnreachable = brokerapi.NewFailureResponse(errShareUnreachable, http.StatusUnprocessableEntity, "share-unreachable")
+
+// ErrInstanceChanged is returned from Bind when the instance was replaced by
+// one with another share while the preflight check was connecting
+var ErrInstanceChanged = brokerapi.NewFailureResponse(errors.New("the service instance changed while binding, please retry"), http.StatusUnprocessableEntity, "instance-changed")
+
 type staticState struct {
 	ServiceName string `json:"ServiceName"`
 	ServiceId   string `json:"ServiceId"`
@@ -39,27 +114,119 @@ type ServiceInstance struct {
 	OrganizationGUID string `json:"organization_guid"`
 	SpaceGUID        string `json:"space_guid"`
 	Share            string
+	Sec              string `json:"sec,omitempty"`
+	Version          string `json:"version,omitempty"`
+
+	// BindDefaults are bind parameters applied to every bind of the instance
+	// that does not set them itself
+	BindDefaults map[string]interface{} `json:"bind_defaults,omitempty"`
+
+	Platform         string `json:"platform,omitempty"`
+	OrganizationName string `json:"organization_name,omitempty"`
+	SpaceName        string `json:"space_name,omitempty"`
+
+	// Metadata holds provision parameters the broker does not know, when it
+	// is configured to keep them
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+
+	// CreatedAt and UpdatedAt are zero for records saved before they were kept
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
 }
 
-type DynamicState struct {
-	InstanceMap map[string]ServiceInstance
-	BindingMap  map[string]brokerapi.BindDetails
+// platformContext is the optional OSB context object describing where an
+// instance lives in human readable terms
+type platformContext struct {
+	Platform         string `json:"platform"`
+	OrganizationName string `json:"organization_name"`
+	SpaceName        string `json:"space_name"`
+}
+
+type ServiceBinding struct {
+	InstanceID string                `json:"instance_id"`
+	Details    brokerapi.BindDetails `json:"details"`
+
+	// VolumeID is the volume id last returned for the binding; it is empty
+	// for records saved before it was kept
+	VolumeID string `json:"volume_id,omitempty"`
+
+	// RotatedSecret replaces the kerberos keytab in Details once the
+	// credentials are rotated. Details are kept as bound, so that the
+	// platform retrying the original bind is not refused as a conflict.
+	RotatedSecret string `json:"rotated_secret,omitempty"`
+
+	// CreatedAt and UpdatedAt are zero for records saved before they were kept
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// UnmarshalJSON also accepts records persisted before the instance id was
+// stored, which hold the bind details directly; their InstanceID is left empty.
+func (sb *ServiceBinding) UnmarshalJSON(data []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+
+	if _, ok := fields["details"]; !ok {
+		*sb = ServiceBinding{}
+		return json.Unmarshal(data, &sb.Details)
+	}
+
+	type serviceBinding ServiceBinding
+	return json.Unmarshal(data, (*serviceBinding)(sb))
+}
+
+// belongsTo is lenient for legacy records that carry no instance id
+func (sb ServiceBinding) belongsTo(instanceID string) bool {
+	return sb.InstanceID == "" || sb.InstanceID == instanceID
+}
+
+// currentDetails are the bind details with any rotated keytab in place
+func (sb ServiceBinding) currentDetails() brokerapi.BindDetails {
+	if sb.RotatedSecret == "" {
+		return sb.Details
+	}
+
+	details := sb.Details
+	details.Parameters = map[string]interface{}{}
+	for key, value := range sb.Details.Parameters {
+		details.Parameters[key] = value
+	}
+	details.Parameters[Secret] = sb.RotatedSecret
+	return details
 }
 
-type lock interface {
-	Lock()
-	Unlock()
+type DynamicState struct {
+	InstanceMap map[string]ServiceInstance
+	BindingMap  map[string]ServiceBinding
 }
 
 type Broker struct {
 	logger  lager.Logger
 	dataDir string
 	os      osshim.Os
-	mutex   lock
+	mutex   sync.Mutex
 	clock   clock.Clock
 	static  staticState
 	dynamic DynamicState
 	store   Store
+	config  brokerConfig
+
+	// storeLock serializes changes with the other brokers sharing the store;
+	// it is nil when the store is this broker's alone
+	storeLock *StoreLock
+
+	orgLimiter *rateLimiter
+}
+
+// bindingTemplateData is what the syslog drain and device name templates are
+// rendered with
+type bindingTemplateData struct {
+	InstanceID string
+	BindingID  string
+	AppGUID    string
+	ServiceInstance
 }
 
 func New(
@@ -68,13 +235,22 @@ func New(
 	os osshim.Os,
 	clock clock.Clock,
 	store Store,
+	options ...Option,
 ) *Broker {
+	if os == nil {
+		panic("os cannot be nil")
+	}
+	if clock == nil {
+		panic("clock cannot be nil")
+	}
+	if store == nil {
+		panic("store cannot be nil")
+	}
 
 	theBroker := Broker{
 		logger:  logger,
 		dataDir: dataDir,
 		os:      os,
-		mutex:   &sync.Mutex{},
 		clock:   clock,
 		store:   store,
 		static: staticState{
@@ -83,20 +259,135 @@ func New(
 		},
 		dynamic: DynamicState{
 			InstanceMap: map[string]ServiceInstance{},
-			BindingMap:  map[string]brokerapi.BindDetails{},
+			BindingMap:  map[string]ServiceBinding{},
 		},
 	}
 
-	theBroker.store.Restore(logger, &theBroker.dynamic)
+	for _, option := range options {
+		option(&theBroker.config)
+	}
+	if len(theBroker.config.plans) == 0 {
+		theBroker.config.plans = DefaultPlans
+	}
+	if theBroker.config.shareNormalizer == nil {
+		theBroker.config.shareNormalizer = DefaultShareNormalizer
+	}
+	if theBroker.config.idResolver == nil {
+		theBroker.config.idResolver = noopIDResolver{}
+	}
+
+	if theBroker.config.orgRateInterval > 0 {
+		theBroker.orgLimiter = newRateLimiter(clock, theBroker.config.orgRateInterval, theBroker.config.orgRateBurst)
+	}
+
+	if locker, ok := store.(Locker); ok {
+		theBroker.storeLock = NewStoreLock(logger, locker, clock, newLockOwner())
+	}
+
+	if err := theBroker.store.Restore(logger, &theBroker.dynamic); err != nil {
+		logger.Error("failed-to-restore-state", err)
+	}
+
+	if theBroker.config.volumeIDCheck {
+		if _, err := theBroker.CheckVolumeIDs(theBroker.config.volumeIDRepair); err != nil {
+			logger.Error("failed-to-check-volume-ids", err)
+		}
+	}
 
 	return &theBroker
 }
 
+// lock serializes a change to the broker's state. A store shared with other
+// brokers is locked too, and the state reloaded from it, since they may have
+// changed it.
+func (b *Broker) lock(ctx context.Context, logger lager.Logger) error {
+	if err := lockContext(ctx, &b.mutex); err != nil {
+		logger.Error("failed-to-acquire-lock", err)
+		return err
+	}
+	if b.storeLock == nil {
+		return nil
+	}
+
+	if err := b.storeLock.LockContext(ctx); err != nil {
+		b.mutex.Unlock()
+		logger.Error("failed-to-acquire-store-lock", err)
+		return err
+	}
+	if err := b.reload(logger); err != nil {
+		b.unlock()
+		return err
+	}
+	return nil
+}
+
+func (b *Broker) unlock() {
+	if b.storeLock != nil {
+		b.storeLock.Unlock()
+	}
+	b.mutex.Unlock()
+}
+
+// save stores the named records of the broker's state, unless the store lock
+// was lost since b.lock, in which case another broker may have changed them
+func (b *Broker) save(logger lager.Logger, instanceID, bindingID string) error {
+	if err := b.lockErr(); err != nil {
+		return err
+	}
+	return b.store.Save(logger, &b.dynamic, instanceID, bindingID)
+}
+
+// saveAll stores the whole of the broker's state, unless the store lock was
+// lost since b.lock
+func (b *Broker) saveAll(logger lager.Logger) error {
+	if err := b.lockErr(); err != nil {
+		return err
+	}
+	return b.store.SaveAll(logger, &b.dynamic)
+}
+
+func (b *Broker) lockErr() error {
+	if b.storeLock == nil {
+		return nil
+	}
+	return b.storeLock.Err()
+}
+
+// reload replaces the state held in memory with that of a store shared with
+// other brokers. Records the store cannot read are left out, as on startup.
+// Callers hold b.mutex; reading does not need the store lock.
+func (b *Broker) reload(logger lager.Logger) error {
+	if b.storeLock == nil {
+		return nil
+	}
+
+	state := DynamicState{InstanceMap: map[string]ServiceInstance{}, BindingMap: map[string]ServiceBinding{}}
+	if err := b.store.Restore(logger, &state); err != nil {
+		if _, partial := err.(RestoreErrors); !partial {
+			logger.Error("failed-to-reload-state", err)
+			return err
+		}
+		logger.Error("skipping-unreadable-records", err)
+	}
+	b.dynamic = state
+	return nil
+}
+
 func (b *Broker) Services(_ context.Context) []brokerapi.Service {
 	logger := b.logger.Session("services")
 	logger.Info("start")
 	defer logger.Info("end")
 
+	plans := []brokerapi.ServicePlan{}
+	for _, plan := range b.config.plans {
+		plans = append(plans, plan.servicePlan())
+	}
+
+	requires := []brokerapi.RequiredPermission{PermissionVolumeMount}
+	if b.config.syslogDrainURL != nil {
+		requires = append(requires, PermissionSyslogDrain)
+	}
+
 	return []brokerapi.Service{{
 		ID:            b.static.ServiceId,
 		Name:          b.static.ServiceName,
@@ -104,85 +395,220 @@ func (b *Broker) Services(_ context.Context) []brokerapi.Service {
 		Bindable:      true,
 		PlanUpdatable: false,
 		Tags:          []string{"nfs"},
-		Requires:      []brokerapi.RequiredPermission{PermissionVolumeMount},
+		Requires:      requires,
 
-		Plans: []brokerapi.ServicePlan{
-			{
-				Name:        "Existing",
-				ID:          "Existing",
-				Description: "A preexisting filesystem",
-			},
-		},
+		Plans: plans,
 	}}
 }
 
 func (b *Broker) Provision(context context.Context, instanceID string, details brokerapi.ProvisionDetails, asyncAllowed bool) (brokerapi.ProvisionedServiceSpec, error) {
-	logger := b.logger.Session("provision").WithData(lager.Data{"instanceID": instanceID})
+	logger := b.requestSession(context, "provision").WithData(lager.Data{"instanceID": instanceID})
 	logger.Info("start")
 	defer logger.Info("end")
 
-	if b.instanceConflicts(details, instanceID) {
-		return brokerapi.ProvisionedServiceSpec{}, brokerapi.ErrInstanceAlreadyExists
+	if details.PlanID == "" {
+		details.PlanID = b.config.defaultPlanID
+	}
+	if _, ok := b.plan(details.PlanID); !ok {
+		logger.Info("unknown-plan", lager.Data{"planID": details.PlanID})
+		return brokerapi.ProvisionedServiceSpec{}, invalidParameters(fmt.Errorf("plan %q is not offered by this broker", details.PlanID), "unknown-plan")
+	}
+
+	if !b.provisionAllowed(details.OrganizationGUID, details.SpaceGUID) {
+		logger.Info("provision-not-allowed", lager.Data{"organizationGUID": details.OrganizationGUID, "spaceGUID": details.SpaceGUID})
+		return brokerapi.ProvisionedServiceSpec{}, ErrProvisionNotAllowed
 	}
 
 	type Configuration struct {
-		Share string `json:"share"`
+		Share        string                 `json:"share"`
+		Sec          string                 `json:"sec"`
+		Version      interface{}            `json:"version"`
+		BindDefaults map[string]interface{} `json:"bind_defaults"`
 	}
 	var configuration Configuration
 
-	var decoder *json.Decoder = json.NewDecoder(bytes.NewBuffer(details.RawParameters))
-	err := decoder.Decode(&configuration)
+	err := decodeParameters(details.RawParameters, &configuration)
 	if err != nil {
-		return brokerapi.ProvisionedServiceSpec{}, brokerapi.ErrRawParamsInvalid
+		return brokerapi.ProvisionedServiceSpec{}, err
 	}
 
 	if configuration.Share == "" {
-		return brokerapi.ProvisionedServiceSpec{}, errors.New("config requires a \"share\" key")
+		return brokerapi.ProvisionedServiceSpec{}, invalidParameters(errors.New("config requires a \"share\" key"), "missing-share")
 	}
 
-	b.dynamic.InstanceMap[instanceID] = ServiceInstance{
-		details.ServiceID,
-		details.PlanID,
-		details.OrganizationGUID,
-		details.SpaceGUID,
-		configuration.Share}
+	if configuration.Sec != "" && !contains(securityFlavors, configuration.Sec) {
+		return brokerapi.ProvisionedServiceSpec{}, invalidParameters(errors.New(`sec must be one of "sys", "krb5", "krb5i" or "krb5p"`), "invalid-sec")
+	}
 
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
+	version, err := toNFSVersion(configuration.Version)
+	if err != nil {
+		return brokerapi.ProvisionedServiceSpec{}, err
+	}
+
+	metadata, err := b.unknownProvisionFields(logger, details.RawParameters)
+	if err != nil {
+		return brokerapi.ProvisionedServiceSpec{}, err
+	}
+
+	// the share is dialed before locking, so that a slow nfs server holds up
+	// no other request
+	if b.config.provisionPreflightTimeout > 0 {
+		port, err := evaluatePort(configuration.BindDefaults)
+		if err != nil {
+			return brokerapi.ProvisionedServiceSpec{}, err
+		}
+
+		if err := checkShareReachable(context, configuration.Share, port, b.config.provisionPreflightTimeout); err != nil {
+			logger.Error("share-unreachable", err, lager.Data{"share": configuration.Share, "port": port})
+			return brokerapi.ProvisionedServiceSpec{}, ErrProvisionShareUnreachable
+		}
+	}
+
+	if err := b.lock(context, logger); err != nil {
+		return brokerapi.ProvisionedServiceSpec{}, err
+	}
+	defer b.unlock()
+
+	instance := ServiceInstance{
+		ServiceID:        details.ServiceID,
+		PlanID:           details.PlanID,
+		OrganizationGUID: details.OrganizationGUID,
+		SpaceGUID:        details.SpaceGUID,
+		Share:            configuration.Share,
+		Sec:              configuration.Sec,
+		Version:          version,
+		BindDefaults:     configuration.BindDefaults,
+		Metadata:         metadata,
+	}
+
+	conflicts, err := b.instanceConflicts(instance, instanceID)
+	if err != nil {
+		logger.Error("failed-checking-instance-exists", err)
+		return brokerapi.ProvisionedServiceSpec{}, err
+	}
+	if conflicts {
+		return brokerapi.ProvisionedServiceSpec{}, brokerapi.ErrInstanceAlreadyExists
+	}
+
+	if existingID, ok := b.duplicateShare(instanceID, configuration.Share); ok {
+		switch b.config.duplicateShares {
+		case DuplicateSharesReject:
+			logger.Info("duplicate-share-rejected", lager.Data{"share": configuration.Share, "existingInstanceID": existingID})
+			return brokerapi.ProvisionedServiceSpec{}, ErrDuplicateShare
+		case DuplicateSharesWarn:
+			logger.Info("duplicate-share", lager.Data{"share": configuration.Share, "existingInstanceID": existingID})
+		}
+	}
+
+	if _, exists := b.dynamic.InstanceMap[instanceID]; !exists && b.config.maxInstances > 0 && len(b.dynamic.InstanceMap) >= b.config.maxInstances {
+		logger.Info("instance-limit-reached", lager.Data{"maxInstances": b.config.maxInstances})
+		return brokerapi.ProvisionedServiceSpec{}, brokerapi.ErrInstanceLimitMet
+	}
+
+	// an identical provision repeated is answered without spending a token
+	previous, existed := b.dynamic.InstanceMap[instanceID]
+	if !existed {
+		if err := b.takeOrgToken(logger, details.OrganizationGUID); err != nil {
+			return brokerapi.ProvisionedServiceSpec{}, err
+		}
+	}
+
+	var platform platformContext
+	if len(details.RawContext) > 0 {
+		if err := json.Unmarshal(details.RawContext, &platform); err != nil {
+			logger.Error("ignoring-invalid-context", err)
+			platform = platformContext{}
+		}
+	}
+	logger.Info("provisioning", lager.Data{"organization": platform.OrganizationName, "space": platform.SpaceName})
+
+	instance.Platform = platform.Platform
+	instance.OrganizationName = platform.OrganizationName
+	instance.SpaceName = platform.SpaceName
+
+	// an identical provision repeated keeps the instance's creation time
+	now := b.clock.Now()
+	instance.CreatedAt = now
+	if existed {
+		instance.CreatedAt = previous.CreatedAt
+	}
+	instance.UpdatedAt = now
+	b.dynamic.InstanceMap[instanceID] = instance
 
-	defer b.store.Save(logger, &b.dynamic, instanceID, "")
+	if err := b.save(logger, instanceID, ""); err != nil {
+		if existed {
+			b.dynamic.InstanceMap[instanceID] = previous
+		} else {
+			delete(b.dynamic.InstanceMap, instanceID)
+			b.refundOrgToken(details.OrganizationGUID)
+		}
+		logger.Error("failed-to-save-instance", err)
+		return brokerapi.ProvisionedServiceSpec{}, err
+	}
 
 	return brokerapi.ProvisionedServiceSpec{IsAsync: false}, nil
 }
 
 func (b *Broker) Deprovision(context context.Context, instanceID string, details brokerapi.DeprovisionDetails, asyncAllowed bool) (brokerapi.DeprovisionServiceSpec, error) {
-	logger := b.logger.Session("deprovision")
+	logger := b.requestSession(context, "deprovision")
 	logger.Info("start")
 	defer logger.Info("end")
 
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
+	if err := b.lock(context, logger); err != nil {
+		return brokerapi.DeprovisionServiceSpec{}, err
+	}
+	defer b.unlock()
 
-	_, instanceExists := b.dynamic.InstanceMap[instanceID]
+	instance, instanceExists := b.dynamic.InstanceMap[instanceID]
 	if !instanceExists {
+		if b.config.lenientDeprovision {
+			logger.Info("instance-already-gone", lager.Data{"instanceID": instanceID})
+			return brokerapi.DeprovisionServiceSpec{IsAsync: false}, nil
+		}
 		return brokerapi.DeprovisionServiceSpec{}, brokerapi.ErrInstanceDoesNotExist
-	} else {
-		delete(b.dynamic.InstanceMap, instanceID)
-		b.store.Save(logger, &b.dynamic, instanceID, "")
+	}
+
+	delete(b.dynamic.InstanceMap, instanceID)
+
+	if err := b.save(logger, instanceID, ""); err != nil {
+		b.dynamic.InstanceMap[instanceID] = instance
+		logger.Error("failed-to-save-instance", err)
+		return brokerapi.DeprovisionServiceSpec{}, err
 	}
 
 	return brokerapi.DeprovisionServiceSpec{IsAsync: false, OperationData: "deprovision"}, nil
 }
 
-func (b *Broker) Bind(context context.Context, instanceID string, bindingID string, details brokerapi.BindDetails) (brokerapi.Binding, error) {
-	logger := b.logger.Session("bind")
+func (b *Broker) Bind(ctx context.Context, instanceID string, bindingID string, details brokerapi.BindDetails) (brokerapi.Binding, error) {
+	logger := b.requestSession(ctx, "bind")
 	logger.Info("start", lager.Data{"bindingID": bindingID, "details": details})
 	defer logger.Info("end")
 
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
+	if b.config.bindTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.config.bindTimeout)
+		defer cancel()
+	}
+
+	// the parameters are stored with the binding, so they are bounded too
+	if b.config.maxMountConfigSize > 0 {
+		if err := b.checkSize(logger, "bind parameter data", "bind-parameters-too-large", details.Parameters); err != nil {
+			return brokerapi.Binding{}, err
+		}
+	}
+
+	var reachedShare string
+	if b.config.preflightTimeout > 0 {
+		var err error
+		if reachedShare, err = b.preflightBind(ctx, logger, instanceID, details); err != nil {
+			return brokerapi.Binding{}, err
+		}
+	}
 
-	defer b.store.Save(logger, &b.dynamic, "", bindingID)
+	if err := b.lock(ctx, logger); err != nil {
+		return brokerapi.Binding{}, err
+	}
+	defer b.unlock()
 
 	logger.Info("Starting nfsbroker bind")
 	instanceDetails, ok := b.dynamic.InstanceMap[instanceID]
@@ -190,144 +616,1306 @@ func (b *Broker) Bind(context context.Context, instanceID string, bindingID stri
 		return brokerapi.Binding{}, brokerapi.ErrInstanceDoesNotExist
 	}
 
+	if b.config.preflightTimeout > 0 && instanceDetails.Share != reachedShare {
+		logger.Info("share-changed-during-preflight", lager.Data{"share": instanceDetails.Share, "reachedShare": reachedShare})
+		return brokerapi.Binding{}, ErrInstanceChanged
+	}
+
 	if details.AppGUID == "" {
 		return brokerapi.Binding{}, brokerapi.ErrAppGuidNotProvided
 	}
 
-	mode, err := evaluateMode(details.Parameters)
+	conflicts, err := b.bindingConflicts(bindingID, instanceID, details)
 	if err != nil {
+		logger.Error("failed-checking-binding-exists", err)
 		return brokerapi.Binding{}, err
 	}
-
-	if b.bindingConflicts(bindingID, details) {
+	if conflicts {
 		return brokerapi.Binding{}, brokerapi.ErrBindingAlreadyExists
 	}
 
-	b.dynamic.BindingMap[bindingID] = details
+	// a repeated bind gets any credentials rotated since
+	previous, existed := b.dynamic.BindingMap[bindingID]
+	record := ServiceBinding{InstanceID: instanceID, Details: details, RotatedSecret: previous.RotatedSecret}
+
+	binding, err := b.bindingResponse(logger, instanceID, bindingID, instanceDetails, record.currentDetails())
+	if err != nil {
+		return brokerapi.Binding{}, err
+	}
 
-	var uid interface{}
-	var exist bool
-	if uid, exist = details.Parameters["uid"]; !exist {
-		return brokerapi.Binding{}, errors.New("config requires a \"uid\"")
+	if err := ctx.Err(); err != nil {
+		logger.Error("bind-timed-out", err, lager.Data{"bindingID": bindingID, "instanceID": instanceID})
+		return brokerapi.Binding{}, err
 	}
 
-	var gid interface{}
-	if gid, exist = details.Parameters["gid"]; !exist {
-		return brokerapi.Binding{}, errors.New("config requires a \"gid\"")
+	// a repeated bind is answered without spending a token
+	if !existed {
+		if err := b.takeOrgToken(logger, instanceDetails.OrganizationGUID); err != nil {
+			return brokerapi.Binding{}, err
+		}
 	}
 
-	mountConfig := map[string]interface{}{"source": fmt.Sprintf("nfs://%s?uid=%s&gid=%s", instanceDetails.Share, uid.(string), gid.(string))}
+	now := b.clock.Now()
+	record.VolumeID = binding.VolumeMounts[0].Device.VolumeId
+	record.CreatedAt = now
+	if existed {
+		record.CreatedAt = previous.CreatedAt
+	}
+	record.UpdatedAt = now
+	b.dynamic.BindingMap[bindingID] = record
 
-	s, err := b.hash(mountConfig)
-	if err != nil {
-		logger.Error("error-calculating-volume-id", err, lager.Data{"config": mountConfig, "bindingID": bindingID, "instanceID": instanceID})
+	if err := b.save(logger, "", bindingID); err != nil {
+		if existed {
+			b.dynamic.BindingMap[bindingID] = previous
+		} else {
+			delete(b.dynamic.BindingMap, bindingID)
+			b.refundOrgToken(instanceDetails.OrganizationGUID)
+		}
+		logger.Error("failed-to-save-binding", err, lager.Data{"bindingID": bindingID, "instanceID": instanceID})
 		return brokerapi.Binding{}, err
 	}
-	volumeId := fmt.Sprintf("%s-%s", instanceID, s)
 
-	return brokerapi.Binding{
-		Credentials: struct{}{}, // if nil, cloud controller chokes on response
-		VolumeMounts: []brokerapi.VolumeMount{{
-			ContainerDir: evaluateContainerPath(details.Parameters, instanceID),
-			Mode:         mode,
-			Driver:       "nfsv3driver",
-			DeviceType:   "shared",
-			Device: brokerapi.SharedDevice{
-				VolumeId:    volumeId,
-				MountConfig: mountConfig,
-			},
-		}},
-	}, nil
+	return binding, nil
 }
 
-func (b *Broker) hash(mountConfig map[string]interface{}) (string, error) {
-	var (
-		bytes []byte
-		err   error
-	)
-	if bytes, err = json.Marshal(mountConfig); err != nil {
+// preflightBind dials the share of the instance being bound. It runs before
+// the broker is locked, so that a slow nfs server holds up no other request,
+// and returns the share it reached for Bind to check again under the lock.
+func (b *Broker) preflightBind(ctx context.Context, logger lager.Logger, instanceID string, details brokerapi.BindDetails) (string, error) {
+	if err := lockContext(ctx, &b.mutex); err != nil {
+		logger.Error("failed-to-acquire-lock", err)
 		return "", err
 	}
-	return fmt.Sprintf("%x", md5.Sum(bytes)), nil
+	err := b.reload(logger)
+	instanceDetails, ok := b.dynamic.InstanceMap[instanceID]
+	b.mutex.Unlock()
+
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", brokerapi.ErrInstanceDoesNotExist
+	}
+
+	port, err := evaluatePort(details.Parameters)
+	if err != nil {
+		return "", err
+	}
+
+	if err := checkShareReachable(ctx, instanceDetails.Share, port, b.config.preflightTimeout); err != nil {
+		logger.Error("share-unreachable", err, lager.Data{"share": instanceDetails.Share, "port": port})
+		return "", ErrShareUnreachable
+	}
+	return instanceDetails.Share, nil
 }
 
-func (b *Broker) Unbind(context context.Context, instanceID string, bindingID string, details brokerapi.UnbindDetails) error {
-	logger := b.logger.Session("unbind")
+// RotateCredentials replaces the kerberos keytab recorded for a binding and
+// returns the refreshed binding. The volume id is unchanged, so apps keep
+// sharing the same mount.
+func (b *Broker) RotateCredentials(instanceID, bindingID, newSecret string) (brokerapi.Binding, error) {
+	logger := b.logger.Session("rotate-credentials").WithData(lager.Data{"instanceID": instanceID, "bindingID": bindingID})
 	logger.Info("start")
 	defer logger.Info("end")
 
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
+	if err := b.lock(context.Background(), logger); err != nil {
+		return brokerapi.Binding{}, err
+	}
+	defer b.unlock()
 
-	defer b.store.Save(logger, &b.dynamic, "", bindingID)
+	instanceDetails, ok := b.dynamic.InstanceMap[instanceID]
+	if !ok {
+		return brokerapi.Binding{}, brokerapi.ErrInstanceDoesNotExist
+	}
 
-	if _, ok := b.dynamic.InstanceMap[instanceID]; !ok {
-		return brokerapi.ErrInstanceDoesNotExist
+	previous, ok := b.dynamic.BindingMap[bindingID]
+	if !ok || !previous.belongsTo(instanceID) {
+		return brokerapi.Binding{}, brokerapi.ErrBindingDoesNotExist
 	}
 
-	if _, ok := b.dynamic.BindingMap[bindingID]; !ok {
-		return brokerapi.ErrBindingDoesNotExist
+	rotated := previous
+	rotated.RotatedSecret = newSecret
+
+	binding, err := b.bindingResponse(logger, instanceID, bindingID, instanceDetails, rotated.currentDetails())
+	if err != nil {
+		return brokerapi.Binding{}, err
 	}
 
-	delete(b.dynamic.BindingMap, bindingID)
+	rotated.InstanceID = instanceID
+	rotated.VolumeID = binding.VolumeMounts[0].Device.VolumeId
+	rotated.UpdatedAt = b.clock.Now()
+	b.dynamic.BindingMap[bindingID] = rotated
 
-	return nil
-}
+	if err := b.save(logger, "", bindingID); err != nil {
+		b.dynamic.BindingMap[bindingID] = previous
+		logger.Error("failed-to-save-binding", err)
+		return brokerapi.Binding{}, err
+	}
 
-func (b *Broker) Update(context context.Context, instanceID string, details brokerapi.UpdateDetails, asyncAllowed bool) (brokerapi.UpdateServiceSpec, error) {
-	panic("not implemented")
+	return binding, nil
 }
 
-func (b *Broker) LastOperation(_ context.Context, instanceID string, operationData string) (brokerapi.LastOperation, error) {
-	logger := b.logger.Session("last-operation").WithData(lager.Data{"instanceID": instanceID})
-	logger.Info("start")
-	defer logger.Info("end")
+// bindingResponse builds the volume mount for a binding from its parameters.
+// Kerberos credentials are passed to the driver but kept out of the volume id.
+func (b *Broker) bindingResponse(logger lager.Logger, instanceID, bindingID string, instanceDetails ServiceInstance, details brokerapi.BindDetails) (brokerapi.Binding, error) {
+	plan, _ := b.plan(instanceDetails.PlanID)
+	if missing := plan.missingBindParameters(details.Parameters); len(missing) > 0 {
+		return brokerapi.Binding{}, invalidParameters(fmt.Errorf("plan %s requires bind parameters: %s", plan.Name, strings.Join(missing, ", ")), "missing-required-parameters")
+	}
+	if err := b.checkExclusiveParameters(details.Parameters); err != nil {
+		return brokerapi.Binding{}, err
+	}
+	details.Parameters = b.mergeBindParameters(logger, instanceDetails.BindDefaults, details.Parameters)
 
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
+	mode, err := evaluateMode(details.Parameters, plan.DefaultReadonly)
+	if err != nil {
+		return brokerapi.Binding{}, err
+	}
 
-	switch operationData {
-	default:
-		return brokerapi.LastOperation{}, errors.New("unrecognized operationData")
+	scope, err := evaluateScope(details.Parameters)
+	if err != nil {
+		return brokerapi.Binding{}, err
 	}
-}
 
-func (b *Broker) instanceConflicts(details brokerapi.ProvisionDetails, instanceID string) bool {
-	if existing, ok := b.dynamic.InstanceMap[instanceID]; ok {
-		if !reflect.DeepEqual(details, existing) {
-			return true
+	if missing := missingParameters(details.Parameters, "uid", "gid"); len(missing) > 0 {
+		uid, gid, err := b.config.idResolver.ResolveIDs(instanceDetails, details)
+		if err != nil {
+			logger.Error("failed-to-resolve-ids", err, lager.Data{"bindingID": bindingID, "instanceID": instanceID})
+			return brokerapi.Binding{}, err
+		}
+		for key, id := range map[string]string{"uid": uid, "gid": gid} {
+			if _, ok := details.Parameters[key]; !ok && id != "" {
+				details.Parameters[key] = id
+			}
 		}
 	}
-	return false
-}
 
-func (b *Broker) bindingConflicts(bindingID string, details brokerapi.BindDetails) bool {
-	if existing, ok := b.dynamic.BindingMap[bindingID]; ok {
-		if !reflect.DeepEqual(details, existing) {
-			return true
-		}
+	if missing := missingParameters(details.Parameters, "uid", "gid"); len(missing) > 0 {
+		return brokerapi.Binding{}, invalidParameters(fmt.Errorf("config requires %s", strings.Join(missing, " and ")), "missing-parameters")
 	}
-	return false
-}
 
-func evaluateContainerPath(parameters map[string]interface{}, volId string) string {
-	if containerPath, ok := parameters["mount"]; ok && containerPath != "" {
-		return containerPath.(string)
+	if strings.HasPrefix(instanceDetails.Sec, "krb5") {
+		if missing := missingParameters(details.Parameters, Username, Secret); len(missing) > 0 {
+			return brokerapi.Binding{}, invalidParameters(fmt.Errorf("sec %s requires %s", instanceDetails.Sec, strings.Join(missing, " and ")), "missing-kerberos-credentials")
+		}
 	}
 
-	return path.Join(DefaultContainerPath, volId)
+	uidString, err := idToString(details.Parameters["uid"])
+	if err != nil {
+		return brokerapi.Binding{}, err
+	}
+
+	gidString, err := idToString(details.Parameters["gid"])
+	if err != nil {
+		return brokerapi.Binding{}, err
+	}
+
+	containerPath, err := evaluateContainerPath(details.Parameters, instanceID)
+	if err != nil {
+		return brokerapi.Binding{}, err
+	}
+	if _, requested := details.Parameters["mount"]; requested && !b.containerPathAllowed(containerPath) {
+		logger.Info("container-path-not-allowed", lager.Data{"containerPath": containerPath})
+		return brokerapi.Binding{}, ErrContainerPathNotAllowed
+	}
+
+	port, err := evaluatePort(details.Parameters)
+	if err != nil {
+		return brokerapi.Binding{}, err
+	}
+
+	share := shareWithPort(instanceDetails.Share, port)
+	source := fmt.Sprintf("nfs://%s?uid=%s&gid=%s", share, uidString, gidString)
+	for _, key := range []string{"dir_mode", "file_mode"} {
+		bits, err := evaluatePermissionBits(details.Parameters, key)
+		if err != nil {
+			return brokerapi.Binding{}, err
+		}
+		if bits != "" {
+			source = fmt.Sprintf("%s&%s=%s", source, key, bits)
+		}
+	}
+	for _, retry := range []struct {
+		key          string
+		defaultValue int
+	}{{"timeo", b.config.timeo}, {"retrans", b.config.retrans}} {
+		option, err := evaluatePositiveOption(details.Parameters, retry.key, retry.defaultValue)
+		if err != nil {
+			return brokerapi.Binding{}, err
+		}
+		if option != 0 {
+			source = fmt.Sprintf("%s&%s=%d", source, retry.key, option)
+		}
+	}
+	for _, blockSize := range []struct {
+		key          string
+		defaultValue int
+	}{{"rsize", b.config.rsize}, {"wsize", b.config.wsize}} {
+		size, err := evaluatePositiveOption(details.Parameters, blockSize.key, blockSize.defaultValue)
+		if err != nil {
+			return brokerapi.Binding{}, err
+		}
+		if size&(size-1) != 0 {
+			if b.config.strictBlockSizes {
+				return brokerapi.Binding{}, invalidParameters(fmt.Errorf("%s must be a power of two", blockSize.key), "invalid-"+blockSize.key)
+			}
+			logger.Info("block-size-not-power-of-two", lager.Data{blockSize.key: size})
+		}
+		if size != 0 {
+			source = fmt.Sprintf("%s&%s=%d", source, blockSize.key, size)
+		}
+	}
+	if instanceDetails.Sec != "" {
+		source = fmt.Sprintf("%s&sec=%s", source, instanceDetails.Sec)
+	}
+	version, err := evaluateVersion(details.Parameters, instanceDetails.Version)
+	if err != nil {
+		return brokerapi.Binding{}, err
+	}
+	if version != "" {
+		source = fmt.Sprintf("%s&version=%s", source, version)
+	}
+	proto, err := evaluateProto(details.Parameters)
+	if err != nil {
+		return brokerapi.Binding{}, err
+	}
+	if proto != DefaultNFSProto {
+		source = fmt.Sprintf("%s&proto=%s", source, proto)
+	}
+	accessMode, err := evaluateAccessMode(details.Parameters, plan.AccessMode)
+	if err != nil {
+		return brokerapi.Binding{}, err
+	}
+	if accessMode == AccessModeReadWriteOnce {
+		source = fmt.Sprintf("%s&nolock=true", source)
+	}
+	allowRoot, err := evaluateAllowRoot(details.Parameters)
+	if err != nil {
+		return brokerapi.Binding{}, err
+	}
+	if allowRoot {
+		source = fmt.Sprintf("%s&allow_root=true", source)
+	}
+	mountConfig := map[string]interface{}{"source": source}
+
+	// the driver chowns the mount point to these after mounting, separately
+	// from the uid and gid the share is accessed as
+	for _, key := range []string{"chown_uid", "chown_gid"} {
+		id, err := evaluateChownID(details.Parameters, key)
+		if err != nil {
+			return brokerapi.Binding{}, err
+		}
+		if id != "" {
+			mountConfig[key] = id
+		}
+	}
+
+	// the device name and credentials are left out of the volume id so that
+	// bindings still share mounts
+	unhashed := map[string]interface{}{}
+	if b.config.deviceName != nil {
+		buf := &bytes.Buffer{}
+		data := bindingTemplateData{InstanceID: instanceID, BindingID: bindingID, AppGUID: details.AppGUID, ServiceInstance: instanceDetails}
+		if err := b.config.deviceName.Execute(buf, data); err != nil {
+			logger.Error("error-rendering-device-name", err, lager.Data{"bindingID": bindingID, "instanceID": instanceID})
+			return brokerapi.Binding{}, err
+		}
+		unhashed["device_name"] = buf.String()
+	}
+
+	for _, key := range []string{Username, Secret} {
+		if value, ok := details.Parameters[key]; ok {
+			unhashed[key] = value
+		}
+	}
+
+	if err := b.addTLSCredentials(logger, unhashed); err != nil {
+		return brokerapi.Binding{}, err
+	}
+
+	// checked before hashing, so that an oversized config costs no more work
+	if b.config.maxMountConfigSize > 0 {
+		fullConfig := make(map[string]interface{}, len(mountConfig)+len(unhashed))
+		for _, config := range []map[string]interface{}{mountConfig, unhashed} {
+			for key, value := range config {
+				fullConfig[key] = value
+			}
+		}
+		if err := b.checkSize(logger, "mount config", "mount-config-too-large", fullConfig); err != nil {
+			return brokerapi.Binding{}, err
+		}
+	}
+
+	// app scoped volumes get their own volume id, and so their own mount, per app
+	volumeConfig := mountConfig
+	if scope == ScopeApp {
+		volumeConfig = map[string]interface{}{"mountConfig": mountConfig, "appGUID": details.AppGUID}
+	}
+
+	s, err := b.hash(volumeConfig)
+	if err != nil {
+		logger.Error("error-calculating-volume-id", err, lager.Data{"config": mountConfig, "bindingID": bindingID, "instanceID": instanceID})
+		return brokerapi.Binding{}, err
+	}
+	volumeId := boundVolumeID(fmt.Sprintf("%s-%s", instanceID, s), b.config.maxVolumeIDLength)
+
+	for key, value := range unhashed {
+		mountConfig[key] = value
+	}
+
+	var syslogDrainURL string
+	if b.config.syslogDrainURL != nil {
+		buf := &bytes.Buffer{}
+		data := bindingTemplateData{InstanceID: instanceID, BindingID: bindingID, AppGUID: details.AppGUID, ServiceInstance: instanceDetails}
+		if err := b.config.syslogDrainURL.Execute(buf, data); err != nil {
+			logger.Error("error-rendering-syslog-drain-url", err, lager.Data{"bindingID": bindingID, "instanceID": instanceID})
+			return brokerapi.Binding{}, err
+		}
+		syslogDrainURL = buf.String()
+	}
+
+	return brokerapi.Binding{
+		Credentials:    struct{}{}, // if nil, cloud controller chokes on response
+		SyslogDrainURL: syslogDrainURL,
+		VolumeMounts: []brokerapi.VolumeMount{{
+			ContainerDir: containerPath,
+			Mode:         mode,
+			Driver:       "nfsv3driver",
+			DeviceType:   "shared",
+			Device: brokerapi.SharedDevice{
+				VolumeId:    volumeId,
+				MountConfig: mountConfig,
+			},
+		}},
+	}, nil
+}
+
+// checkSize refuses a value that serializes to more than the configured
+// maximum mount config size
+func (b *Broker) checkSize(logger lager.Logger, what, code string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	if len(data) > b.config.maxMountConfigSize {
+		logger.Info(code, lager.Data{"size": len(data), "maxMountConfigSize": b.config.maxMountConfigSize})
+		return invalidParameters(fmt.Errorf("%s is larger than %d bytes", what, b.config.maxMountConfigSize), code)
+	}
+	return nil
+}
+
+func (b *Broker) hash(mountConfig map[string]interface{}) (string, error) {
+	var (
+		bytes []byte
+		err   error
+	)
+	if bytes, err = json.Marshal(mountConfig); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", md5.Sum(bytes)), nil
+}
+
+// addTLSCredentials adds the configured client credentials to mountConfig.
+// Inline contents are never logged.
+func (b *Broker) addTLSCredentials(logger lager.Logger, mountConfig map[string]interface{}) error {
+	credentials := b.config.tlsCredentials
+	for key, value := range map[string]string{"tls_cert": credentials.Cert, "tls_key": credentials.Key, "tls_ca": credentials.CA} {
+		if value == "" {
+			continue
+		}
+
+		if !credentials.Inline {
+			if _, err := b.os.Stat(value); err != nil {
+				logger.Error("tls-credential-file-not-found", err, lager.Data{"option": key, "path": value})
+				return errTLSCredentialsMisconfigured
+			}
+		}
+		mountConfig[key] = value
+	}
+	return nil
+}
+
+// boundVolumeID replaces characters volume drivers may reject and shortens
+// the id to maxLength. Any id that has to change is suffixed with a hash of
+// the original so that distinct ids stay distinct.
+func boundVolumeID(volumeID string, maxLength int) string {
+	sanitized := volumeIDUnsafeChars.ReplaceAllString(volumeID, "_")
+	if sanitized == volumeID && (maxLength <= 0 || len(volumeID) <= maxLength) {
+		return volumeID
+	}
+
+	suffix := fmt.Sprintf("%x", md5.Sum([]byte(volumeID)))
+	if maxLength > 0 {
+		if maxLength < MinVolumeIDLength {
+			maxLength = MinVolumeIDLength
+		}
+		if prefixLength := maxLength - len(suffix) - 1; len(sanitized) > prefixLength {
+			sanitized = sanitized[:prefixLength]
+		}
+	}
+	return fmt.Sprintf("%s-%s", sanitized, suffix)
+}
+
+func (b *Broker) Unbind(context context.Context, instanceID string, bindingID string, details brokerapi.UnbindDetails) error {
+	logger := b.requestSession(context, "unbind")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	if err := b.lock(context, logger); err != nil {
+		return err
+	}
+	defer b.unlock()
+
+	if _, ok := b.dynamic.InstanceMap[instanceID]; !ok {
+		return brokerapi.ErrInstanceDoesNotExist
+	}
+
+	binding, ok := b.dynamic.BindingMap[bindingID]
+	if !ok || !binding.belongsTo(instanceID) {
+		return brokerapi.ErrBindingDoesNotExist
+	}
+
+	delete(b.dynamic.BindingMap, bindingID)
+
+	if err := b.save(logger, "", bindingID); err != nil {
+		b.dynamic.BindingMap[bindingID] = binding
+		logger.Error("failed-to-save-binding", err, lager.Data{"bindingID": bindingID, "instanceID": instanceID})
+		return err
+	}
+
+	return nil
+}
+
+// ListBindings returns the IDs of every binding recorded against the instance
+func (b *Broker) ListBindings(instanceID string) ([]string, error) {
+	logger := b.logger.Session("list-bindings").WithData(lager.Data{"instanceID": instanceID})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if err := b.reload(logger); err != nil {
+		return nil, err
+	}
+
+	if _, ok := b.dynamic.InstanceMap[instanceID]; !ok {
+		return nil, brokerapi.ErrInstanceDoesNotExist
+	}
+
+	bindingIDs := []string{}
+	for bindingID, binding := range b.dynamic.BindingMap {
+		if binding.InstanceID == instanceID {
+			bindingIDs = append(bindingIDs, bindingID)
+		}
+	}
+	sort.Strings(bindingIDs)
+
+	return bindingIDs, nil
+}
+
+// CheckVolumeIDs recomputes the volume id of every binding that recorded one
+// and logs those that no longer match, as happens when the way volume ids are
+// derived changes. With repair, the recorded id is updated to the new one and
+// saved. It returns the IDs of the drifted bindings.
+func (b *Broker) CheckVolumeIDs(repair bool) ([]string, error) {
+	logger := b.logger.Session("check-volume-ids", lager.Data{"repair": repair})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	if err := b.lock(context.Background(), logger); err != nil {
+		return nil, err
+	}
+	defer b.unlock()
+
+	var drifted []string
+	for bindingID, binding := range b.dynamic.BindingMap {
+		if binding.VolumeID == "" || binding.InstanceID == "" {
+			continue
+		}
+		instance, ok := b.dynamic.InstanceMap[binding.InstanceID]
+		if !ok {
+			continue
+		}
+
+		response, err := b.bindingResponse(logger, binding.InstanceID, bindingID, instance, binding.currentDetails())
+		if err != nil {
+			logger.Error("failed-to-recompute-volume-id", err, lager.Data{"bindingID": bindingID})
+			continue
+		}
+		expected := response.VolumeMounts[0].Device.VolumeId
+		if expected == binding.VolumeID {
+			continue
+		}
+
+		logger.Info("volume-id-drift", lager.Data{"bindingID": bindingID, "instanceID": binding.InstanceID, "recorded": binding.VolumeID, "expected": expected})
+		drifted = append(drifted, bindingID)
+		if !repair {
+			continue
+		}
+
+		repaired := binding
+		repaired.VolumeID = expected
+		b.dynamic.BindingMap[bindingID] = repaired
+		if err := b.save(logger, "", bindingID); err != nil {
+			b.dynamic.BindingMap[bindingID] = binding
+			logger.Error("failed-to-save-binding", err, lager.Data{"bindingID": bindingID})
+			return drifted, err
+		}
+	}
+
+	sort.Strings(drifted)
+	return drifted, nil
+}
+
+// ReapOlderThan removes broken records last updated more than age ago:
+// instances with no share, which can never be bound, and bindings whose
+// instance no longer exists. Records saved before timestamps were kept, and
+// legacy bindings without an instance id, are left alone. It returns the
+// IDs it removed, including those removed before any error.
+func (b *Broker) ReapOlderThan(age time.Duration) (instanceIDs, bindingIDs []string, err error) {
+	logger := b.logger.Session("reap")
+	logger.Info("start", lager.Data{"age": age.String()})
+	defer logger.Info("end")
+
+	if err := b.lock(context.Background(), logger); err != nil {
+		return nil, nil, err
+	}
+	defer b.unlock()
+
+	cutoff := b.clock.Now().Add(-age)
+	expired := func(updatedAt time.Time) bool {
+		return !updatedAt.IsZero() && updatedAt.Before(cutoff)
+	}
+
+	var expiredInstances []string
+	for instanceID, instance := range b.dynamic.InstanceMap {
+		if instance.Share == "" && expired(instance.UpdatedAt) {
+			expiredInstances = append(expiredInstances, instanceID)
+		}
+	}
+	sort.Strings(expiredInstances)
+
+	for _, instanceID := range expiredInstances {
+		instance := b.dynamic.InstanceMap[instanceID]
+		delete(b.dynamic.InstanceMap, instanceID)
+
+		if err := b.save(logger, instanceID, ""); err != nil {
+			b.dynamic.InstanceMap[instanceID] = instance
+			logger.Error("failed-to-reap-instance", err, lager.Data{"instanceID": instanceID})
+			return instanceIDs, bindingIDs, err
+		}
+		logger.Info("reaped-instance", lager.Data{"instanceID": instanceID})
+		instanceIDs = append(instanceIDs, instanceID)
+	}
+
+	var expiredBindings []string
+	for bindingID, binding := range b.dynamic.BindingMap {
+		if _, ok := b.dynamic.InstanceMap[binding.InstanceID]; !ok && binding.InstanceID != "" && expired(binding.UpdatedAt) {
+			expiredBindings = append(expiredBindings, bindingID)
+		}
+	}
+	sort.Strings(expiredBindings)
+
+	for _, bindingID := range expiredBindings {
+		binding := b.dynamic.BindingMap[bindingID]
+		delete(b.dynamic.BindingMap, bindingID)
+
+		if err := b.save(logger, "", bindingID); err != nil {
+			b.dynamic.BindingMap[bindingID] = binding
+			logger.Error("failed-to-reap-binding", err, lager.Data{"bindingID": bindingID})
+			return instanceIDs, bindingIDs, err
+		}
+		logger.Info("reaped-binding", lager.Data{"bindingID": bindingID})
+		bindingIDs = append(bindingIDs, bindingID)
+	}
+
+	return instanceIDs, bindingIDs, nil
+}
+
+// Dump returns a copy of every instance and binding the broker holds, safe
+// to inspect or modify without affecting the broker
+func (b *Broker) Dump() DynamicState {
+	logger := b.logger.Session("dump")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.dump()
+}
+
+// DumpReloaded is Dump, after reloading the state of a store shared with
+// other brokers, so that their changes are included
+func (b *Broker) DumpReloaded() (DynamicState, error) {
+	logger := b.logger.Session("dump-reloaded")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if err := b.reload(logger); err != nil {
+		return DynamicState{}, err
+	}
+	return b.dump(), nil
+}
+
+// dump copies the broker's state. Callers hold b.mutex.
+func (b *Broker) dump() DynamicState {
+	state := DynamicState{
+		InstanceMap: make(map[string]ServiceInstance, len(b.dynamic.InstanceMap)),
+		BindingMap:  make(map[string]ServiceBinding, len(b.dynamic.BindingMap)),
+	}
+	for id, instance := range b.dynamic.InstanceMap {
+		if instance.Metadata != nil {
+			instance.Metadata = copyValue(instance.Metadata).(map[string]interface{})
+		}
+		if instance.BindDefaults != nil {
+			instance.BindDefaults = copyValue(instance.BindDefaults).(map[string]interface{})
+		}
+		state.InstanceMap[id] = instance
+	}
+	for id, binding := range b.dynamic.BindingMap {
+		if binding.Details.Parameters != nil {
+			binding.Details.Parameters = copyValue(binding.Details.Parameters).(map[string]interface{})
+		}
+		if binding.Details.BindResource != nil {
+			bindResource := *binding.Details.BindResource
+			binding.Details.BindResource = &bindResource
+		}
+		state.BindingMap[id] = binding
+	}
+	return state
+}
+
+// ExportSnapshot serializes every instance and binding the broker holds in
+// the file store's format, whichever store backs the broker, so that the
+// state can be backed up or used as a seed file
+func (b *Broker) ExportSnapshot() ([]byte, error) {
+	logger := b.logger.Session("export-snapshot")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if err := b.reload(logger); err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(&b.dynamic)
+	if err != nil {
+		logger.Error("failed-to-marshall-state", err)
+		return nil, err
+	}
+
+	logger.Info("snapshot-exported", lager.Data{"instances": len(b.dynamic.InstanceMap), "bindings": len(b.dynamic.BindingMap)})
+	return data, nil
 }
 
-func evaluateMode(parameters map[string]interface{}) (string, error) {
+// SnapshotImportMode says how ImportSnapshot combines a snapshot with the
+// broker's current state
+type SnapshotImportMode string
+
+const (
+	// SnapshotMerge adds the snapshot's records, keeping any current record
+	// that was updated more recently than the snapshot's copy
+	SnapshotMerge SnapshotImportMode = "merge"
+	// SnapshotReplace discards the current state in favour of the snapshot
+	SnapshotReplace SnapshotImportMode = "replace"
+)
+
+// ImportSnapshot loads a snapshot written by ExportSnapshot, or a file store's
+// state file, into the broker and writes the result to the store. The broker
+// state is left unchanged if the snapshot is invalid or cannot be saved.
+func (b *Broker) ImportSnapshot(data []byte, mode SnapshotImportMode) error {
+	logger := b.logger.Session("import-snapshot", lager.Data{"mode": mode})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	if mode != SnapshotMerge && mode != SnapshotReplace {
+		return fmt.Errorf("unknown snapshot import mode %q", mode)
+	}
+
+	var snapshot DynamicState
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		logger.Error("failed-to-unmarshall-snapshot", err)
+		return err
+	}
+
+	if err := b.lock(context.Background(), logger); err != nil {
+		return err
+	}
+	defer b.unlock()
+
+	next := DynamicState{InstanceMap: map[string]ServiceInstance{}, BindingMap: map[string]ServiceBinding{}}
+	if mode == SnapshotMerge {
+		for id, instance := range b.dynamic.InstanceMap {
+			next.InstanceMap[id] = instance
+		}
+		for id, binding := range b.dynamic.BindingMap {
+			next.BindingMap[id] = binding
+		}
+	}
+
+	for id, instance := range snapshot.InstanceMap {
+		if existing, ok := next.InstanceMap[id]; ok && existing.UpdatedAt.After(instance.UpdatedAt) {
+			logger.Info("keeping-newer-instance", lager.Data{"instanceID": id})
+			continue
+		}
+		next.InstanceMap[id] = instance
+	}
+	for id, binding := range snapshot.BindingMap {
+		if existing, ok := next.BindingMap[id]; ok && existing.UpdatedAt.After(binding.UpdatedAt) {
+			logger.Info("keeping-newer-binding", lager.Data{"bindingID": id})
+			continue
+		}
+		next.BindingMap[id] = binding
+	}
+
+	for id, instance := range next.InstanceMap {
+		if instance.Share == "" {
+			return fmt.Errorf("invalid snapshot: instance %s has no share", id)
+		}
+	}
+	for id, binding := range next.BindingMap {
+		if _, ok := next.InstanceMap[binding.InstanceID]; binding.InstanceID != "" && !ok {
+			return fmt.Errorf("invalid snapshot: binding %s refers to unknown instance %s", id, binding.InstanceID)
+		}
+	}
+
+	// SaveAll replaces the stored records at once, removing those the
+	// snapshot replaced, so a failure leaves the store as it was
+	previous := b.dynamic
+	b.dynamic = next
+
+	if err := b.saveAll(logger); err != nil {
+		logger.Error("failed-to-save-state", err)
+		b.dynamic = previous
+		return err
+	}
+
+	logger.Info("snapshot-imported", lager.Data{"instances": len(b.dynamic.InstanceMap), "bindings": len(b.dynamic.BindingMap)})
+	return nil
+}
+
+// copyValue deep copies the maps and slices of a decoded JSON value
+func copyValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(value))
+		for k, v := range value {
+			copied[k] = copyValue(v)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(value))
+		for i, v := range value {
+			copied[i] = copyValue(v)
+		}
+		return copied
+	default:
+		return value
+	}
+}
+
+func (b *Broker) Update(context context.Context, instanceID string, details brokerapi.UpdateDetails, asyncAllowed bool) (brokerapi.UpdateServiceSpec, error) {
+	panic("not implemented")
+}
+
+func (b *Broker) LastOperation(ctx context.Context, instanceID string, operationData string) (brokerapi.LastOperation, error) {
+	logger := b.requestSession(ctx, "last-operation").WithData(lager.Data{"instanceID": instanceID})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if err := b.reload(logger); err != nil {
+		return brokerapi.LastOperation{}, err
+	}
+
+	logger.Debug("state", lager.Data{"instanceCount": len(b.dynamic.InstanceMap), "bindingCount": len(b.dynamic.BindingMap)})
+
+	switch operationData {
+	default:
+		return brokerapi.LastOperation{}, errors.New("unrecognized operationData")
+	}
+}
+
+// provisionAllowed is true when no allowlist is configured, or when either
+// the org or the space is on it
+func (b *Broker) provisionAllowed(organizationGUID, spaceGUID string) bool {
+	if len(b.config.allowedOrgs) == 0 && len(b.config.allowedSpaces) == 0 {
+		return true
+	}
+	return contains(b.config.allowedOrgs, organizationGUID) || contains(b.config.allowedSpaces, spaceGUID)
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// instanceConflicts is true when instanceID was provisioned differently from
+// instance. With a store shared with other brokers, an instance that is in
+// the store but could not be reloaded from it is a conflict too; a store of
+// this broker's alone holds nothing it does not.
+func (b *Broker) instanceConflicts(instance ServiceInstance, instanceID string) (bool, error) {
+	if existing, ok := b.dynamic.InstanceMap[instanceID]; ok {
+		return !existing.provisionedAs(instance, b.config.shareNormalizer), nil
+	}
+	if b.storeLock == nil {
+		return false, nil
+	}
+	return b.store.InstanceExists(instanceID)
+}
+
+// provisionedAs compares what a provision request sets, leaving out the
+// platform context and timestamps. Shares are compared once normalized.
+func (instance ServiceInstance) provisionedAs(other ServiceInstance, normalize ShareNormalizer) bool {
+	return instance.ServiceID == other.ServiceID &&
+		instance.PlanID == other.PlanID &&
+		instance.OrganizationGUID == other.OrganizationGUID &&
+		instance.SpaceGUID == other.SpaceGUID &&
+		normalize(instance.Share) == normalize(other.Share) &&
+		instance.Sec == other.Sec &&
+		instance.Version == other.Version &&
+		sameParameters(instance.BindDefaults, other.BindDefaults) &&
+		sameParameters(instance.Metadata, other.Metadata)
+}
+
+// sameParameters treats nil and empty parameters alike, since empty ones are
+// not stored
+func sameParameters(a, b map[string]interface{}) bool {
+	if len(a) == 0 && len(b) == 0 {
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// bindingConflicts consults a shared store like instanceConflicts
+func (b *Broker) bindingConflicts(bindingID, instanceID string, details brokerapi.BindDetails) (bool, error) {
+	if existing, ok := b.dynamic.BindingMap[bindingID]; ok {
+		return !existing.belongsTo(instanceID) || !reflect.DeepEqual(details, existing.Details), nil
+	}
+	if b.storeLock == nil {
+		return false, nil
+	}
+	return b.store.BindingExists(bindingID)
+}
+
+// checkExclusiveParameters fails if the bind itself sets more than one
+// parameter of an exclusive group; defaults and forced parameters are not
+// checked
+func (b *Broker) checkExclusiveParameters(parameters map[string]interface{}) error {
+	for _, group := range b.config.exclusiveParameters {
+		var given []string
+		for _, key := range group {
+			if _, ok := parameters[key]; ok {
+				given = append(given, key)
+			}
+		}
+		if len(given) > 1 {
+			return invalidParameters(fmt.Errorf("%s cannot be used together", strings.Join(given, ", ")), "conflicting-parameters")
+		}
+	}
+	return nil
+}
+
+// takeOrgToken applies the per organization rate limit, if there is one
+func (b *Broker) takeOrgToken(logger lager.Logger, organizationGUID string) error {
+	if b.orgLimiter == nil {
+		return nil
+	}
+	if ok, retryAfter := b.orgLimiter.take(organizationGUID); !ok {
+		logger.Info("rate-limited", lager.Data{"organizationGUID": organizationGUID, "retryAfter": retryAfter.String()})
+		return rateLimited(retryAfter)
+	}
+	return nil
+}
+
+// refundOrgToken gives back the token of a request that failed to save
+func (b *Broker) refundOrgToken(organizationGUID string) {
+	if b.orgLimiter != nil {
+		b.orgLimiter.refund(organizationGUID)
+	}
+}
+
+// mergeBindParameters layers the instance's bind defaults, then the bind's
+// own parameters, then the parameters the broker forces, each overriding the
+// one before key by key
+func (b *Broker) mergeBindParameters(logger lager.Logger, instanceDefaults, parameters map[string]interface{}) map[string]interface{} {
+	merged := map[string]interface{}{}
+	for key, value := range instanceDefaults {
+		merged[key] = value
+	}
+	for key, value := range parameters {
+		if _, ok := merged[key]; ok {
+			logger.Debug("bind-parameter-overrides-instance-default", lager.Data{"key": key})
+		}
+		merged[key] = value
+	}
+	for key, value := range b.config.forcedBindParameters {
+		if _, ok := merged[key]; ok {
+			logger.Info("forced-bind-parameter-overrides-request", lager.Data{"key": key})
+		}
+		merged[key] = value
+	}
+	return merged
+}
+
+func evaluateContainerPath(parameters map[string]interface{}, volId string) (string, error) {
+	if containerPath, ok := parameters["mount"]; ok && containerPath != "" {
+		containerPath, ok := containerPath.(string)
+		if !ok {
+			return "", brokerapi.ErrRawParamsInvalid
+		}
+		return containerPath, nil
+	}
+
+	return path.Join(DefaultContainerPath, volId), nil
+}
+
+// containerPathAllowed matches the cleaned path, so that .. cannot climb out
+// of an allowed directory
+func (b *Broker) containerPathAllowed(containerPath string) bool {
+	containerPath = path.Clean(containerPath)
+	if b.config.containerPathAllow != nil && !b.config.containerPathAllow.MatchString(containerPath) {
+		return false
+	}
+	if b.config.containerPathDeny != nil && b.config.containerPathDeny.MatchString(containerPath) {
+		return false
+	}
+	return true
+}
+
+// invalidParameters marks err as a problem with the request, so that
+// brokerapi answers 400 Bad Request, logging code as the failed action
+func invalidParameters(err error, code string) error {
+	return brokerapi.NewFailureResponse(err, http.StatusBadRequest, code)
+}
+
+// decodeParameters rejects any raw parameters that are not a JSON object before decoding them into target
+func decodeParameters(rawParameters json.RawMessage, target interface{}) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(rawParameters, &fields); err != nil || fields == nil {
+		return brokerapi.ErrRawParamsInvalid
+	}
+
+	if err := json.Unmarshal(rawParameters, target); err != nil {
+		return brokerapi.ErrRawParamsInvalid
+	}
+	return nil
+}
+
+// missingParameters lists, quoted, every key that parameters lacks
+func missingParameters(parameters map[string]interface{}, keys ...string) []string {
+	var missing []string
+	for _, key := range keys {
+		if _, ok := parameters[key]; !ok {
+			missing = append(missing, strconv.Quote(key))
+		}
+	}
+	return missing
+}
+
+// duplicateShare finds another instance whose share normalizes to the same
+// value
+func (b *Broker) duplicateShare(instanceID, share string) (string, bool) {
+	share = b.config.shareNormalizer(share)
+	for id, instance := range b.dynamic.InstanceMap {
+		if id != instanceID && b.config.shareNormalizer(instance.Share) == share {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+// unknownProvisionFields applies the configured UnknownFieldsMode to any
+// parameters other than the known ones, returning them when they are to be
+// stored
+func (b *Broker) unknownProvisionFields(logger lager.Logger, rawParameters json.RawMessage) (map[string]interface{}, error) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(rawParameters, &fields); err != nil {
+		return nil, brokerapi.ErrRawParamsInvalid
+	}
+	for _, known := range knownProvisionFields {
+		delete(fields, known)
+	}
+	if len(fields) == 0 {
+		return nil, nil
+	}
+
+	var names []string
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	switch b.config.unknownFields {
+	case UnknownFieldsReject:
+		return nil, invalidParameters(fmt.Errorf("unknown provision parameters: %s", strings.Join(names, ", ")), "unknown-parameters")
+	case UnknownFieldsStore:
+		return fields, nil
+	default:
+		logger.Info("ignoring-unknown-provision-parameters", lager.Data{"parameters": names})
+		return nil, nil
+	}
+}
+
+// idToString accepts a uid or gid given either as a string or as a whole JSON number
+func idToString(id interface{}) (string, error) {
+	switch id := id.(type) {
+	case string:
+		return id, nil
+	case float64:
+		if id == float64(int64(id)) {
+			return strconv.FormatInt(int64(id), 10), nil
+		}
+	}
+	return "", brokerapi.ErrRawParamsInvalid
+}
+
+// evaluateMode reads readonly as a boolean. Older clients send it as the
+// string "true" or "false", or as 1 or 0, so those are accepted too. Without
+// it, the plan's default applies.
+func evaluateMode(parameters map[string]interface{}, defaultReadonly bool) (string, error) {
 	if ro, ok := parameters["readonly"]; ok {
-		switch ro := ro.(type) {
-		case bool:
-			return readOnlyToMode(ro), nil
-		default:
+		readonly, ok := toBoolean(ro)
+		if !ok {
 			return "", brokerapi.ErrRawParamsInvalid
 		}
+		return readOnlyToMode(readonly), nil
+	}
+	return readOnlyToMode(defaultReadonly), nil
+}
+
+// evaluateVersion reads the optional version bind parameter. An instance
+// provisioned with a version pins it, and binds may only repeat it.
+func evaluateVersion(parameters map[string]interface{}, pinned string) (string, error) {
+	version, err := toNFSVersion(parameters["version"])
+	if err != nil {
+		return "", err
+	}
+
+	if pinned != "" {
+		if version != "" && version != pinned {
+			return "", invalidParameters(fmt.Errorf("version is pinned to %s by the service instance", pinned), "version-pinned")
+		}
+		return pinned, nil
+	}
+	return version, nil
+}
+
+// toNFSVersion accepts a version as a string or a JSON number, so that 3 and
+// "3" or 4.1 and "4.1" are the same; 4 means 4.0
+func toNFSVersion(value interface{}) (string, error) {
+	var version string
+	switch value := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		version = value
+	case float64:
+		version = strconv.FormatFloat(value, 'f', -1, 64)
+	default:
+		return "", errInvalidNFSVersion
+	}
+
+	if version == "4" {
+		version = "4.0"
+	}
+	if !contains(nfsVersions, version) {
+		return "", errInvalidNFSVersion
+	}
+	return version, nil
+}
+
+// evaluateProto reads the optional proto bind parameter, the transport the
+// share is mounted over
+func evaluateProto(parameters map[string]interface{}) (string, error) {
+	value, ok := parameters["proto"]
+	if !ok {
+		return DefaultNFSProto, nil
+	}
+
+	proto, ok := value.(string)
+	if !ok || (proto != "tcp" && proto != "udp") {
+		return "", invalidParameters(errors.New(`proto must be "tcp" or "udp"`), "invalid-proto")
+	}
+	return proto, nil
+}
+
+// evaluateAccessMode reads the optional access_mode bind parameter, falling
+// back to the plan's, then to read-write-many
+func evaluateAccessMode(parameters map[string]interface{}, planDefault string) (string, error) {
+	value, ok := parameters["access_mode"]
+	if !ok {
+		if planDefault != "" {
+			return planDefault, nil
+		}
+		return AccessModeReadWriteMany, nil
+	}
+
+	accessMode, ok := value.(string)
+	if !ok || !contains(accessModes, accessMode) {
+		return "", invalidParameters(errInvalidAccessMode, "invalid-access-mode")
+	}
+	return accessMode, nil
+}
+
+// evaluateAllowRoot reads the optional allow_root bind parameter. Root stays
+// squashed unless the bind asks otherwise.
+func evaluateAllowRoot(parameters map[string]interface{}) (bool, error) {
+	value, ok := parameters["allow_root"]
+	if !ok {
+		return false, nil
+	}
+
+	allowRoot, ok := toBoolean(value)
+	if !ok {
+		return false, invalidParameters(errors.New("allow_root must be a boolean"), "invalid-allow-root")
+	}
+	return allowRoot, nil
+}
+
+// toBoolean accepts a JSON boolean, or the strings and numbers 1 and 0
+func toBoolean(value interface{}) (bool, bool) {
+	switch value {
+	case true, "true", "1", float64(1):
+		return true, true
+	case false, "false", "0", float64(0):
+		return false, true
+	default:
+		return false, false
+	}
+}
+
+func evaluateScope(parameters map[string]interface{}) (string, error) {
+	if scope, ok := parameters["scope"]; ok {
+		switch scope {
+		case ScopeSpace, ScopeApp:
+			return scope.(string), nil
+		default:
+			return "", invalidParameters(fmt.Errorf("scope must be one of \"%s\" or \"%s\"", ScopeSpace, ScopeApp), "invalid-scope")
+		}
+	}
+	return ScopeSpace, nil
+}
+
+func evaluatePort(parameters map[string]interface{}) (int, error) {
+	value, ok := parameters["port"]
+	if !ok {
+		return 0, nil
+	}
+
+	port, ok := toInteger(value)
+	if !ok || port < 1 || port > 65535 {
+		return 0, errInvalidPort
+	}
+	return port, nil
+}
+
+// evaluatePositiveOption validates an optional positive integer NFS option
+// such as timeo or rsize, falling back to defaultValue when the bind does not
+// set it
+func evaluatePositiveOption(parameters map[string]interface{}, key string, defaultValue int) (int, error) {
+	value, ok := parameters[key]
+	if !ok {
+		return defaultValue, nil
+	}
+
+	option, ok := toInteger(value)
+	if !ok || option < 1 {
+		return 0, invalidParameters(fmt.Errorf("%s must be a positive integer", key), "invalid-"+key)
+	}
+	return option, nil
+}
+
+// toInteger accepts a whole JSON number or a numeric string
+func toInteger(value interface{}) (int, bool) {
+	switch value := value.(type) {
+	case float64:
+		if value != float64(int(value)) {
+			return 0, false
+		}
+		return int(value), true
+	case string:
+		i, err := strconv.Atoi(value)
+		return i, err == nil
+	default:
+		return 0, false
+	}
+}
+
+// evaluateChownID validates an optional numeric owner for the mount point
+func evaluateChownID(parameters map[string]interface{}, key string) (string, error) {
+	value, ok := parameters[key]
+	if !ok {
+		return "", nil
+	}
+
+	id, ok := toInteger(value)
+	if !ok || id < 0 {
+		return "", invalidParameters(fmt.Errorf("%s must be a numeric id", key), "invalid-"+key)
+	}
+	return strconv.Itoa(id), nil
+}
+
+// evaluatePermissionBits validates an optional octal mode such as "0770"
+func evaluatePermissionBits(parameters map[string]interface{}, key string) (string, error) {
+	value, ok := parameters[key]
+	if !ok {
+		return "", nil
+	}
+
+	bits, ok := value.(string)
+	if !ok || !permissionBitsPattern.MatchString(bits) {
+		return "", invalidParameters(fmt.Errorf("%s must be an octal permission string such as \"0770\"", key), "invalid-"+key)
+	}
+	return bits, nil
+}
+
+// shareWithPort rewrites a "server:/export" share as "server:port/export"
+func shareWithPort(share string, port int) string {
+	if port == 0 {
+		return share
+	}
+
+	host, export := share, ""
+	if i := strings.IndexAny(share, ":/"); i >= 0 {
+		host, export = share[:i], strings.TrimPrefix(share[i:], ":")
+	}
+	if !strings.HasPrefix(export, "/") {
+		export = "/" + export
+	}
+	return fmt.Sprintf("%s:%d%s", host, port, export)
+}
+
+// checkShareReachable dials the NFS server behind share, on port or the
+// standard NFS port when port is zero
+func checkShareReachable(ctx context.Context, share string, port int, timeout time.Duration) error {
+	if port == 0 {
+		port = DefaultNFSPort
+	}
+
+	host := share
+	if i := strings.IndexAny(share, ":/"); i >= 0 {
+		host = share[:i]
+	}
+
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return err
 	}
-	return "rw", nil
+	return conn.Close()
 }
 
 func readOnlyToMode(ro bool) string {
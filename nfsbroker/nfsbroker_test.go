@@ -3,6 +3,13 @@ package nfsbroker_test
 import (
 	"bytes"
 	"errors"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
 
 	"code.cloudfoundry.org/lager/lagertest"
 	"github.com/pivotal-cf/brokerapi"
@@ -13,12 +20,16 @@ import (
 
 	"fmt"
 
+	"code.cloudfoundry.org/clock/fakeclock"
+	"code.cloudfoundry.org/goshims/ioutilshim/ioutil_fake"
 	"code.cloudfoundry.org/goshims/osshim/os_fake"
 	"code.cloudfoundry.org/lager"
 	"code.cloudfoundry.org/nfsbroker/nfsbroker"
 	"code.cloudfoundry.org/nfsbroker/nfsbrokerfakes"
 	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
 	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
 )
 
 var _ = Describe("Broker", func() {
@@ -28,6 +39,7 @@ var _ = Describe("Broker", func() {
 		logger    lager.Logger
 		ctx       context.Context
 		fakeStore *nfsbrokerfakes.FakeStore
+		fakeClock *fakeclock.FakeClock
 	)
 
 	BeforeEach(func() {
@@ -35,6 +47,35 @@ var _ = Describe("Broker", func() {
 		ctx = context.TODO()
 		fakeOs = &os_fake.FakeOs{}
 		fakeStore = &nfsbrokerfakes.FakeStore{}
+		fakeClock = fakeclock.NewFakeClock(time.Date(2017, time.June, 1, 12, 0, 0, 0, time.UTC))
+	})
+
+	Context("when a dependency is missing", func() {
+		panicMessage := func(construct func()) (message interface{}) {
+			defer func() {
+				message = recover()
+			}()
+			construct()
+			return nil
+		}
+
+		It("panics naming a nil os", func() {
+			Expect(panicMessage(func() {
+				nfsbroker.New(logger, "service-name", "service-id", "/fake-dir", nil, fakeClock, fakeStore)
+			})).To(Equal("os cannot be nil"))
+		})
+
+		It("panics naming a nil clock", func() {
+			Expect(panicMessage(func() {
+				nfsbroker.New(logger, "service-name", "service-id", "/fake-dir", fakeOs, nil, fakeStore)
+			})).To(Equal("clock cannot be nil"))
+		})
+
+		It("panics naming a nil store", func() {
+			Expect(panicMessage(func() {
+				nfsbroker.New(logger, "service-name", "service-id", "/fake-dir", fakeOs, fakeClock, nil)
+			})).To(Equal("store cannot be nil"))
+		})
 	})
 
 	Context("when creating first time", func() {
@@ -43,7 +84,7 @@ var _ = Describe("Broker", func() {
 				logger,
 				"service-name", "service-id", "/fake-dir",
 				fakeOs,
-				nil,
+				fakeClock,
 				fakeStore,
 			)
 		})
@@ -58,6 +99,7 @@ var _ = Describe("Broker", func() {
 				Expect(result.PlanUpdatable).To(Equal(false))
 				Expect(result.Tags).To(ContainElement("nfs"))
 				Expect(result.Requires).To(ContainElement(brokerapi.RequiredPermission("volume_mount")))
+				Expect(result.Requires).NotTo(ContainElement(brokerapi.RequiredPermission("syslog_drain")))
 
 				Expect(result.Plans[0].Name).To(Equal("Existing"))
 				Expect(result.Plans[0].ID).To(Equal("Existing"))
@@ -103,6 +145,51 @@ var _ = Describe("Broker", func() {
 				Expect(data.InstanceMap[instanceID].PlanID).To(Equal("Existing"))
 			})
 
+			It("records when the instance was created", func() {
+				_, data, _, _ := fakeStore.SaveArgsForCall(fakeStore.SaveCallCount() - 1)
+				Expect(data.InstanceMap[instanceID].CreatedAt).To(Equal(fakeClock.Now()))
+				Expect(data.InstanceMap[instanceID].UpdatedAt).To(Equal(fakeClock.Now()))
+			})
+
+			It("leaves the org and space names empty without a platform context", func() {
+				_, data, _, _ := fakeStore.SaveArgsForCall(fakeStore.SaveCallCount() - 1)
+				Expect(data.InstanceMap[instanceID].OrganizationName).To(BeEmpty())
+				Expect(data.InstanceMap[instanceID].SpaceName).To(BeEmpty())
+			})
+
+			Context("given a platform context", func() {
+				BeforeEach(func() {
+					provisionDetails.RawContext = json.RawMessage(`{
+						"platform": "cloudfoundry",
+						"organization_guid": "org-guid",
+						"organization_name": "some-org",
+						"space_guid": "space-guid",
+						"space_name": "some-space"
+					}`)
+				})
+
+				It("records the org and space names", func() {
+					Expect(err).NotTo(HaveOccurred())
+					_, data, _, _ := fakeStore.SaveArgsForCall(fakeStore.SaveCallCount() - 1)
+					Expect(data.InstanceMap[instanceID].Platform).To(Equal("cloudfoundry"))
+					Expect(data.InstanceMap[instanceID].OrganizationName).To(Equal("some-org"))
+					Expect(data.InstanceMap[instanceID].SpaceName).To(Equal("some-space"))
+				})
+			})
+
+			Context("given a malformed platform context", func() {
+				BeforeEach(func() {
+					provisionDetails.RawContext = json.RawMessage(`"not an object"`)
+				})
+
+				It("provisions anyway", func() {
+					Expect(err).NotTo(HaveOccurred())
+					_, data, _, _ := fakeStore.SaveArgsForCall(fakeStore.SaveCallCount() - 1)
+					Expect(data.InstanceMap[instanceID].Share).To(Equal("server:/some-share"))
+					Expect(data.InstanceMap[instanceID].OrganizationName).To(BeEmpty())
+				})
+			})
+
 			Context("create-service was given invalid JSON", func() {
 				BeforeEach(func() {
 					badJson := []byte("{this is not json")
@@ -114,6 +201,20 @@ var _ = Describe("Broker", func() {
 				})
 
 			})
+			DescribeTable("create-service was given parameters that are not a JSON object",
+				func(rawParameters string) {
+					details := brokerapi.ProvisionDetails{PlanID: "Existing", RawParameters: json.RawMessage(rawParameters)}
+					_, err := broker.Provision(ctx, "other-instance-id", details, false)
+					Expect(err).To(Equal(brokerapi.ErrRawParamsInvalid))
+				},
+				Entry("an array", `["server:/some-share"]`),
+				Entry("a string", `"server:/some-share"`),
+				Entry("a number", `42`),
+				Entry("a boolean", `true`),
+				Entry("null", `null`),
+				Entry("nothing", ``),
+			)
+
 			Context("create-service was given valid JSON but no 'share' key", func() {
 				BeforeEach(func() {
 					configuration := map[string]interface{}{"unknown key": "server:/some-share"}
@@ -123,7 +224,239 @@ var _ = Describe("Broker", func() {
 				})
 
 				It("errors", func() {
-					Expect(err).To(Equal(errors.New("config requires a \"share\" key")))
+					Expect(err).To(MatchError("config requires a \"share\" key"))
+				})
+			})
+
+			Context("create-service was given unknown parameters", func() {
+				BeforeEach(func() {
+					provisionDetails.RawParameters = json.RawMessage(`{"share": "server:/some-share", "owner": "team-a", "cost_center": 42}`)
+				})
+
+				It("ignores them by default", func() {
+					Expect(err).NotTo(HaveOccurred())
+					_, data, _, _ := fakeStore.SaveArgsForCall(fakeStore.SaveCallCount() - 1)
+					Expect(data.InstanceMap[instanceID].Metadata).To(BeNil())
+					Expect(logger.(*lagertest.TestLogger).Buffer()).To(gbytes.Say("ignoring-unknown-provision-parameters"))
+				})
+
+				Context("when the broker rejects them", func() {
+					BeforeEach(func() {
+						broker = nfsbroker.New(
+							logger,
+							"service-name", "service-id", "/fake-dir",
+							fakeOs,
+							fakeClock,
+							fakeStore,
+							nfsbroker.WithUnknownProvisionFields(nfsbroker.UnknownFieldsReject),
+						)
+					})
+
+					It("errors naming them", func() {
+						Expect(err).To(MatchError("unknown provision parameters: cost_center, owner"))
+						Expect(fakeStore.SaveCallCount()).To(Equal(0))
+					})
+				})
+
+				Context("when the broker stores them", func() {
+					BeforeEach(func() {
+						broker = nfsbroker.New(
+							logger,
+							"service-name", "service-id", "/fake-dir",
+							fakeOs,
+							fakeClock,
+							fakeStore,
+							nfsbroker.WithUnknownProvisionFields(nfsbroker.UnknownFieldsStore),
+						)
+					})
+
+					It("keeps them with the instance", func() {
+						Expect(err).NotTo(HaveOccurred())
+						_, data, _, _ := fakeStore.SaveArgsForCall(fakeStore.SaveCallCount() - 1)
+						Expect(data.InstanceMap[instanceID].Metadata).To(Equal(map[string]interface{}{"owner": "team-a", "cost_center": float64(42)}))
+					})
+				})
+			})
+
+			DescribeTable("reports validation failures with a status and code",
+				func(rawParameters string, options []nfsbroker.Option, statusCode int, code string) {
+					broker = nfsbroker.New(
+						logger,
+						"service-name", "service-id", "/fake-dir",
+						fakeOs,
+						fakeClock,
+						fakeStore,
+						options...,
+					)
+					_, err := broker.Provision(ctx, instanceID, brokerapi.ProvisionDetails{PlanID: "Existing", RawParameters: json.RawMessage(rawParameters)}, false)
+					expectFailureResponse(err, logger, statusCode, code)
+				},
+				Entry("a missing share", `{}`, nil, http.StatusBadRequest, "missing-share"),
+				Entry("an unknown sec", `{"share":"server:/some-share","sec":"none"}`, nil, http.StatusBadRequest, "invalid-sec"),
+				Entry("an unknown version", `{"share":"server:/some-share","version":"2"}`, nil, http.StatusBadRequest, "invalid-version"),
+				Entry("rejected unknown parameters", `{"share":"server:/some-share","owner":"team-a"}`, []nfsbroker.Option{nfsbroker.WithUnknownProvisionFields(nfsbroker.UnknownFieldsReject)}, http.StatusBadRequest, "unknown-parameters"),
+				Entry("an org and space off the allowlist", `{"share":"server:/some-share"}`, []nfsbroker.Option{nfsbroker.WithProvisionAllowlist([]string{"allowed-org"}, nil)}, http.StatusForbidden, "provision-not-allowed"),
+			)
+
+			Context("when the instance cannot be saved", func() {
+				BeforeEach(func() {
+					fakeStore.SaveReturns(errors.New("badness"))
+				})
+
+				It("fails the provision", func() {
+					Expect(err).To(MatchError("badness"))
+				})
+
+				It("does not keep the instance in memory", func() {
+					_, data, _, _ := fakeStore.SaveArgsForCall(fakeStore.SaveCallCount() - 1)
+					Expect(data.InstanceMap).NotTo(HaveKey(instanceID))
+				})
+			})
+
+			Context("given a provision allowlist", func() {
+				BeforeEach(func() {
+					broker = nfsbroker.New(
+						logger,
+						"service-name", "service-id", "/fake-dir",
+						fakeOs,
+						fakeClock,
+						fakeStore,
+						nfsbroker.WithProvisionAllowlist([]string{"allowed-org"}, []string{"allowed-space"}),
+					)
+				})
+
+				DescribeTable("checks the org and space",
+					func(organizationGUID, spaceGUID string, allowed bool) {
+						provisionDetails.OrganizationGUID = organizationGUID
+						provisionDetails.SpaceGUID = spaceGUID
+						_, err := broker.Provision(ctx, "other-instance-id", provisionDetails, false)
+						if allowed {
+							Expect(err).NotTo(HaveOccurred())
+						} else {
+							Expect(err).To(Equal(nfsbroker.ErrProvisionNotAllowed))
+						}
+					},
+					Entry("an allowed org", "allowed-org", "other-space", true),
+					Entry("an allowed space in another org", "other-org", "allowed-space", true),
+					Entry("an allowed org and space", "allowed-org", "allowed-space", true),
+					Entry("neither allowed", "other-org", "other-space", false),
+				)
+
+				It("refuses an org and space off the allowlist before looking at the parameters", func() {
+					provisionDetails.OrganizationGUID = "other-org"
+					provisionDetails.RawParameters = json.RawMessage(`{"sec":"none"}`)
+					_, err := broker.Provision(ctx, "other-instance-id", provisionDetails, false)
+					Expect(err).To(Equal(nfsbroker.ErrProvisionNotAllowed))
+				})
+			})
+
+			Context("when duplicate shares are rejected", func() {
+				BeforeEach(func() {
+					broker = nfsbroker.New(
+						logger,
+						"service-name", "service-id", "/fake-dir",
+						fakeOs,
+						fakeClock,
+						fakeStore,
+						nfsbroker.WithDuplicateShares(nfsbroker.DuplicateSharesReject),
+					)
+				})
+
+				DescribeTable("compares the normalized share",
+					func(share string, duplicate bool) {
+						Expect(err).NotTo(HaveOccurred())
+
+						details := brokerapi.ProvisionDetails{PlanID: "Existing", RawParameters: json.RawMessage(`{"share": "` + share + `"}`)}
+						_, err := broker.Provision(ctx, "other-instance-id", details, false)
+						if duplicate {
+							Expect(err).To(Equal(nfsbroker.ErrDuplicateShare))
+						} else {
+							Expect(err).NotTo(HaveOccurred())
+						}
+					},
+					Entry("the exact share", "server:/some-share", true),
+					Entry("a trailing slash", "server:/some-share/", true),
+					Entry("a different case", "SERVER:/Some-Share", true),
+					Entry("a distinct share", "server:/other-share", false),
+				)
+
+				Context("when shares are compared case sensitively", func() {
+					BeforeEach(func() {
+						broker = nfsbroker.New(
+							logger,
+							"service-name", "service-id", "/fake-dir",
+							fakeOs,
+							fakeClock,
+							fakeStore,
+							nfsbroker.WithDuplicateShares(nfsbroker.DuplicateSharesReject),
+							nfsbroker.WithShareNormalizer(nfsbroker.CaseSensitiveShareNormalizer),
+						)
+					})
+
+					It("allows an export path differing only by case", func() {
+						details := brokerapi.ProvisionDetails{PlanID: "Existing", RawParameters: json.RawMessage(`{"share": "SERVER:/Some-Share"}`)}
+						_, err := broker.Provision(ctx, "other-instance-id", details, false)
+						Expect(err).NotTo(HaveOccurred())
+					})
+
+					It("still rejects a duplicate with repeated slashes", func() {
+						details := brokerapi.ProvisionDetails{PlanID: "Existing", RawParameters: json.RawMessage(`{"share": "server://some-share/"}`)}
+						_, err := broker.Provision(ctx, "other-instance-id", details, false)
+						Expect(err).To(Equal(nfsbroker.ErrDuplicateShare))
+					})
+				})
+			})
+
+			Context("when duplicate shares are warned about", func() {
+				BeforeEach(func() {
+					broker = nfsbroker.New(
+						logger,
+						"service-name", "service-id", "/fake-dir",
+						fakeOs,
+						fakeClock,
+						fakeStore,
+						nfsbroker.WithDuplicateShares(nfsbroker.DuplicateSharesWarn),
+					)
+				})
+
+				It("provisions and logs the duplicate", func() {
+					_, err := broker.Provision(ctx, "other-instance-id", provisionDetails, false)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(logger.(*lagertest.TestLogger).Buffer()).To(gbytes.Say("duplicate-share"))
+				})
+			})
+
+			Context("given an instance limit", func() {
+				BeforeEach(func() {
+					broker = nfsbroker.New(
+						logger,
+						"service-name", "service-id", "/fake-dir",
+						fakeOs,
+						fakeClock,
+						fakeStore,
+						nfsbroker.WithMaxInstances(2),
+					)
+
+					_, err := broker.Provision(ctx, "first-instance-id", provisionDetails, false)
+					Expect(err).NotTo(HaveOccurred())
+				})
+
+				It("provisions up to the limit", func() {
+					Expect(err).NotTo(HaveOccurred())
+				})
+
+				It("rejects provisioning past the limit", func() {
+					_, err := broker.Provision(ctx, "third-instance-id", provisionDetails, false)
+					Expect(err).To(Equal(brokerapi.ErrInstanceLimitMet))
+					Expect(fakeStore.SaveCallCount()).To(Equal(2))
+				})
+
+				It("frees a slot on deprovision", func() {
+					_, err := broker.Deprovision(ctx, "first-instance-id", brokerapi.DeprovisionDetails{}, false)
+					Expect(err).NotTo(HaveOccurred())
+
+					_, err = broker.Provision(ctx, "third-instance-id", provisionDetails, false)
+					Expect(err).NotTo(HaveOccurred())
 				})
 			})
 
@@ -138,6 +471,73 @@ var _ = Describe("Broker", func() {
 					Expect(err).To(Equal(brokerapi.ErrInstanceAlreadyExists))
 				})
 			})
+
+			Context("when the service instance is provisioned again with the same details", func() {
+				// enclosing context creates initial instance
+				JustBeforeEach(func() {
+					_, err = broker.Provision(ctx, "some-instance-id", provisionDetails, true)
+				})
+
+				It("should succeed", func() {
+					Expect(err).NotTo(HaveOccurred())
+					Expect(fakeStore.SaveCallCount()).To(Equal(2))
+				})
+			})
+
+			Context("when the service instance is provisioned again with the share spelled differently", func() {
+				JustBeforeEach(func() {
+					provisionDetails.RawParameters = json.RawMessage(`{"share":"SERVER:/some-share/"}`)
+					_, err = broker.Provision(ctx, "some-instance-id", provisionDetails, true)
+				})
+
+				It("should succeed", func() {
+					Expect(err).NotTo(HaveOccurred())
+				})
+			})
+
+			It("keeps the creation time when provisioning the same details", func() {
+				createdAt := fakeClock.Now()
+				fakeClock.Increment(time.Hour)
+
+				_, err := broker.Provision(ctx, "some-instance-id", provisionDetails, true)
+				Expect(err).NotTo(HaveOccurred())
+
+				_, data, _, _ := fakeStore.SaveArgsForCall(fakeStore.SaveCallCount() - 1)
+				Expect(data.InstanceMap["some-instance-id"].CreatedAt).To(Equal(createdAt))
+				Expect(data.InstanceMap["some-instance-id"].UpdatedAt).To(Equal(createdAt.Add(time.Hour)))
+			})
+
+			It("does not look the instance up in a store of its own", func() {
+				Expect(fakeStore.InstanceExistsCallCount()).To(Equal(0))
+			})
+
+			Context("when another broker has saved the instance", func() {
+				BeforeEach(func() {
+					fakeLocker := &nfsbrokerfakes.FakeLocker{}
+					fakeLocker.TryLockReturns(true, nil)
+					broker = nfsbroker.New(logger, "service-name", "service-id", "/fake-dir", fakeOs, fakeClock, &lockingStore{FakeStore: fakeStore, FakeLocker: fakeLocker})
+					fakeStore.InstanceExistsReturns(true, nil)
+				})
+
+				It("should error without saving", func() {
+					Expect(err).To(Equal(brokerapi.ErrInstanceAlreadyExists))
+					Expect(fakeStore.InstanceExistsArgsForCall(0)).To(Equal(instanceID))
+					Expect(fakeStore.SaveCallCount()).To(Equal(0))
+				})
+			})
+
+			Context("when the store cannot be checked", func() {
+				BeforeEach(func() {
+					fakeLocker := &nfsbrokerfakes.FakeLocker{}
+					fakeLocker.TryLockReturns(true, nil)
+					broker = nfsbroker.New(logger, "service-name", "service-id", "/fake-dir", fakeOs, fakeClock, &lockingStore{FakeStore: fakeStore, FakeLocker: fakeLocker})
+					fakeStore.InstanceExistsReturns(false, errors.New("badness"))
+				})
+
+				It("fails the provision", func() {
+					Expect(err).To(MatchError("badness"))
+				})
+			})
 		})
 
 		Context(".Deprovision", func() {
@@ -168,6 +568,24 @@ var _ = Describe("Broker", func() {
 				It("should fail", func() {
 					Expect(err).To(Equal(brokerapi.ErrInstanceDoesNotExist))
 				})
+
+				Context("when deprovision is lenient", func() {
+					BeforeEach(func() {
+						broker = nfsbroker.New(
+							logger,
+							"service-name", "service-id", "/fake-dir",
+							fakeOs,
+							fakeClock,
+							fakeStore,
+							nfsbroker.WithLenientDeprovision(),
+						)
+					})
+
+					It("should succeed without saving", func() {
+						Expect(err).NotTo(HaveOccurred())
+						Expect(fakeStore.SaveCallCount()).To(Equal(0))
+					})
+				})
 			})
 
 			Context("given an existing instance", func() {
@@ -199,6 +617,22 @@ var _ = Describe("Broker", func() {
 					_, exists := data.InstanceMap[instanceID]
 					Expect(exists).To(BeFalse())
 				})
+
+				Context("when the deprovision cannot be saved", func() {
+					BeforeEach(func() {
+						fakeStore.SaveReturns(errors.New("badness"))
+					})
+
+					It("fails the deprovision", func() {
+						Expect(err).To(MatchError("badness"))
+					})
+
+					It("keeps the instance in memory", func() {
+						_, data, _, _ := fakeStore.SaveArgsForCall(fakeStore.SaveCallCount() - 1)
+						Expect(data.InstanceMap).To(HaveKey(instanceID))
+						Expect(data.InstanceMap[instanceID].Share).To(Equal("server:/some-share"))
+					})
+				})
 			})
 
 		})
@@ -208,6 +642,21 @@ var _ = Describe("Broker", func() {
 				_, err := broker.LastOperation(ctx, "non-existant", "provision")
 				Expect(err).To(HaveOccurred())
 			})
+
+			It("logs how many instances and bindings the broker holds", func() {
+				provisionDetails := brokerapi.ProvisionDetails{PlanID: "Existing", RawParameters: json.RawMessage(`{"share":"server:/some-share"}`)}
+				_, err := broker.Provision(ctx, "instance-1", provisionDetails, false)
+				Expect(err).NotTo(HaveOccurred())
+				_, err = broker.Provision(ctx, "instance-2", provisionDetails, false)
+				Expect(err).NotTo(HaveOccurred())
+
+				bindDetails := brokerapi.BindDetails{AppGUID: "guid", Parameters: map[string]interface{}{"uid": "1000", "gid": "1000"}}
+				_, err = broker.Bind(ctx, "instance-1", "binding-id", bindDetails)
+				Expect(err).NotTo(HaveOccurred())
+
+				broker.LastOperation(ctx, "instance-1", "provision")
+				Expect(logger.(*lagertest.TestLogger).Buffer()).To(gbytes.Say(`"bindingCount":1,"instanceCount":2`))
+			})
 		})
 
 		Context(".Bind", func() {
@@ -250,205 +699,2340 @@ var _ = Describe("Broker", func() {
 				Expect(share).To(Equal(fmt.Sprintf("nfs://server:/some-share?uid=%s&gid=%s", uid, gid)))
 			})
 
-			Context("given the uid is not supplied", func() {
-				BeforeEach(func() {
-					bindDetails = brokerapi.BindDetails{AppGUID: "guid", Parameters: map[string]interface{}{
-						nfsbroker.Username: "principal name",
-						nfsbroker.Secret:   "some keytab data",
-						"gid":              gid,
-					},
-					}
+			It("does not return a syslog drain url", func() {
+				binding, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(binding.SyslogDrainURL).To(BeEmpty())
+			})
+
+			Context("given a port", func() {
+				It("includes a numeric port in the source", func() {
+					bindDetails.Parameters["port"] = float64(2049)
+					binding, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(binding.VolumeMounts[0].Device.MountConfig["source"]).To(Equal(fmt.Sprintf("nfs://server:2049/some-share?uid=%s&gid=%s", uid, gid)))
 				})
 
-				It("should return with an error", func() {
-					_, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
-					Expect(err).To(HaveOccurred())
+				It("includes a string port in the source", func() {
+					bindDetails.Parameters["port"] = "12345"
+					binding, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(binding.VolumeMounts[0].Device.MountConfig["source"]).To(Equal(fmt.Sprintf("nfs://server:12345/some-share?uid=%s&gid=%s", uid, gid)))
 				})
-			})
 
-			Context("given the gid is not supplied", func() {
-				BeforeEach(func() {
-					bindDetails = brokerapi.BindDetails{AppGUID: "guid", Parameters: map[string]interface{}{
-						nfsbroker.Username: "principal name",
-						nfsbroker.Secret:   "some keytab data",
-						"uid":              uid,
-					},
-					}
+				It("rejects a port out of range", func() {
+					bindDetails.Parameters["port"] = float64(70000)
+					_, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+					Expect(err).To(MatchError("port must be an integer between 1 and 65535"))
 				})
 
-				It("should return with an error", func() {
+				It("rejects a port that is not a number", func() {
+					bindDetails.Parameters["port"] = "nfs"
 					_, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
-					Expect(err).To(HaveOccurred())
+					Expect(err).To(MatchError("port must be an integer between 1 and 65535"))
 				})
 			})
 
-			It("includes empty credentials to prevent CAPI crash", func() {
-				binding, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
-				Expect(err).NotTo(HaveOccurred())
+			Context("given nfs retry options", func() {
+				It("includes them in the source", func() {
+					bindDetails.Parameters["timeo"] = float64(600)
+					bindDetails.Parameters["retrans"] = "5"
+					binding, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(binding.VolumeMounts[0].Device.MountConfig["source"]).To(Equal(fmt.Sprintf("nfs://server:/some-share?uid=%s&gid=%s&timeo=600&retrans=5", uid, gid)))
+				})
 
-				Expect(binding.Credentials).NotTo(BeNil())
-			})
+				DescribeTable("rejects values that are not positive integers",
+					func(key string, value interface{}) {
+						bindDetails.Parameters[key] = value
+						_, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+						Expect(err).To(MatchError(key + " must be a positive integer"))
+					},
+					Entry("a word", "timeo", "long"),
+					Entry("a fraction", "timeo", 1.5),
+					Entry("zero", "retrans", float64(0)),
+					Entry("a negative string", "retrans", "-1"),
+					Entry("a boolean", "retrans", true),
+				)
 
-			It("uses the instance id in the default container path", func() {
-				binding, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
-				Expect(err).NotTo(HaveOccurred())
-				Expect(binding.VolumeMounts[0].ContainerDir).To(Equal("/var/vcap/data/some-instance-id"))
-			})
+				Context("when the broker has retry defaults", func() {
+					BeforeEach(func() {
+						broker = nfsbroker.New(
+							logger,
+							"service-name", "service-id", "/fake-dir",
+							fakeOs,
+							fakeClock,
+							fakeStore,
+							nfsbroker.WithRetryDefaults(300, 3),
+						)
+
+						provisionDetails := brokerapi.ProvisionDetails{PlanID: "Existing", RawParameters: json.RawMessage(`{"share":"server:/some-share"}`)}
+						_, err := broker.Provision(ctx, instanceID, provisionDetails, false)
+						Expect(err).NotTo(HaveOccurred())
+					})
 
-			It("flows container path through", func() {
-				bindDetails.Parameters["mount"] = "/var/vcap/otherdir/something"
-				binding, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
-				Expect(err).NotTo(HaveOccurred())
-				Expect(binding.VolumeMounts[0].ContainerDir).To(Equal("/var/vcap/otherdir/something"))
-			})
+					It("applies the defaults", func() {
+						binding, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+						Expect(err).NotTo(HaveOccurred())
+						Expect(binding.VolumeMounts[0].Device.MountConfig["source"]).To(Equal(fmt.Sprintf("nfs://server:/some-share?uid=%s&gid=%s&timeo=300&retrans=3", uid, gid)))
+					})
 
-			It("uses rw as its default mode", func() {
-				binding, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
-				Expect(err).NotTo(HaveOccurred())
-				Expect(binding.VolumeMounts[0].Mode).To(Equal("rw"))
+					It("lets the bind override them", func() {
+						bindDetails.Parameters["timeo"] = "50"
+						binding, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+						Expect(err).NotTo(HaveOccurred())
+						Expect(binding.VolumeMounts[0].Device.MountConfig["source"]).To(Equal(fmt.Sprintf("nfs://server:/some-share?uid=%s&gid=%s&timeo=50&retrans=3", uid, gid)))
+					})
+				})
 			})
 
-			It("sets mode to `r` when readonly is true", func() {
-				bindDetails.Parameters["readonly"] = true
-				binding, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
-				Expect(err).NotTo(HaveOccurred())
-
-				Expect(binding.VolumeMounts[0].Mode).To(Equal("r"))
-			})
+			Context("given nfs block sizes", func() {
+				It("includes them in the source", func() {
+					bindDetails.Parameters["rsize"] = float64(65536)
+					bindDetails.Parameters["wsize"] = "1048576"
+					binding, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(binding.VolumeMounts[0].Device.MountConfig["source"]).To(Equal(fmt.Sprintf("nfs://server:/some-share?uid=%s&gid=%s&rsize=65536&wsize=1048576", uid, gid)))
+				})
 
-			It("should write state", func() {
-				_, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
-				Expect(err).NotTo(HaveOccurred())
+				It("leaves them to the driver when absent", func() {
+					binding, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(binding.VolumeMounts[0].Device.MountConfig["source"]).NotTo(ContainSubstring("size"))
+				})
+
+				It("rejects values that are not positive integers", func() {
+					bindDetails.Parameters["wsize"] = float64(0)
+					_, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+					Expect(err).To(MatchError("wsize must be a positive integer"))
+				})
+
+				It("logs a size that is not a power of two", func() {
+					bindDetails.Parameters["rsize"] = float64(60000)
+					binding, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(binding.VolumeMounts[0].Device.MountConfig["source"]).To(ContainSubstring("&rsize=60000"))
+					Expect(logger.(*lagertest.TestLogger).Buffer()).To(gbytes.Say("block-size-not-power-of-two"))
+				})
+
+				Context("when the broker has block size defaults and is strict", func() {
+					BeforeEach(func() {
+						broker = nfsbroker.New(
+							logger,
+							"service-name", "service-id", "/fake-dir",
+							fakeOs,
+							fakeClock,
+							fakeStore,
+							nfsbroker.WithBlockSizeDefaults(32768, 32768),
+							nfsbroker.WithStrictBlockSizes(),
+						)
+
+						provisionDetails := brokerapi.ProvisionDetails{PlanID: "Existing", RawParameters: json.RawMessage(`{"share":"server:/some-share"}`)}
+						_, err := broker.Provision(ctx, instanceID, provisionDetails, false)
+						Expect(err).NotTo(HaveOccurred())
+					})
+
+					It("applies the defaults", func() {
+						binding, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+						Expect(err).NotTo(HaveOccurred())
+						Expect(binding.VolumeMounts[0].Device.MountConfig["source"]).To(Equal(fmt.Sprintf("nfs://server:/some-share?uid=%s&gid=%s&rsize=32768&wsize=32768", uid, gid)))
+					})
+
+					It("rejects a size that is not a power of two", func() {
+						bindDetails.Parameters["wsize"] = "60000"
+						_, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+						Expect(err).To(MatchError("wsize must be a power of two"))
+					})
+				})
+			})
+
+			Context("given an instance provisioned with a security flavor", func() {
+				var sec string
+
+				JustBeforeEach(func() {
+					provisionDetails := brokerapi.ProvisionDetails{PlanID: "Existing", RawParameters: json.RawMessage(`{"share":"server:/some-share","sec":"` + sec + `"}`)}
+					_, err := broker.Provision(ctx, "secure-instance-id", provisionDetails, false)
+					Expect(err).NotTo(HaveOccurred())
+				})
+
+				Context("when the flavor is sys", func() {
+					BeforeEach(func() {
+						sec = "sys"
+					})
+
+					It("includes it in the source", func() {
+						binding, err := broker.Bind(ctx, "secure-instance-id", "binding-id", bindDetails)
+						Expect(err).NotTo(HaveOccurred())
+						Expect(binding.VolumeMounts[0].Device.MountConfig["source"]).To(Equal(fmt.Sprintf("nfs://server:/some-share?uid=%s&gid=%s&sec=sys", uid, gid)))
+					})
+				})
+
+				Context("when the flavor is kerberos", func() {
+					BeforeEach(func() {
+						sec = "krb5p"
+					})
+
+					It("includes it in the source when the credentials are given", func() {
+						binding, err := broker.Bind(ctx, "secure-instance-id", "binding-id", bindDetails)
+						Expect(err).NotTo(HaveOccurred())
+						Expect(binding.VolumeMounts[0].Device.MountConfig["source"]).To(Equal(fmt.Sprintf("nfs://server:/some-share?uid=%s&gid=%s&sec=krb5p", uid, gid)))
+					})
+
+					It("requires the kerberos credentials", func() {
+						delete(bindDetails.Parameters, nfsbroker.Secret)
+						_, err := broker.Bind(ctx, "secure-instance-id", "binding-id", bindDetails)
+						Expect(err).To(MatchError(`sec krb5p requires "kerberosKeytab"`))
+					})
+				})
+			})
+
+			Context("given a transport protocol", func() {
+				It("includes udp in the source", func() {
+					bindDetails.Parameters["proto"] = "udp"
+					binding, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(binding.VolumeMounts[0].Device.MountConfig["source"]).To(Equal(fmt.Sprintf("nfs://server:/some-share?uid=%s&gid=%s&proto=udp", uid, gid)))
+				})
+
+				It("leaves tcp, the default, out of the source", func() {
+					bindDetails.Parameters["proto"] = "tcp"
+					binding, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(binding.VolumeMounts[0].Device.MountConfig["source"]).To(Equal(fmt.Sprintf("nfs://server:/some-share?uid=%s&gid=%s", uid, gid)))
+				})
+
+				It("mounts over tcp when the bind does not say", func() {
+					binding, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(binding.VolumeMounts[0].Device.MountConfig["source"]).NotTo(ContainSubstring("proto"))
+				})
+
+				DescribeTable("rejects other protocols",
+					func(proto interface{}) {
+						bindDetails.Parameters["proto"] = proto
+						_, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+						Expect(err).To(MatchError(`proto must be "tcp" or "udp"`))
+						expectFailureResponse(err, logger, http.StatusBadRequest, "invalid-proto")
+					},
+					Entry("rdma", "rdma"),
+					Entry("upper case", "UDP"),
+					Entry("a number", float64(6)),
+				)
+			})
+
+			Context("given an access mode", func() {
+				It("mounts without locking for a single writer", func() {
+					bindDetails.Parameters["access_mode"] = "read-write-once"
+					binding, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(binding.VolumeMounts[0].Device.MountConfig["source"]).To(Equal(fmt.Sprintf("nfs://server:/some-share?uid=%s&gid=%s&nolock=true", uid, gid)))
+				})
+
+				It("keeps locking for many writers", func() {
+					bindDetails.Parameters["access_mode"] = "read-write-many"
+					binding, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(binding.VolumeMounts[0].Device.MountConfig["source"]).To(Equal(fmt.Sprintf("nfs://server:/some-share?uid=%s&gid=%s", uid, gid)))
+				})
+
+				It("allows many writers when the bind does not say", func() {
+					binding, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(binding.VolumeMounts[0].Device.MountConfig["source"]).NotTo(ContainSubstring("nolock"))
+				})
+
+				It("rejects an unknown access mode", func() {
+					bindDetails.Parameters["access_mode"] = "exclusive"
+					_, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+					Expect(err).To(MatchError(`access_mode must be "read-write-once" or "read-write-many"`))
+					expectFailureResponse(err, logger, http.StatusBadRequest, "invalid-access-mode")
+				})
+			})
+
+			Context("given exclusive parameter groups", func() {
+				BeforeEach(func() {
+					broker = nfsbroker.New(
+						logger,
+						"service-name", "service-id", "/fake-dir",
+						fakeOs,
+						fakeClock,
+						fakeStore,
+						nfsbroker.WithExclusiveBindParameters([][]string{{"soft", "hard"}, {"timeo", "retrans", "proto"}}),
+					)
+
+					provisionDetails := brokerapi.ProvisionDetails{PlanID: "Existing", RawParameters: json.RawMessage(`{"share":"server:/some-share"}`)}
+					_, err := broker.Provision(ctx, instanceID, provisionDetails, false)
+					Expect(err).NotTo(HaveOccurred())
+				})
+
+				It("rejects a bind setting two parameters of a group", func() {
+					bindDetails.Parameters["soft"] = true
+					bindDetails.Parameters["hard"] = true
+					_, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+					Expect(err).To(MatchError("soft, hard cannot be used together"))
+					expectFailureResponse(err, logger, http.StatusBadRequest, "conflicting-parameters")
+				})
+
+				It("accepts a bind setting one parameter of each group", func() {
+					bindDetails.Parameters["soft"] = true
+					bindDetails.Parameters["timeo"] = "600"
+					_, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+					Expect(err).NotTo(HaveOccurred())
+				})
+			})
+
+			Context("given an instance provisioned with bind defaults", func() {
+				BeforeEach(func() {
+					provisionDetails := brokerapi.ProvisionDetails{PlanID: "Existing", RawParameters: json.RawMessage(`{"share":"server:/some-share","bind_defaults":{"timeo":600,"retrans":3,"rsize":32768}}`)}
+					_, err := broker.Provision(ctx, "defaulted-instance-id", provisionDetails, false)
+					Expect(err).NotTo(HaveOccurred())
+				})
+
+				It("applies the instance defaults", func() {
+					binding, err := broker.Bind(ctx, "defaulted-instance-id", "binding-id", bindDetails)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(binding.VolumeMounts[0].Device.MountConfig["source"]).To(Equal(fmt.Sprintf("nfs://server:/some-share?uid=%s&gid=%s&timeo=600&retrans=3&rsize=32768", uid, gid)))
+				})
+
+				It("lets the bind parameters override them", func() {
+					bindDetails.Parameters["retrans"] = "5"
+					binding, err := broker.Bind(ctx, "defaulted-instance-id", "binding-id", bindDetails)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(binding.VolumeMounts[0].Device.MountConfig["source"]).To(Equal(fmt.Sprintf("nfs://server:/some-share?uid=%s&gid=%s&timeo=600&retrans=5&rsize=32768", uid, gid)))
+				})
+
+				It("stores the bind parameters without the defaults", func() {
+					_, err := broker.Bind(ctx, "defaulted-instance-id", "binding-id", bindDetails)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(broker.Dump().BindingMap["binding-id"].Details.Parameters).NotTo(HaveKey("timeo"))
+				})
+
+				Context("when the broker forces bind parameters", func() {
+					BeforeEach(func() {
+						broker = nfsbroker.New(
+							logger,
+							"service-name", "service-id", "/fake-dir",
+							fakeOs,
+							fakeClock,
+							fakeStore,
+							nfsbroker.WithForcedBindParameters(map[string]interface{}{"rsize": float64(8192)}),
+						)
+
+						provisionDetails := brokerapi.ProvisionDetails{PlanID: "Existing", RawParameters: json.RawMessage(`{"share":"server:/some-share","bind_defaults":{"timeo":600,"retrans":3,"rsize":32768}}`)}
+						_, err := broker.Provision(ctx, "defaulted-instance-id", provisionDetails, false)
+						Expect(err).NotTo(HaveOccurred())
+					})
+
+					It("lets each layer win for its own keys", func() {
+						bindDetails.Parameters["retrans"] = "5"
+						bindDetails.Parameters["rsize"] = "65536"
+						binding, err := broker.Bind(ctx, "defaulted-instance-id", "binding-id", bindDetails)
+						Expect(err).NotTo(HaveOccurred())
+						Expect(binding.VolumeMounts[0].Device.MountConfig["source"]).To(Equal(fmt.Sprintf("nfs://server:/some-share?uid=%s&gid=%s&timeo=600&retrans=5&rsize=8192", uid, gid)))
+					})
+				})
+			})
+
+			Context("given an nfs version", func() {
+				It("includes a bind-time version in the source", func() {
+					bindDetails.Parameters["version"] = 4.1
+					binding, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(binding.VolumeMounts[0].Device.MountConfig["source"]).To(Equal(fmt.Sprintf("nfs://server:/some-share?uid=%s&gid=%s&version=4.1", uid, gid)))
+				})
+
+				It("rejects an unknown version", func() {
+					bindDetails.Parameters["version"] = "2"
+					_, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+					Expect(err).To(MatchError(`version must be one of "3", "4.0", "4.1" or "4.2"`))
+				})
+
+				Context("when the instance pins a version", func() {
+					BeforeEach(func() {
+						provisionDetails := brokerapi.ProvisionDetails{PlanID: "Existing", RawParameters: json.RawMessage(`{"share":"server:/some-share","version":"4"}`)}
+						_, err := broker.Provision(ctx, "pinned-instance-id", provisionDetails, false)
+						Expect(err).NotTo(HaveOccurred())
+					})
+
+					It("uses it when the bind does not set one", func() {
+						binding, err := broker.Bind(ctx, "pinned-instance-id", "binding-id", bindDetails)
+						Expect(err).NotTo(HaveOccurred())
+						Expect(binding.VolumeMounts[0].Device.MountConfig["source"]).To(Equal(fmt.Sprintf("nfs://server:/some-share?uid=%s&gid=%s&version=4.0", uid, gid)))
+					})
+
+					It("accepts the same version at bind time", func() {
+						bindDetails.Parameters["version"] = "4.0"
+						_, err := broker.Bind(ctx, "pinned-instance-id", "binding-id", bindDetails)
+						Expect(err).NotTo(HaveOccurred())
+					})
+
+					It("rejects a different version at bind time", func() {
+						bindDetails.Parameters["version"] = float64(3)
+						_, err := broker.Bind(ctx, "pinned-instance-id", "binding-id", bindDetails)
+						Expect(err).To(MatchError("version is pinned to 4.0 by the service instance"))
+					})
+				})
+			})
+
+			It("rejects an unknown security flavor on provision", func() {
+				provisionDetails := brokerapi.ProvisionDetails{PlanID: "Existing", RawParameters: json.RawMessage(`{"share":"server:/some-share","sec":"none"}`)}
+				_, err := broker.Provision(ctx, "secure-instance-id", provisionDetails, false)
+				Expect(err).To(MatchError(`sec must be one of "sys", "krb5", "krb5i" or "krb5p"`))
+			})
+
+			Context("given mount point permission bits", func() {
+				It("includes valid octal modes in the source", func() {
+					bindDetails.Parameters["dir_mode"] = "0770"
+					bindDetails.Parameters["file_mode"] = "640"
+					binding, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(binding.VolumeMounts[0].Device.MountConfig["source"]).To(Equal(fmt.Sprintf("nfs://server:/some-share?uid=%s&gid=%s&dir_mode=0770&file_mode=640", uid, gid)))
+				})
+
+				It("leaves the source alone when absent", func() {
+					binding, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(binding.VolumeMounts[0].Device.MountConfig["source"]).NotTo(ContainSubstring("_mode"))
+				})
+
+				DescribeTable("rejects invalid modes",
+					func(key string, value interface{}) {
+						bindDetails.Parameters[key] = value
+						_, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+						Expect(err).To(MatchError(key + ` must be an octal permission string such as "0770"`))
+					},
+					Entry("a non-octal digit", "dir_mode", "0780"),
+					Entry("too many digits", "dir_mode", "07770"),
+					Entry("too few digits", "file_mode", "77"),
+					Entry("symbolic notation", "file_mode", "rwxr-x---"),
+					Entry("a number", "dir_mode", float64(770)),
+					Entry("an injected option", "file_mode", "0644&uid=0"),
+				)
+			})
+
+			Context("given a mount config size limit", func() {
+				BeforeEach(func() {
+					broker = nfsbroker.New(
+						logger,
+						"service-name", "service-id", "/fake-dir",
+						fakeOs,
+						fakeClock,
+						fakeStore,
+						nfsbroker.WithMaxMountConfigSize(1024),
+					)
+
+					provisionDetails := brokerapi.ProvisionDetails{PlanID: "Existing", RawParameters: json.RawMessage(`{"share":"server:/some-share"}`)}
+					_, err := broker.Provision(ctx, instanceID, provisionDetails, false)
+					Expect(err).NotTo(HaveOccurred())
+				})
+
+				It("binds within the limit", func() {
+					_, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+					Expect(err).NotTo(HaveOccurred())
+				})
+
+				It("rejects oversized parameters without storing the binding", func() {
+					saves := fakeStore.SaveCallCount()
+					bindDetails.Parameters[nfsbroker.Secret] = strings.Repeat("x", 2048)
+					_, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+					Expect(err).To(MatchError("bind parameter data is larger than 1024 bytes"))
+					expectFailureResponse(err, logger, http.StatusBadRequest, "bind-parameters-too-large")
+					Expect(fakeStore.SaveCallCount()).To(Equal(saves))
+				})
+
+				DescribeTable("counts what the broker adds to the mount config",
+					func(option nfsbroker.Option) {
+						broker = nfsbroker.New(
+							logger,
+							"service-name", "service-id", "/fake-dir",
+							fakeOs,
+							fakeClock,
+							fakeStore,
+							nfsbroker.WithMaxMountConfigSize(1024),
+							option,
+						)
+						provisionDetails := brokerapi.ProvisionDetails{PlanID: "Existing", RawParameters: json.RawMessage(`{"share":"server:/some-share"}`)}
+						_, err := broker.Provision(ctx, instanceID, provisionDetails, false)
+						Expect(err).NotTo(HaveOccurred())
+
+						_, err = broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+						Expect(err).To(MatchError("mount config is larger than 1024 bytes"))
+						expectFailureResponse(err, logger, http.StatusBadRequest, "mount-config-too-large")
+					},
+					Entry("the device name", nfsbroker.WithDeviceName(template.Must(template.New("deviceName").Parse(strings.Repeat("x", 2048))))),
+					Entry("the tls credentials", nfsbroker.WithTLSClientCredentials(nfsbroker.TLSCredentials{Key: strings.Repeat("x", 2048), Inline: true})),
+				)
+			})
+
+			Context("given a mount point owner", func() {
+				It("passes it to the driver in the mount config, not the source", func() {
+					bindDetails.Parameters["chown_uid"] = "1000"
+					bindDetails.Parameters["chown_gid"] = float64(1001)
+					binding, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+					Expect(err).NotTo(HaveOccurred())
+
+					mountConfig := binding.VolumeMounts[0].Device.MountConfig
+					Expect(mountConfig).To(HaveKeyWithValue("chown_uid", "1000"))
+					Expect(mountConfig).To(HaveKeyWithValue("chown_gid", "1001"))
+					Expect(mountConfig["source"]).To(Equal(fmt.Sprintf("nfs://server:/some-share?uid=%s&gid=%s", uid, gid)))
+				})
+
+				It("leaves the mount config alone when absent", func() {
+					binding, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(binding.VolumeMounts[0].Device.MountConfig).NotTo(HaveKey("chown_uid"))
+					Expect(binding.VolumeMounts[0].Device.MountConfig).NotTo(HaveKey("chown_gid"))
+				})
+
+				DescribeTable("rejects an owner that is not numeric",
+					func(key string, value interface{}) {
+						bindDetails.Parameters[key] = value
+						_, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+						Expect(err).To(MatchError(key + " must be a numeric id"))
+					},
+					Entry("a name", "chown_uid", "vcap"),
+					Entry("a negative id", "chown_gid", float64(-1)),
+					Entry("a fractional id", "chown_uid", 1000.5),
+					Entry("a boolean", "chown_gid", true),
+				)
+			})
+
+			Context("given allow_root", func() {
+				DescribeTable("renders it into the source",
+					func(value interface{}, allowRoot bool) {
+						bindDetails.Parameters["allow_root"] = value
+						binding, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+						Expect(err).NotTo(HaveOccurred())
+						if allowRoot {
+							Expect(binding.VolumeMounts[0].Device.MountConfig["source"]).To(Equal(fmt.Sprintf("nfs://server:/some-share?uid=%s&gid=%s&allow_root=true", uid, gid)))
+						} else {
+							Expect(binding.VolumeMounts[0].Device.MountConfig["source"]).NotTo(ContainSubstring("allow_root"))
+						}
+					},
+					Entry("true", true, true),
+					Entry("the string true", "true", true),
+					Entry("false", false, false),
+					Entry("the number 0", float64(0), false),
+				)
+
+				It("squashes root when omitted", func() {
+					binding, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(binding.VolumeMounts[0].Device.MountConfig["source"]).NotTo(ContainSubstring("allow_root"))
+				})
+
+				It("rejects a value that is not a boolean", func() {
+					bindDetails.Parameters["allow_root"] = "yes"
+					_, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+					Expect(err).To(MatchError("allow_root must be a boolean"))
+				})
+			})
+
+			DescribeTable("reports validation failures with a status and code",
+				func(key string, value interface{}, code string) {
+					if value == nil {
+						delete(bindDetails.Parameters, key)
+					} else {
+						bindDetails.Parameters[key] = value
+					}
+					_, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+					expectFailureResponse(err, logger, http.StatusBadRequest, code)
+				},
+				Entry("a missing uid", "uid", nil, "missing-parameters"),
+				Entry("an unknown scope", "scope", "org", "invalid-scope"),
+				Entry("an invalid port", "port", "nfs", "invalid-port"),
+				Entry("an invalid timeo", "timeo", float64(-1), "invalid-timeo"),
+				Entry("an invalid dir_mode", "dir_mode", "0780", "invalid-dir_mode"),
+				Entry("an invalid allow_root", "allow_root", "yes", "invalid-allow-root"),
+				Entry("an unknown version", "version", "2", "invalid-version"),
+			)
+
+			DescribeTable("given parameters of an unexpected type",
+				func(key string, value interface{}) {
+					bindDetails.Parameters[key] = value
+					_, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+					Expect(err).To(Equal(brokerapi.ErrRawParamsInvalid))
+				},
+				Entry("an array uid", "uid", []interface{}{"1000"}),
+				Entry("an object uid", "uid", map[string]interface{}{"uid": "1000"}),
+				Entry("a boolean uid", "uid", true),
+				Entry("a fractional uid", "uid", 1000.5),
+				Entry("an array gid", "gid", []interface{}{"1000"}),
+				Entry("a boolean gid", "gid", false),
+				Entry("a numeric mount", "mount", float64(42)),
+				Entry("an array mount", "mount", []interface{}{"/var/vcap/data/foo"}),
+			)
+
+			It("errors on a null uid", func() {
+				bindDetails.Parameters["uid"] = nil
+				_, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+				Expect(err).To(Equal(brokerapi.ErrRawParamsInvalid))
+			})
+
+			It("accepts a numeric uid and gid", func() {
+				bindDetails.Parameters["uid"] = float64(1234)
+				bindDetails.Parameters["gid"] = float64(5678)
+				binding, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(binding.VolumeMounts[0].Device.MountConfig["source"]).To(Equal("nfs://server:/some-share?uid=1234&gid=5678"))
+			})
+
+			Context("given an id resolver", func() {
+				var fakeResolver *nfsbrokerfakes.FakeIDResolver
+
+				BeforeEach(func() {
+					fakeResolver = &nfsbrokerfakes.FakeIDResolver{}
+					fakeResolver.ResolveIDsReturns("2000", "3000", nil)
+					broker = nfsbroker.New(
+						logger,
+						"service-name", "service-id", "/fake-dir",
+						fakeOs,
+						fakeClock,
+						fakeStore,
+						nfsbroker.WithIDResolver(fakeResolver),
+					)
+
+					provisionDetails := brokerapi.ProvisionDetails{PlanID: "Existing", RawParameters: json.RawMessage(`{"share":"server:/some-share"}`)}
+					_, err := broker.Provision(ctx, instanceID, provisionDetails, false)
+					Expect(err).NotTo(HaveOccurred())
+				})
+
+				It("puts the resolved ids in the source", func() {
+					delete(bindDetails.Parameters, "uid")
+					delete(bindDetails.Parameters, "gid")
+					binding, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(binding.VolumeMounts[0].Device.MountConfig["source"]).To(Equal("nfs://server:/some-share?uid=2000&gid=3000"))
+
+					instance, details := fakeResolver.ResolveIDsArgsForCall(0)
+					Expect(instance.Share).To(Equal("server:/some-share"))
+					Expect(details.AppGUID).To(Equal(bindDetails.AppGUID))
+				})
+
+				It("keeps an id the bind supplies", func() {
+					delete(bindDetails.Parameters, "gid")
+					binding, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(binding.VolumeMounts[0].Device.MountConfig["source"]).To(Equal(fmt.Sprintf("nfs://server:/some-share?uid=%s&gid=3000", uid)))
+				})
+
+				It("is not asked when the bind supplies both", func() {
+					_, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(fakeResolver.ResolveIDsCallCount()).To(Equal(0))
+				})
+
+				It("still requires the ids when it has none", func() {
+					fakeResolver.ResolveIDsReturns("", "", nil)
+					delete(bindDetails.Parameters, "uid")
+					_, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+					Expect(err).To(MatchError(`config requires "uid"`))
+				})
+
+				It("fails the bind when it fails", func() {
+					fakeResolver.ResolveIDsReturns("", "", errors.New("badness"))
+					delete(bindDetails.Parameters, "uid")
+					_, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+					Expect(err).To(MatchError("badness"))
+				})
+			})
+
+			Context("given the uid is not supplied", func() {
+				BeforeEach(func() {
+					bindDetails = brokerapi.BindDetails{AppGUID: "guid", Parameters: map[string]interface{}{
+						nfsbroker.Username: "principal name",
+						nfsbroker.Secret:   "some keytab data",
+						"gid":              gid,
+					},
+					}
+				})
+
+				It("should return with an error", func() {
+					_, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+					Expect(err).To(MatchError(`config requires "uid"`))
+				})
+			})
+
+			Context("given neither uid nor gid is supplied", func() {
+				BeforeEach(func() {
+					bindDetails = brokerapi.BindDetails{AppGUID: "guid", Parameters: map[string]interface{}{
+						nfsbroker.Username: "principal name",
+						nfsbroker.Secret:   "some keytab data",
+					},
+					}
+				})
+
+				It("lists every missing key", func() {
+					_, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+					Expect(err).To(MatchError(`config requires "uid" and "gid"`))
+				})
+			})
+
+			Context("given the gid is not supplied", func() {
+				BeforeEach(func() {
+					bindDetails = brokerapi.BindDetails{AppGUID: "guid", Parameters: map[string]interface{}{
+						nfsbroker.Username: "principal name",
+						nfsbroker.Secret:   "some keytab data",
+						"uid":              uid,
+					},
+					}
+				})
+
+				It("should return with an error", func() {
+					_, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+					Expect(err).To(HaveOccurred())
+				})
+			})
+
+			It("includes empty credentials to prevent CAPI crash", func() {
+				binding, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(binding.Credentials).NotTo(BeNil())
+			})
+
+			It("uses the instance id in the default container path", func() {
+				binding, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(binding.VolumeMounts[0].ContainerDir).To(Equal("/var/vcap/data/some-instance-id"))
+			})
+
+			It("flows container path through", func() {
+				bindDetails.Parameters["mount"] = "/var/vcap/otherdir/something"
+				binding, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(binding.VolumeMounts[0].ContainerDir).To(Equal("/var/vcap/otherdir/something"))
+			})
+
+			Context("given container path patterns", func() {
+				BeforeEach(func() {
+					broker = nfsbroker.New(
+						logger,
+						"service-name", "service-id", "/fake-dir",
+						fakeOs,
+						fakeClock,
+						fakeStore,
+						nfsbroker.WithContainerPathPatterns(regexp.MustCompile(`^/var/vcap/data/`), regexp.MustCompile(`/secrets(/|$)`)),
+					)
+
+					provisionDetails := brokerapi.ProvisionDetails{PlanID: "Existing", RawParameters: json.RawMessage(`{"share":"server:/some-share"}`)}
+					_, err := broker.Provision(ctx, "some-instance-id", provisionDetails, false)
+					Expect(err).NotTo(HaveOccurred())
+				})
+
+				DescribeTable("checks the requested container path",
+					func(containerPath string, allowed bool) {
+						bindDetails.Parameters["mount"] = containerPath
+						binding, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+						if allowed {
+							Expect(err).NotTo(HaveOccurred())
+							Expect(binding.VolumeMounts[0].ContainerDir).To(Equal(containerPath))
+						} else {
+							Expect(err).To(Equal(nfsbroker.ErrContainerPathNotAllowed))
+						}
+					},
+					Entry("an allowed path", "/var/vcap/data/something", true),
+					Entry("a path outside the allowed directory", "/etc/something", false),
+					Entry("a denied path", "/var/vcap/data/secrets", false),
+					Entry("a path climbing out of the allowed directory", "/var/vcap/data/../../../etc", false),
+				)
+
+				It("allows the default container path", func() {
+					binding, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(binding.VolumeMounts[0].ContainerDir).To(Equal("/var/vcap/data/some-instance-id"))
+				})
+			})
+
+			It("uses rw as its default mode", func() {
+				binding, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(binding.VolumeMounts[0].Mode).To(Equal("rw"))
+			})
+
+			It("sets mode to `r` when readonly is true", func() {
+				bindDetails.Parameters["readonly"] = true
+				binding, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(binding.VolumeMounts[0].Mode).To(Equal("r"))
+			})
+
+			It("should write state", func() {
+				_, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+				Expect(err).NotTo(HaveOccurred())
+
+				_, data, _, _ := fakeStore.SaveArgsForCall(fakeStore.SaveCallCount() - 1)
+				Expect(data.InstanceMap[instanceID].PlanID).To(Equal("Existing"))
+			})
+
+			Context("when the binding cannot be saved", func() {
+				var err error
+
+				BeforeEach(func() {
+					fakeStore.SaveReturns(errors.New("badness"))
+				})
+
+				JustBeforeEach(func() {
+					_, err = broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+				})
+
+				It("fails the bind", func() {
+					Expect(err).To(MatchError("badness"))
+				})
+
+				It("does not keep the binding in memory", func() {
+					_, data, _, bindingID := fakeStore.SaveArgsForCall(fakeStore.SaveCallCount() - 1)
+					Expect(bindingID).To(Equal("binding-id"))
+					Expect(data.BindingMap).NotTo(HaveKey("binding-id"))
+
+					err = broker.Unbind(ctx, "some-instance-id", "binding-id", brokerapi.UnbindDetails{})
+					Expect(err).To(Equal(brokerapi.ErrBindingDoesNotExist))
+				})
+			})
+
+			It("errors if mode is not a boolean", func() {
+				bindDetails.Parameters["readonly"] = ""
+				_, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+				Expect(err).To(Equal(brokerapi.ErrRawParamsInvalid))
+			})
+
+			DescribeTable("accepts readonly as older clients send it",
+				func(readonly interface{}, mode string) {
+					bindDetails.Parameters["readonly"] = readonly
+					binding, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(binding.VolumeMounts[0].Mode).To(Equal(mode))
+				},
+				Entry("the string true", "true", "r"),
+				Entry("the string false", "false", "rw"),
+				Entry("the string 1", "1", "r"),
+				Entry("the string 0", "0", "rw"),
+				Entry("the number 1", float64(1), "r"),
+				Entry("the number 0", float64(0), "rw"),
+			)
+
+			DescribeTable("rejects readonly values that are not booleans",
+				func(readonly interface{}) {
+					bindDetails.Parameters["readonly"] = readonly
+					_, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+					Expect(err).To(Equal(brokerapi.ErrRawParamsInvalid))
+				},
+				Entry("a word", "yes"),
+				Entry("a capitalized string", "TRUE"),
+				Entry("another number", float64(2)),
+				Entry("a list", []interface{}{true}),
+			)
+
+			It("fills in the driver name", func() {
+				binding, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(binding.VolumeMounts[0].Driver).To(Equal("nfsv3driver"))
+			})
+
+			It("fills in the volume id", func() {
+				binding, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(binding.VolumeMounts[0].Device.VolumeId).To(ContainSubstring("some-instance-id"))
+			})
+
+			Context("when the binding already exists", func() {
+				BeforeEach(func() {
+					_, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+					Expect(err).NotTo(HaveOccurred())
+				})
+
+				It("doesn't error when binding the same details", func() {
+					_, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+					Expect(err).NotTo(HaveOccurred())
+				})
+
+				It("keeps the creation time when binding the same details", func() {
+					createdAt := fakeClock.Now()
+					fakeClock.Increment(time.Hour)
+
+					_, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+					Expect(err).NotTo(HaveOccurred())
+
+					_, data, _, _ := fakeStore.SaveArgsForCall(fakeStore.SaveCallCount() - 1)
+					Expect(data.BindingMap["binding-id"].CreatedAt).To(Equal(createdAt))
+					Expect(data.BindingMap["binding-id"].UpdatedAt).To(Equal(createdAt.Add(time.Hour)))
+				})
+
+				It("errors when binding different details", func() {
+					bindDetails.AppGUID = "different"
+					_, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+					Expect(err).To(Equal(brokerapi.ErrBindingAlreadyExists))
+				})
+			})
+
+			Context("when another broker has saved the binding", func() {
+				BeforeEach(func() {
+					instance := broker.Dump().InstanceMap[instanceID]
+					fakeStore.RestoreStub = func(_ lager.Logger, state *nfsbroker.DynamicState) error {
+						state.InstanceMap[instanceID] = instance
+						return nil
+					}
+					fakeLocker := &nfsbrokerfakes.FakeLocker{}
+					fakeLocker.TryLockReturns(true, nil)
+					broker = nfsbroker.New(logger, "service-name", "service-id", "/fake-dir", fakeOs, fakeClock, &lockingStore{FakeStore: fakeStore, FakeLocker: fakeLocker})
+					fakeStore.BindingExistsReturns(true, nil)
+				})
+
+				It("errors", func() {
+					_, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+					Expect(err).To(Equal(brokerapi.ErrBindingAlreadyExists))
+					Expect(fakeStore.BindingExistsArgsForCall(0)).To(Equal("binding-id"))
+				})
+			})
+
+			Context("given another binding with the same share", func() {
+				var (
+					err       error
+					bindSpec1 brokerapi.Binding
+				)
+
+				BeforeEach(func() {
+					bindSpec1, err = broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+					Expect(err).NotTo(HaveOccurred())
+				})
+
+				Context("given different options", func() {
+					var (
+						bindSpec2 brokerapi.Binding
+					)
+					BeforeEach(func() {
+						bindDetails.Parameters["uid"] = "3000"
+						bindDetails.Parameters["gid"] = "3000"
+						bindSpec2, err = broker.Bind(ctx, "some-instance-id", "binding-id-2", bindDetails)
+						Expect(err).NotTo(HaveOccurred())
+					})
+
+					It("should issue a volume mount with a different volume ID", func() {
+						Expect(bindSpec1.VolumeMounts[0].Device.VolumeId).NotTo(Equal(bindSpec2.VolumeMounts[0].Device.VolumeId))
+					})
+				})
+			})
+
+			Context("given another app binding with the same options", func() {
+				var (
+					err                  error
+					bindSpec1, bindSpec2 brokerapi.Binding
+					otherBindDetails     brokerapi.BindDetails
+				)
+
+				JustBeforeEach(func() {
+					bindSpec1, err = broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+					Expect(err).NotTo(HaveOccurred())
+
+					otherBindDetails = brokerapi.BindDetails{AppGUID: "other-guid", Parameters: map[string]interface{}{}}
+					for k, v := range bindDetails.Parameters {
+						otherBindDetails.Parameters[k] = v
+					}
+					bindSpec2, err = broker.Bind(ctx, "some-instance-id", "binding-id-2", otherBindDetails)
+					Expect(err).NotTo(HaveOccurred())
+				})
+
+				It("shares the volume across apps by default", func() {
+					Expect(bindSpec1.VolumeMounts[0].Device.VolumeId).To(Equal(bindSpec2.VolumeMounts[0].Device.VolumeId))
+				})
+
+				Context("when the bindings are app scoped", func() {
+					BeforeEach(func() {
+						bindDetails.Parameters["scope"] = "app"
+					})
+
+					It("issues a different volume ID per app", func() {
+						Expect(bindSpec1.VolumeMounts[0].Device.VolumeId).NotTo(Equal(bindSpec2.VolumeMounts[0].Device.VolumeId))
+						Expect(bindSpec1.VolumeMounts[0].Device.MountConfig).To(Equal(bindSpec2.VolumeMounts[0].Device.MountConfig))
+					})
+				})
+
+				Context("when the bindings are space scoped", func() {
+					BeforeEach(func() {
+						bindDetails.Parameters["scope"] = "space"
+					})
+
+					It("shares the volume across apps", func() {
+						Expect(bindSpec1.VolumeMounts[0].Device.VolumeId).To(Equal(bindSpec2.VolumeMounts[0].Device.VolumeId))
+					})
+				})
+			})
+
+			It("errors when the scope is not recognized", func() {
+				bindDetails.Parameters["scope"] = "org"
+				_, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+				Expect(err).To(MatchError(`scope must be one of "space" or "app"`))
+			})
+
+			It("errors when the service instance does not exist", func() {
+				_, err := broker.Bind(ctx, "nonexistent-instance-id", "binding-id", brokerapi.BindDetails{AppGUID: "guid"})
+				Expect(err).To(Equal(brokerapi.ErrInstanceDoesNotExist))
+			})
+
+			It("errors when the app guid is not provided", func() {
+				_, err := broker.Bind(ctx, "some-instance-id", "binding-id", brokerapi.BindDetails{})
+				Expect(err).To(Equal(brokerapi.ErrAppGuidNotProvided))
+			})
+		})
+
+		Context(".Unbind", func() {
+			var (
+				instanceID  string
+				err         error
+				bindDetails brokerapi.BindDetails
+			)
+
+			BeforeEach(func() {
+				instanceID = "some-instance-id"
+
+				configuration := map[string]interface{}{"share": "server:/some-share"}
+
+				buf := &bytes.Buffer{}
+				_ = json.NewEncoder(buf).Encode(configuration)
+				provisionDetails := brokerapi.ProvisionDetails{PlanID: "Existing", RawParameters: json.RawMessage(buf.Bytes())}
+
+				_, err = broker.Provision(ctx, instanceID, provisionDetails, false)
+				Expect(err).NotTo(HaveOccurred())
+
+				bindDetails = brokerapi.BindDetails{AppGUID: "guid", Parameters: map[string]interface{}{nfsbroker.Username: "principal name", nfsbroker.Secret: "some keytab data", "uid": "1000", "gid": "1000"}}
+
+				_, err = broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("unbinds a bound service instance from an app", func() {
+				err = broker.Unbind(ctx, "some-instance-id", "binding-id", brokerapi.UnbindDetails{})
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("fails when trying to unbind a instance that has not been provisioned", func() {
+				err = broker.Unbind(ctx, "some-other-instance-id", "binding-id", brokerapi.UnbindDetails{})
+				Expect(err).To(Equal(brokerapi.ErrInstanceDoesNotExist))
+			})
+
+			It("fails when trying to unbind a binding that has not been bound", func() {
+				err := broker.Unbind(ctx, "some-instance-id", "some-other-binding-id", brokerapi.UnbindDetails{})
+				Expect(err).To(Equal(brokerapi.ErrBindingDoesNotExist))
+			})
+			It("should write state", func() {
+				err := broker.Unbind(ctx, "some-instance-id", "binding-id", brokerapi.UnbindDetails{})
+				Expect(err).NotTo(HaveOccurred())
 
 				_, data, _, _ := fakeStore.SaveArgsForCall(fakeStore.SaveCallCount() - 1)
 				Expect(data.InstanceMap[instanceID].PlanID).To(Equal("Existing"))
 			})
 
-			It("errors if mode is not a boolean", func() {
-				bindDetails.Parameters["readonly"] = ""
-				_, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
-				Expect(err).To(Equal(brokerapi.ErrRawParamsInvalid))
-			})
+			Context("when the unbind cannot be saved", func() {
+				BeforeEach(func() {
+					fakeStore.SaveReturns(errors.New("badness"))
+				})
+
+				It("returns the error and keeps the binding", func() {
+					err := broker.Unbind(ctx, "some-instance-id", "binding-id", brokerapi.UnbindDetails{})
+					Expect(err).To(MatchError("badness"))
+
+					bindingIDs, err := broker.ListBindings("some-instance-id")
+					Expect(err).NotTo(HaveOccurred())
+					Expect(bindingIDs).To(ConsistOf("binding-id"))
+				})
+
+				It("lets the unbind be retried", func() {
+					Expect(broker.Unbind(ctx, "some-instance-id", "binding-id", brokerapi.UnbindDetails{})).NotTo(Succeed())
+
+					fakeStore.SaveReturns(nil)
+					Expect(broker.Unbind(ctx, "some-instance-id", "binding-id", brokerapi.UnbindDetails{})).To(Succeed())
+				})
+			})
+		})
+
+		Context(".RotateCredentials", func() {
+			var original brokerapi.Binding
+
+			BeforeEach(func() {
+				provisionDetails := brokerapi.ProvisionDetails{PlanID: "Existing", RawParameters: json.RawMessage(`{"share":"server:/some-share"}`)}
+				_, err := broker.Provision(ctx, "some-instance-id", provisionDetails, false)
+				Expect(err).NotTo(HaveOccurred())
+
+				bindDetails := brokerapi.BindDetails{AppGUID: "guid", Parameters: map[string]interface{}{
+					nfsbroker.Username: "principal name",
+					nfsbroker.Secret:   "old keytab",
+					"uid":              "1000",
+					"gid":              "1000",
+				}}
+				original, err = broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("changes the credential but keeps the volume id", func() {
+				Expect(original.VolumeMounts[0].Device.MountConfig[nfsbroker.Secret]).To(Equal("old keytab"))
+
+				rotated, err := broker.RotateCredentials("some-instance-id", "binding-id", "new keytab")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(rotated.VolumeMounts[0].Device.MountConfig[nfsbroker.Secret]).To(Equal("new keytab"))
+				Expect(rotated.VolumeMounts[0].Device.MountConfig[nfsbroker.Username]).To(Equal("principal name"))
+				Expect(rotated.VolumeMounts[0].Device.VolumeId).To(Equal(original.VolumeMounts[0].Device.VolumeId))
+			})
+
+			It("records the new credential", func() {
+				_, err := broker.RotateCredentials("some-instance-id", "binding-id", "new keytab")
+				Expect(err).NotTo(HaveOccurred())
+
+				_, data, _, bindingID := fakeStore.SaveArgsForCall(fakeStore.SaveCallCount() - 1)
+				Expect(bindingID).To(Equal("binding-id"))
+				Expect(data.BindingMap["binding-id"].RotatedSecret).To(Equal("new keytab"))
+				Expect(data.BindingMap["binding-id"].Details.Parameters[nfsbroker.Secret]).To(Equal("old keytab"))
+			})
+
+			It("answers a retried original bind with the new credential", func() {
+				_, err := broker.RotateCredentials("some-instance-id", "binding-id", "new keytab")
+				Expect(err).NotTo(HaveOccurred())
+
+				retried, err := broker.Bind(ctx, "some-instance-id", "binding-id", brokerapi.BindDetails{AppGUID: "guid", Parameters: map[string]interface{}{
+					nfsbroker.Username: "principal name",
+					nfsbroker.Secret:   "old keytab",
+					"uid":              "1000",
+					"gid":              "1000",
+				}})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(retried.VolumeMounts[0].Device.MountConfig[nfsbroker.Secret]).To(Equal("new keytab"))
+				Expect(retried.VolumeMounts[0].Device.VolumeId).To(Equal(original.VolumeMounts[0].Device.VolumeId))
+
+				_, data, _, _ := fakeStore.SaveArgsForCall(fakeStore.SaveCallCount() - 1)
+				Expect(data.BindingMap["binding-id"].RotatedSecret).To(Equal("new keytab"))
+			})
+
+			It("updates the binding's timestamp", func() {
+				createdAt := fakeClock.Now()
+				fakeClock.Increment(time.Hour)
+
+				_, err := broker.RotateCredentials("some-instance-id", "binding-id", "new keytab")
+				Expect(err).NotTo(HaveOccurred())
+
+				_, data, _, _ := fakeStore.SaveArgsForCall(fakeStore.SaveCallCount() - 1)
+				Expect(data.BindingMap["binding-id"].CreatedAt).To(Equal(createdAt))
+				Expect(data.BindingMap["binding-id"].UpdatedAt).To(Equal(createdAt.Add(time.Hour)))
+			})
+
+			It("errors when the binding does not exist", func() {
+				_, err := broker.RotateCredentials("some-instance-id", "nonexistent-binding-id", "new keytab")
+				Expect(err).To(Equal(brokerapi.ErrBindingDoesNotExist))
+			})
+
+			Context("when the rotation cannot be saved", func() {
+				BeforeEach(func() {
+					fakeStore.SaveReturns(errors.New("badness"))
+				})
+
+				It("keeps the old credential", func() {
+					_, err := broker.RotateCredentials("some-instance-id", "binding-id", "new keytab")
+					Expect(err).To(MatchError("badness"))
+
+					fakeStore.SaveReturns(nil)
+					_, err = broker.Bind(ctx, "some-instance-id", "binding-id", brokerapi.BindDetails{AppGUID: "guid", Parameters: map[string]interface{}{
+						nfsbroker.Username: "principal name",
+						nfsbroker.Secret:   "old keytab",
+						"uid":              "1000",
+						"gid":              "1000",
+					}})
+					Expect(err).NotTo(HaveOccurred())
+				})
+			})
+		})
+
+		Context(".Dump", func() {
+			BeforeEach(func() {
+				provisionDetails := brokerapi.ProvisionDetails{PlanID: "Existing", RawParameters: json.RawMessage(`{"share":"server:/some-share"}`)}
+				_, err := broker.Provision(ctx, "some-instance-id", provisionDetails, false)
+				Expect(err).NotTo(HaveOccurred())
+
+				bindDetails := brokerapi.BindDetails{AppGUID: "guid", Parameters: map[string]interface{}{"uid": "1000", "gid": "1000"}}
+				_, err = broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("returns every instance and binding", func() {
+				state := broker.Dump()
+				Expect(state.InstanceMap["some-instance-id"].Share).To(Equal("server:/some-share"))
+				Expect(state.BindingMap["binding-id"].InstanceID).To(Equal("some-instance-id"))
+			})
+
+			It("returns a copy that does not affect the broker", func() {
+				state := broker.Dump()
+				delete(state.InstanceMap, "some-instance-id")
+				state.BindingMap["binding-id"].Details.Parameters["uid"] = "0"
+				state.BindingMap["other-binding-id"] = nfsbroker.ServiceBinding{InstanceID: "some-instance-id"}
+
+				again := broker.Dump()
+				Expect(again.InstanceMap).To(HaveKey("some-instance-id"))
+				Expect(again.BindingMap["binding-id"].Details.Parameters["uid"]).To(Equal("1000"))
+				Expect(again.BindingMap).NotTo(HaveKey("other-binding-id"))
+			})
+		})
+
+		Context(".ExportSnapshot", func() {
+			BeforeEach(func() {
+				provisionDetails := brokerapi.ProvisionDetails{PlanID: "Existing", RawParameters: json.RawMessage(`{"share":"server:/some-share","bind_defaults":{"timeo":600}}`)}
+				_, err := broker.Provision(ctx, "some-instance-id", provisionDetails, false)
+				Expect(err).NotTo(HaveOccurred())
+
+				bindDetails := brokerapi.BindDetails{AppGUID: "guid", Parameters: map[string]interface{}{"uid": "1000", "gid": "1000"}}
+				_, err = broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("exports a snapshot the file store restores into an equivalent state", func() {
+				snapshot, err := broker.ExportSnapshot()
+				Expect(err).NotTo(HaveOccurred())
+
+				fakeIoutil := &ioutil_fake.FakeIoutil{}
+				fakeIoutil.ReadFileReturns(snapshot, nil)
+				state := nfsbroker.DynamicState{InstanceMap: map[string]nfsbroker.ServiceInstance{}, BindingMap: map[string]nfsbroker.ServiceBinding{}}
+				Expect(nfsbroker.NewFileStore("/tmp/snapshot.json", fakeIoutil).Restore(logger, &state)).To(Succeed())
+
+				Expect(state).To(Equal(broker.Dump()))
+			})
+		})
+
+		Context(".ImportSnapshot", func() {
+			BeforeEach(func() {
+				provisionDetails := brokerapi.ProvisionDetails{PlanID: "Existing", RawParameters: json.RawMessage(`{"share":"server:/some-share"}`)}
+				_, err := broker.Provision(ctx, "some-instance-id", provisionDetails, false)
+				Expect(err).NotTo(HaveOccurred())
+
+				bindDetails := brokerapi.BindDetails{AppGUID: "guid", Parameters: map[string]interface{}{"uid": "1000", "gid": "1000"}}
+				_, err = broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			Context("when merging", func() {
+				It("adds the snapshot's records to the current ones", func() {
+					snapshot := []byte(`{"InstanceMap":{"other-instance-id":{"Share":"server:/other-share"}},"BindingMap":{"other-binding-id":{"instance_id":"other-instance-id","details":{"app_guid":"guid"}}}}`)
+					Expect(broker.ImportSnapshot(snapshot, nfsbroker.SnapshotMerge)).To(Succeed())
+
+					state := broker.Dump()
+					Expect(state.InstanceMap).To(HaveKey("some-instance-id"))
+					Expect(state.InstanceMap).To(HaveKey("other-instance-id"))
+					Expect(state.BindingMap).To(HaveKey("binding-id"))
+					Expect(state.BindingMap).To(HaveKey("other-binding-id"))
+					Expect(fakeStore.SaveAllCallCount()).To(Equal(1))
+				})
+
+				It("keeps current records that are newer than the snapshot's", func() {
+					snapshot := []byte(`{"InstanceMap":{"some-instance-id":{"Share":"server:/old-share","updated_at":"2017-01-01T00:00:00Z"}},"BindingMap":{}}`)
+					Expect(broker.ImportSnapshot(snapshot, nfsbroker.SnapshotMerge)).To(Succeed())
+					Expect(broker.Dump().InstanceMap["some-instance-id"].Share).To(Equal("server:/some-share"))
+				})
+
+				It("takes snapshot records that are newer than the current ones", func() {
+					snapshot := []byte(`{"InstanceMap":{"some-instance-id":{"Share":"server:/new-share","updated_at":"2018-01-01T00:00:00Z"}},"BindingMap":{}}`)
+					Expect(broker.ImportSnapshot(snapshot, nfsbroker.SnapshotMerge)).To(Succeed())
+					Expect(broker.Dump().InstanceMap["some-instance-id"].Share).To(Equal("server:/new-share"))
+				})
+			})
+
+			Context("when replacing", func() {
+				It("discards the current records and removes them from the store", func() {
+					saves := fakeStore.SaveCallCount()
+					snapshot := []byte(`{"InstanceMap":{"other-instance-id":{"Share":"server:/other-share"}},"BindingMap":{}}`)
+					Expect(broker.ImportSnapshot(snapshot, nfsbroker.SnapshotReplace)).To(Succeed())
+
+					state := broker.Dump()
+					Expect(state.InstanceMap).To(HaveLen(1))
+					Expect(state.InstanceMap).To(HaveKey("other-instance-id"))
+					Expect(state.BindingMap).To(BeEmpty())
+
+					Expect(fakeStore.SaveCallCount()).To(Equal(saves))
+					Expect(fakeStore.SaveAllCallCount()).To(Equal(1))
+					_, saved := fakeStore.SaveAllArgsForCall(0)
+					Expect(saved.InstanceMap).NotTo(HaveKey("some-instance-id"))
+					Expect(saved.BindingMap).NotTo(HaveKey("binding-id"))
+				})
+			})
+
+			It("rejects a snapshot that is not valid json", func() {
+				Expect(broker.ImportSnapshot([]byte(`{"InstanceMap":`), nfsbroker.SnapshotReplace)).NotTo(Succeed())
+				Expect(broker.Dump().InstanceMap).To(HaveKey("some-instance-id"))
+			})
+
+			It("rejects a snapshot whose bindings refer to unknown instances", func() {
+				snapshot := []byte(`{"InstanceMap":{},"BindingMap":{"other-binding-id":{"instance_id":"missing-instance-id","details":{"app_guid":"guid"}}}}`)
+				err := broker.ImportSnapshot(snapshot, nfsbroker.SnapshotMerge)
+				Expect(err).To(MatchError("invalid snapshot: binding other-binding-id refers to unknown instance missing-instance-id"))
+				Expect(broker.Dump().BindingMap).NotTo(HaveKey("other-binding-id"))
+			})
+
+			It("rejects an unknown mode", func() {
+				Expect(broker.ImportSnapshot([]byte(`{}`), "upsert")).To(MatchError(`unknown snapshot import mode "upsert"`))
+			})
+
+			Context("when the state cannot be saved", func() {
+				BeforeEach(func() {
+					fakeStore.SaveAllReturns(errors.New("badness"))
+				})
+
+				It("leaves the broker state unchanged", func() {
+					snapshot := []byte(`{"InstanceMap":{"other-instance-id":{"Share":"server:/other-share"}},"BindingMap":{}}`)
+					Expect(broker.ImportSnapshot(snapshot, nfsbroker.SnapshotReplace)).To(MatchError("badness"))
+
+					state := broker.Dump()
+					Expect(state.InstanceMap).To(HaveKey("some-instance-id"))
+					Expect(state.InstanceMap).NotTo(HaveKey("other-instance-id"))
+				})
+			})
+		})
+
+		Context(".ReapOlderThan", func() {
+			var (
+				instanceIDs, bindingIDs []string
+				err                     error
+			)
+
+			BeforeEach(func() {
+				old := fakeClock.Now()
+				recent := old.Add(23 * time.Hour)
+				fakeStore.RestoreStub = func(logger lager.Logger, state *nfsbroker.DynamicState) error {
+					state.InstanceMap["healthy-instance-id"] = nfsbroker.ServiceInstance{Share: "server:/some-share", UpdatedAt: old}
+					state.InstanceMap["old-broken-instance-id"] = nfsbroker.ServiceInstance{UpdatedAt: old}
+					state.InstanceMap["new-broken-instance-id"] = nfsbroker.ServiceInstance{UpdatedAt: recent}
+					state.InstanceMap["legacy-broken-instance-id"] = nfsbroker.ServiceInstance{}
+					state.BindingMap["healthy-binding-id"] = nfsbroker.ServiceBinding{InstanceID: "healthy-instance-id", UpdatedAt: old}
+					state.BindingMap["old-orphan-binding-id"] = nfsbroker.ServiceBinding{InstanceID: "deleted-instance-id", UpdatedAt: old}
+					state.BindingMap["new-orphan-binding-id"] = nfsbroker.ServiceBinding{InstanceID: "deleted-instance-id", UpdatedAt: recent}
+					state.BindingMap["old-broken-binding-id"] = nfsbroker.ServiceBinding{InstanceID: "old-broken-instance-id", UpdatedAt: old}
+					state.BindingMap["legacy-binding-id"] = nfsbroker.ServiceBinding{UpdatedAt: old}
+					return nil
+				}
+
+				broker = nfsbroker.New(
+					logger,
+					"service-name", "service-id", "/fake-dir",
+					fakeOs,
+					fakeClock,
+					fakeStore,
+				)
+
+				fakeClock.Increment(48 * time.Hour)
+			})
+
+			JustBeforeEach(func() {
+				instanceIDs, bindingIDs, err = broker.ReapOlderThan(24 * time.Hour)
+			})
+
+			It("removes only old broken instances and old orphaned bindings", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(instanceIDs).To(Equal([]string{"old-broken-instance-id"}))
+				Expect(bindingIDs).To(Equal([]string{"old-broken-binding-id", "old-orphan-binding-id"}))
+
+				state := broker.Dump()
+				Expect(state.InstanceMap).To(HaveLen(3))
+				Expect(state.InstanceMap).NotTo(HaveKey("old-broken-instance-id"))
+				Expect(state.BindingMap).To(HaveLen(3))
+				Expect(state.BindingMap).To(HaveKey("healthy-binding-id"))
+				Expect(state.BindingMap).To(HaveKey("new-orphan-binding-id"))
+				Expect(state.BindingMap).To(HaveKey("legacy-binding-id"))
+			})
+
+			It("saves each removal", func() {
+				Expect(fakeStore.SaveCallCount()).To(Equal(3))
+				_, _, instanceID, _ := fakeStore.SaveArgsForCall(0)
+				Expect(instanceID).To(Equal("old-broken-instance-id"))
+				_, _, _, bindingID := fakeStore.SaveArgsForCall(2)
+				Expect(bindingID).To(Equal("old-orphan-binding-id"))
+			})
+
+			Context("when a removal cannot be saved", func() {
+				BeforeEach(func() {
+					fakeStore.SaveReturns(errors.New("badness"))
+				})
+
+				It("keeps the record and stops", func() {
+					Expect(err).To(MatchError("badness"))
+					Expect(instanceIDs).To(BeEmpty())
+					Expect(broker.Dump().InstanceMap).To(HaveKey("old-broken-instance-id"))
+				})
+			})
+		})
+
+		Context(".ListBindings", func() {
+			BeforeEach(func() {
+				configuration := map[string]interface{}{"share": "server:/some-share"}
+
+				buf := &bytes.Buffer{}
+				_ = json.NewEncoder(buf).Encode(configuration)
+				provisionDetails := brokerapi.ProvisionDetails{PlanID: "Existing", RawParameters: json.RawMessage(buf.Bytes())}
+
+				_, err := broker.Provision(ctx, "instance-1", provisionDetails, false)
+				Expect(err).NotTo(HaveOccurred())
+				_, err = broker.Provision(ctx, "instance-2", provisionDetails, false)
+				Expect(err).NotTo(HaveOccurred())
+				_, err = broker.Provision(ctx, "instance-3", provisionDetails, false)
+				Expect(err).NotTo(HaveOccurred())
+
+				bindDetails := brokerapi.BindDetails{AppGUID: "guid", Parameters: map[string]interface{}{"uid": "1000", "gid": "1000"}}
+
+				_, err = broker.Bind(ctx, "instance-1", "binding-b", bindDetails)
+				Expect(err).NotTo(HaveOccurred())
+				_, err = broker.Bind(ctx, "instance-2", "binding-c", bindDetails)
+				Expect(err).NotTo(HaveOccurred())
+				_, err = broker.Bind(ctx, "instance-1", "binding-a", bindDetails)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("lists the bindings of each instance", func() {
+				bindingIDs, err := broker.ListBindings("instance-1")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(bindingIDs).To(Equal([]string{"binding-a", "binding-b"}))
+
+				bindingIDs, err = broker.ListBindings("instance-2")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(bindingIDs).To(Equal([]string{"binding-c"}))
+			})
+
+			It("returns an empty list for an instance without bindings", func() {
+				bindingIDs, err := broker.ListBindings("instance-3")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(bindingIDs).To(BeEmpty())
+			})
+
+			It("no longer lists a binding once unbound", func() {
+				err := broker.Unbind(ctx, "instance-1", "binding-a", brokerapi.UnbindDetails{})
+				Expect(err).NotTo(HaveOccurred())
+
+				bindingIDs, err := broker.ListBindings("instance-1")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(bindingIDs).To(Equal([]string{"binding-b"}))
+			})
+
+			It("errors when the instance does not exist", func() {
+				_, err := broker.ListBindings("nonexistent-instance-id")
+				Expect(err).To(Equal(brokerapi.ErrInstanceDoesNotExist))
+			})
+		})
+	})
+
+	Context("when configured with plans", func() {
+		var bindDetails brokerapi.BindDetails
+
+		BeforeEach(func() {
+			broker = nfsbroker.New(
+				logger,
+				"service-name", "service-id", "/fake-dir",
+				fakeOs,
+				fakeClock,
+				fakeStore,
+				nfsbroker.WithPlans([]nfsbroker.Plan{
+					{ID: "Existing", Name: "Existing", Description: "A preexisting filesystem"},
+					{ID: "ReadOnly", Name: "ReadOnly", Description: "A preexisting filesystem, read-only", DefaultReadonly: true},
+				}),
+			)
+
+			provisionDetails := brokerapi.ProvisionDetails{PlanID: "ReadOnly", RawParameters: json.RawMessage(`{"share":"server:/some-share"}`)}
+			_, err := broker.Provision(ctx, "some-instance-id", provisionDetails, false)
+			Expect(err).NotTo(HaveOccurred())
+
+			bindDetails = brokerapi.BindDetails{AppGUID: "guid", Parameters: map[string]interface{}{"uid": "1000", "gid": "1000"}}
+		})
+
+		It("advertises the plans and the read-only default", func() {
+			plans := broker.Services(ctx)[0].Plans
+			Expect(plans).To(HaveLen(2))
+			Expect(plans[0].ID).To(Equal("Existing"))
+			Expect(plans[0].Metadata).To(BeNil())
+			Expect(plans[1].ID).To(Equal("ReadOnly"))
+			Expect(plans[1].Metadata.Bullets).To(ConsistOf("Mounted read-only unless the binding sets readonly to false"))
+		})
+
+		It("mounts read-only when the binding does not say", func() {
+			binding, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(binding.VolumeMounts[0].Mode).To(Equal("r"))
+		})
+
+		It("lets the binding ask for read-write", func() {
+			bindDetails.Parameters["readonly"] = false
+			binding, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(binding.VolumeMounts[0].Mode).To(Equal("rw"))
+		})
+
+		It("provisions an offered plan", func() {
+			provisionDetails := brokerapi.ProvisionDetails{PlanID: "Existing", RawParameters: json.RawMessage(`{"share":"server:/other-share"}`)}
+			_, err := broker.Provision(ctx, "other-instance-id", provisionDetails, false)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(broker.Dump().InstanceMap["other-instance-id"].PlanID).To(Equal("Existing"))
+		})
+
+		It("rejects a plan it does not offer", func() {
+			provisionDetails := brokerapi.ProvisionDetails{PlanID: "Exisitng", RawParameters: json.RawMessage(`{"share":"server:/other-share"}`)}
+			_, err := broker.Provision(ctx, "other-instance-id", provisionDetails, false)
+			Expect(err).To(MatchError(`plan "Exisitng" is not offered by this broker`))
+			expectFailureResponse(err, logger, http.StatusBadRequest, "unknown-plan")
+			Expect(broker.Dump().InstanceMap).NotTo(HaveKey("other-instance-id"))
+		})
+
+		It("rejects a request without a plan", func() {
+			provisionDetails := brokerapi.ProvisionDetails{RawParameters: json.RawMessage(`{"share":"server:/other-share"}`)}
+			_, err := broker.Provision(ctx, "other-instance-id", provisionDetails, false)
+			Expect(err).To(MatchError(`plan "" is not offered by this broker`))
+		})
+
+		It("advertises plans as free by default", func() {
+			plans := broker.Services(ctx)[0].Plans
+			Expect(*plans[0].Free).To(BeTrue())
+			Expect(*plans[1].Free).To(BeTrue())
+		})
+
+		Context("given a paid plan", func() {
+			BeforeEach(func() {
+				free := false
+				broker = nfsbroker.New(
+					logger,
+					"service-name", "service-id", "/fake-dir",
+					fakeOs,
+					fakeClock,
+					fakeStore,
+					nfsbroker.WithPlans([]nfsbroker.Plan{
+						{ID: "Existing", Name: "Existing", Description: "A preexisting filesystem"},
+						{ID: "Premium", Name: "Premium", Description: "A preexisting filesystem, supported", Free: &free, Costs: []brokerapi.ServicePlanCost{
+							{Amount: map[string]float64{"usd": 9.99}, Unit: "MONTHLY"},
+						}},
+					}),
+				)
+			})
+
+			It("serializes the free flag and costs into the catalog", func() {
+				plans, err := json.Marshal(broker.Services(ctx)[0].Plans)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(plans).To(MatchJSON(`[
+					{"id": "Existing", "name": "Existing", "description": "A preexisting filesystem", "free": true},
+					{"id": "Premium", "name": "Premium", "description": "A preexisting filesystem, supported", "free": false,
+					 "metadata": {"costs": [{"amount": {"usd": 9.99}, "unit": "MONTHLY"}]}}
+				]`))
+			})
+		})
+
+		Context("given a plan with an access mode", func() {
+			BeforeEach(func() {
+				broker = nfsbroker.New(
+					logger,
+					"service-name", "service-id", "/fake-dir",
+					fakeOs,
+					fakeClock,
+					fakeStore,
+					nfsbroker.WithPlans([]nfsbroker.Plan{
+						{ID: "Single", Name: "Single", Description: "A preexisting filesystem with one writer", AccessMode: nfsbroker.AccessModeReadWriteOnce},
+					}),
+				)
+
+				provisionDetails := brokerapi.ProvisionDetails{PlanID: "Single", RawParameters: json.RawMessage(`{"share":"server:/some-share"}`)}
+				_, err := broker.Provision(ctx, "single-instance-id", provisionDetails, false)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("uses the plan's access mode when the bind does not say", func() {
+				binding, err := broker.Bind(ctx, "single-instance-id", "binding-id", bindDetails)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(binding.VolumeMounts[0].Device.MountConfig["source"]).To(Equal("nfs://server:/some-share?uid=1000&gid=1000&nolock=true"))
+			})
+
+			It("lets the bind override it", func() {
+				bindDetails.Parameters["access_mode"] = "read-write-many"
+				binding, err := broker.Bind(ctx, "single-instance-id", "binding-id", bindDetails)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(binding.VolumeMounts[0].Device.MountConfig["source"]).To(Equal("nfs://server:/some-share?uid=1000&gid=1000"))
+			})
+		})
+
+		Context("given a plan requiring bind parameters", func() {
+			BeforeEach(func() {
+				broker = nfsbroker.New(
+					logger,
+					"service-name", "service-id", "/fake-dir",
+					fakeOs,
+					fakeClock,
+					fakeStore,
+					nfsbroker.WithPlans([]nfsbroker.Plan{
+						{ID: "Strict", Name: "Strict", Description: "A preexisting filesystem", RequiredBindParameters: []string{"uid", "gid", "mount"}},
+					}),
+				)
+
+				provisionDetails := brokerapi.ProvisionDetails{PlanID: "Strict", RawParameters: json.RawMessage(`{"share":"server:/some-share","bind_defaults":{"mount":"/data"}}`)}
+				_, err := broker.Provision(ctx, "strict-instance-id", provisionDetails, false)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("binds when the bind supplies them", func() {
+				bindDetails.Parameters["mount"] = "/var/data"
+				binding, err := broker.Bind(ctx, "strict-instance-id", "binding-id", bindDetails)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(binding.VolumeMounts[0].ContainerDir).To(Equal("/var/data"))
+			})
+
+			It("names the missing ones, even when an instance default would supply them", func() {
+				delete(bindDetails.Parameters, "gid")
+				_, err := broker.Bind(ctx, "strict-instance-id", "binding-id", bindDetails)
+				Expect(err).To(MatchError("plan Strict requires bind parameters: gid, mount"))
+				expectFailureResponse(err, logger, http.StatusBadRequest, "missing-required-parameters")
+			})
+		})
+
+		Context("given a default plan", func() {
+			BeforeEach(func() {
+				broker = nfsbroker.New(
+					logger,
+					"service-name", "service-id", "/fake-dir",
+					fakeOs,
+					fakeClock,
+					fakeStore,
+					nfsbroker.WithPlans([]nfsbroker.Plan{
+						{ID: "Existing", Name: "Existing", Description: "A preexisting filesystem"},
+						{ID: "ReadOnly", Name: "ReadOnly", Description: "A preexisting filesystem, read-only", DefaultReadonly: true},
+					}),
+					nfsbroker.WithDefaultPlan("ReadOnly"),
+				)
+			})
+
+			It("provisions the default plan when the request names none", func() {
+				provisionDetails := brokerapi.ProvisionDetails{RawParameters: json.RawMessage(`{"share":"server:/other-share"}`)}
+				_, err := broker.Provision(ctx, "other-instance-id", provisionDetails, false)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(broker.Dump().InstanceMap["other-instance-id"].PlanID).To(Equal("ReadOnly"))
+			})
+
+			It("still rejects a plan it does not offer", func() {
+				provisionDetails := brokerapi.ProvisionDetails{PlanID: "Exisitng", RawParameters: json.RawMessage(`{"share":"server:/other-share"}`)}
+				_, err := broker.Provision(ctx, "other-instance-id", provisionDetails, false)
+				Expect(err).To(MatchError(`plan "Exisitng" is not offered by this broker`))
+			})
+		})
+	})
+
+	Context("when configured with a syslog drain url", func() {
+		BeforeEach(func() {
+			tmpl := template.Must(template.New("syslogDrainURL").Parse("syslog://logs.example.com/{{.SpaceGUID}}/{{.AppGUID}}/{{.BindingID}}"))
+			broker = nfsbroker.New(
+				logger,
+				"service-name", "service-id", "/fake-dir",
+				fakeOs,
+				fakeClock,
+				fakeStore,
+				nfsbroker.WithSyslogDrainURL(tmpl),
+			)
+
+			provisionDetails := brokerapi.ProvisionDetails{PlanID: "Existing", SpaceGUID: "space-guid", RawParameters: json.RawMessage(`{"share":"server:/some-share"}`)}
+			_, err := broker.Provision(ctx, "some-instance-id", provisionDetails, false)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("requires the syslog_drain permission", func() {
+			result := broker.Services(ctx)[0]
+			Expect(result.Requires).To(ContainElement(brokerapi.RequiredPermission("volume_mount")))
+			Expect(result.Requires).To(ContainElement(brokerapi.RequiredPermission("syslog_drain")))
+		})
+
+		It("returns the rendered syslog drain url with the volume mount", func() {
+			bindDetails := brokerapi.BindDetails{AppGUID: "app-guid", Parameters: map[string]interface{}{"uid": "1234", "gid": "5678"}}
+			binding, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(binding.SyslogDrainURL).To(Equal("syslog://logs.example.com/space-guid/app-guid/binding-id"))
+			Expect(binding.VolumeMounts).To(HaveLen(1))
+		})
+	})
+
+	Context("when configured with a device name", func() {
+		var bindDetails brokerapi.BindDetails
+
+		BeforeEach(func() {
+			tmpl := template.Must(template.New("deviceName").Parse("nfs-{{.BindingID}}"))
+			broker = nfsbroker.New(
+				logger,
+				"service-name", "service-id", "/fake-dir",
+				fakeOs,
+				fakeClock,
+				fakeStore,
+				nfsbroker.WithDeviceName(tmpl),
+			)
+
+			provisionDetails := brokerapi.ProvisionDetails{PlanID: "Existing", RawParameters: json.RawMessage(`{"share":"server:/some-share"}`)}
+			_, err := broker.Provision(ctx, "some-instance-id", provisionDetails, false)
+			Expect(err).NotTo(HaveOccurred())
+
+			bindDetails = brokerapi.BindDetails{AppGUID: "app-guid", Parameters: map[string]interface{}{"uid": "1234", "gid": "5678"}}
+		})
+
+		It("gives the mount config the rendered device name", func() {
+			binding, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(binding.VolumeMounts[0].Device.MountConfig["device_name"]).To(Equal("nfs-binding-id"))
+		})
+
+		It("gives the same name when the binding is bound again", func() {
+			_, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(broker.Unbind(ctx, "some-instance-id", "binding-id", brokerapi.UnbindDetails{})).To(Succeed())
+
+			binding, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(binding.VolumeMounts[0].Device.MountConfig["device_name"]).To(Equal("nfs-binding-id"))
+		})
+
+		It("leaves the name out of the volume id", func() {
+			binding, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+			Expect(err).NotTo(HaveOccurred())
+			other, err := broker.Bind(ctx, "some-instance-id", "other-binding-id", bindDetails)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(other.VolumeMounts[0].Device.MountConfig["device_name"]).To(Equal("nfs-other-binding-id"))
+			Expect(other.VolumeMounts[0].Device.VolumeId).To(Equal(binding.VolumeMounts[0].Device.VolumeId))
+		})
+	})
+
+	Context("when configured with a bind timeout", func() {
+		var (
+			fakeLockingStore *lockingStore
+			storeLocked      bool
+		)
+
+		BeforeEach(func() {
+			// a shared store is reloaded under the lock, so it has to keep what is saved
+			memoryStore := nfsbroker.NewInMemoryStore()
+			fakeStore.SaveStub = memoryStore.Save
+			fakeStore.RestoreStub = memoryStore.Restore
+
+			storeLocked = false
+			fakeLockingStore = &lockingStore{FakeStore: fakeStore, FakeLocker: &nfsbrokerfakes.FakeLocker{}}
+			fakeLockingStore.TryLockStub = func(lager.Logger, string, time.Time, time.Duration) (bool, error) {
+				return !storeLocked, nil
+			}
+
+			broker = nfsbroker.New(
+				logger,
+				"service-name", "service-id", "/fake-dir",
+				fakeOs,
+				fakeClock,
+				fakeLockingStore,
+				nfsbroker.WithBindTimeout(50*time.Millisecond),
+			)
+
+			provisionDetails := brokerapi.ProvisionDetails{PlanID: "Existing", RawParameters: json.RawMessage(`{"share":"server:/some-share"}`)}
+			_, err := broker.Provision(ctx, "some-instance-id", provisionDetails, false)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("binds when the lock is available", func() {
+			bindDetails := brokerapi.BindDetails{AppGUID: "guid", Parameters: map[string]interface{}{"uid": "1234", "gid": "5678"}}
+			_, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		Context("when acquiring the lock is slow", func() {
+			BeforeEach(func() {
+				storeLocked = true
+			})
+
+			It("times out without recording the binding", func() {
+				bindDetails := brokerapi.BindDetails{AppGUID: "guid", Parameters: map[string]interface{}{"uid": "1234", "gid": "5678"}}
+				_, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+				Expect(err).To(Equal(context.DeadlineExceeded))
+
+				Expect(fakeStore.SaveCallCount()).To(Equal(1))
+			})
+		})
+	})
+
+	Context("when the store is shared with another broker", func() {
+		var (
+			sharedStore   nfsbroker.Store
+			fakeLocker    *nfsbrokerfakes.FakeLocker
+			otherBroker   *nfsbroker.Broker
+			bindDetails   brokerapi.BindDetails
+			provisionOpts brokerapi.ProvisionDetails
+		)
+
+		BeforeEach(func() {
+			sharedStore = nfsbroker.NewInMemoryStore()
+			fakeLocker = &nfsbrokerfakes.FakeLocker{}
+			fakeLocker.TryLockReturns(true, nil)
+			fakeStore.SaveStub = sharedStore.Save
+			fakeStore.RestoreStub = sharedStore.Restore
+			fakeStore.SaveAllStub = sharedStore.SaveAll
+
+			broker = nfsbroker.New(logger, "service-name", "service-id", "/fake-dir", fakeOs, fakeClock, &lockingStore{FakeStore: fakeStore, FakeLocker: fakeLocker})
+			otherBroker = nfsbroker.New(logger, "service-name", "service-id", "/fake-dir", fakeOs, fakeClock, &lockingStore{FakeStore: fakeStore, FakeLocker: fakeLocker})
+
+			provisionOpts = brokerapi.ProvisionDetails{PlanID: "Existing", RawParameters: json.RawMessage(`{"share":"server:/some-share"}`)}
+			bindDetails = brokerapi.BindDetails{AppGUID: "guid", Parameters: map[string]interface{}{"uid": "1234", "gid": "5678"}}
+
+			_, err := otherBroker.Provision(ctx, "some-instance-id", provisionOpts, false)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("binds an instance the other broker provisioned", func() {
+			_, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+			Expect(err).NotTo(HaveOccurred())
+			state, err := otherBroker.DumpReloaded()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(state.BindingMap).To(HaveKey("binding-id"))
+		})
+
+		It("deprovisions an instance the other broker provisioned", func() {
+			_, err := broker.Deprovision(ctx, "some-instance-id", brokerapi.DeprovisionDetails{}, false)
+			Expect(err).NotTo(HaveOccurred())
+			state, err := otherBroker.DumpReloaded()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(state.InstanceMap).NotTo(HaveKey("some-instance-id"))
+		})
+
+		It("keeps the other broker's records when saving its own", func() {
+			_, err := broker.Provision(ctx, "other-instance-id", brokerapi.ProvisionDetails{PlanID: "Existing", RawParameters: json.RawMessage(`{"share":"server:/other-share"}`)}, false)
+			Expect(err).NotTo(HaveOccurred())
+			state, err := otherBroker.DumpReloaded()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(state.InstanceMap).To(HaveKey("some-instance-id"))
+			Expect(state.InstanceMap).To(HaveKey("other-instance-id"))
+		})
+
+		It("dumps what it last held without reading the store", func() {
+			restores := fakeStore.RestoreCallCount()
+			Expect(broker.Dump().InstanceMap).NotTo(HaveKey("some-instance-id"))
+			Expect(fakeStore.RestoreCallCount()).To(Equal(restores))
+		})
+
+		It("fails a reloaded dump when the store cannot be read", func() {
+			fakeStore.RestoreStub = nil
+			fakeStore.RestoreReturns(errors.New("connection refused"))
+
+			_, err := broker.DumpReloaded()
+			Expect(err).To(MatchError("connection refused"))
+		})
+
+		It("releases the store lock after each request", func() {
+			Expect(fakeLocker.ReleaseLockCallCount()).To(Equal(fakeLocker.TryLockCallCount()))
+		})
+
+		Context("when the store lock cannot be taken", func() {
+			BeforeEach(func() {
+				fakeLocker.TryLockReturns(false, errors.New("connection refused"))
+			})
+
+			It("fails the request instead of waiting forever", func() {
+				errs := make(chan error)
+				go func() {
+					_, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+					errs <- err
+				}()
+
+				for i := 1; i < nfsbroker.DefaultLockErrorLimit; i++ {
+					fakeClock.WaitForWatcherAndIncrement(nfsbroker.DefaultLockRetryInterval)
+				}
+				Eventually(errs).Should(Receive(MatchError("connection refused")))
+			})
+		})
+
+		Context("when the state cannot be reloaded", func() {
+			BeforeEach(func() {
+				fakeStore.RestoreStub = nil
+				fakeStore.RestoreReturns(errors.New("connection refused"))
+			})
+
+			It("fails the request and releases the lock", func() {
+				_, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+				Expect(err).To(MatchError("connection refused"))
+				Expect(fakeLocker.ReleaseLockCallCount()).To(Equal(fakeLocker.TryLockCallCount()))
+			})
+		})
+	})
+
+	Context("when configured with a share preflight check", func() {
+		var (
+			listener    net.Listener
+			bindDetails brokerapi.BindDetails
+		)
+
+		BeforeEach(func() {
+			var err error
+			listener, err = net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+
+			broker = nfsbroker.New(
+				logger,
+				"service-name", "service-id", "/fake-dir",
+				fakeOs,
+				fakeClock,
+				fakeStore,
+				nfsbroker.WithSharePreflight(time.Second),
+			)
+
+			provisionDetails := brokerapi.ProvisionDetails{PlanID: "Existing", RawParameters: json.RawMessage(`{"share":"127.0.0.1:/some-share"}`)}
+			_, err = broker.Provision(ctx, "some-instance-id", provisionDetails, false)
+			Expect(err).NotTo(HaveOccurred())
+
+			bindDetails = brokerapi.BindDetails{AppGUID: "guid", Parameters: map[string]interface{}{
+				"uid":  "1234",
+				"gid":  "5678",
+				"port": float64(listener.Addr().(*net.TCPAddr).Port),
+			}}
+		})
+
+		AfterEach(func() {
+			listener.Close()
+		})
+
+		It("binds when the nfs server is listening", func() {
+			_, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		Context("when the nfs server is not listening", func() {
+			BeforeEach(func() {
+				Expect(listener.Close()).To(Succeed())
+			})
+
+			It("fails with ErrShareUnreachable without recording the binding", func() {
+				_, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+				Expect(err).To(Equal(nfsbroker.ErrShareUnreachable))
+				expectFailureResponse(err, logger, http.StatusUnprocessableEntity, "share-unreachable")
+				Expect(fakeStore.SaveCallCount()).To(Equal(1))
+			})
+		})
+
+		Context("when the store is shared with another broker", func() {
+			var (
+				fakeLocker *nfsbrokerfakes.FakeLocker
+				stored     []nfsbroker.ServiceInstance
+			)
+
+			BeforeEach(func() {
+				fakeLocker = &nfsbrokerfakes.FakeLocker{}
+				fakeLocker.TryLockReturns(true, nil)
+
+				// each restore finds the next instance stored, then keeps finding the last
+				stored = []nfsbroker.ServiceInstance{broker.Dump().InstanceMap["some-instance-id"]}
+				fakeStore.RestoreStub = func(logger lager.Logger, state *nfsbroker.DynamicState) error {
+					state.InstanceMap["some-instance-id"] = stored[0]
+					if len(stored) > 1 {
+						stored = stored[1:]
+					}
+					return nil
+				}
+
+				broker = nfsbroker.New(
+					logger,
+					"service-name", "service-id", "/fake-dir",
+					fakeOs,
+					fakeClock,
+					&lockingStore{FakeStore: fakeStore, FakeLocker: fakeLocker},
+					nfsbroker.WithSharePreflight(time.Second),
+				)
+			})
+
+			It("binds when the nfs server is listening", func() {
+				_, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			Context("when the nfs server is not listening", func() {
+				BeforeEach(func() {
+					Expect(listener.Close()).To(Succeed())
+				})
+
+				It("fails without taking the store lock", func() {
+					_, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+					Expect(err).To(Equal(nfsbroker.ErrShareUnreachable))
+					Expect(fakeLocker.TryLockCallCount()).To(Equal(0))
+				})
+			})
+
+			Context("when another broker replaces the instance during the check", func() {
+				BeforeEach(func() {
+					replaced := stored[0]
+					replaced.Share = "127.0.0.1:/other-share"
+					stored = append(stored, replaced)
+				})
+
+				It("fails without binding the share it did not check", func() {
+					_, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+					Expect(err).To(Equal(nfsbroker.ErrInstanceChanged))
+					Expect(fakeStore.SaveCallCount()).To(Equal(1))
+					Expect(fakeLocker.ReleaseLockCallCount()).To(Equal(1))
+				})
+			})
+		})
+	})
+
+	Context("when configured with an org rate limit", func() {
+		provision := func(instanceID, organizationGUID string) error {
+			provisionDetails := brokerapi.ProvisionDetails{PlanID: "Existing", OrganizationGUID: organizationGUID, RawParameters: json.RawMessage(`{"share":"server:/` + instanceID + `"}`)}
+			_, err := broker.Provision(ctx, instanceID, provisionDetails, false)
+			return err
+		}
+
+		BeforeEach(func() {
+			broker = nfsbroker.New(
+				logger,
+				"service-name", "service-id", "/fake-dir",
+				fakeOs,
+				fakeClock,
+				fakeStore,
+				nfsbroker.WithOrgRateLimit(10*time.Second, 2),
+			)
+
+			Expect(provision("instance-1", "org-a")).To(Succeed())
+			Expect(provision("instance-2", "org-a")).To(Succeed())
+		})
+
+		It("refuses requests once the org's bucket is empty", func() {
+			err := provision("instance-3", "org-a")
+			Expect(err).To(MatchError("too many requests for this organization, retry after 10s"))
+			expectFailureResponse(err, logger, http.StatusTooManyRequests, "rate-limited")
+			Expect(broker.Dump().InstanceMap).NotTo(HaveKey("instance-3"))
+		})
+
+		It("counts binds against the instance's org", func() {
+			fakeClock.Increment(10 * time.Second)
+			bindDetails := brokerapi.BindDetails{AppGUID: "guid", Parameters: map[string]interface{}{"uid": "1000", "gid": "1000"}}
+			_, err := broker.Bind(ctx, "instance-1", "binding-id", bindDetails)
+			Expect(err).NotTo(HaveOccurred())
 
-			It("fills in the driver name", func() {
-				binding, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
-				Expect(err).NotTo(HaveOccurred())
+			_, err = broker.Bind(ctx, "instance-1", "other-binding-id", bindDetails)
+			Expect(err).To(MatchError("too many requests for this organization, retry after 10s"))
+		})
 
-				Expect(binding.VolumeMounts[0].Driver).To(Equal("nfsv3driver"))
-			})
+		It("keeps a bucket per org", func() {
+			Expect(provision("instance-3", "org-b")).To(Succeed())
+		})
 
-			It("fills in the volume id", func() {
-				binding, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
-				Expect(err).NotTo(HaveOccurred())
+		It("does not spend a token on a repeated provision", func() {
+			Expect(provision("instance-1", "org-a")).To(Succeed())
+		})
 
-				Expect(binding.VolumeMounts[0].Device.VolumeId).To(ContainSubstring("some-instance-id"))
-			})
+		It("does not spend a token on a repeated bind", func() {
+			fakeClock.Increment(10 * time.Second)
+			bindDetails := brokerapi.BindDetails{AppGUID: "guid", Parameters: map[string]interface{}{"uid": "1000", "gid": "1000"}}
+			_, err := broker.Bind(ctx, "instance-1", "binding-id", bindDetails)
+			Expect(err).NotTo(HaveOccurred())
 
-			Context("when the binding already exists", func() {
-				BeforeEach(func() {
-					_, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
-					Expect(err).NotTo(HaveOccurred())
-				})
+			_, err = broker.Bind(ctx, "instance-1", "binding-id", bindDetails)
+			Expect(err).NotTo(HaveOccurred())
+		})
 
-				It("doesn't error when binding the same details", func() {
-					_, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
-					Expect(err).NotTo(HaveOccurred())
-				})
+		It("does not spend a token on an invalid request", func() {
+			provisionDetails := brokerapi.ProvisionDetails{PlanID: "Existing", OrganizationGUID: "org-b", RawParameters: json.RawMessage(`{}`)}
+			for i := 0; i < 3; i++ {
+				_, err := broker.Provision(ctx, "instance-3", provisionDetails, false)
+				Expect(err).To(MatchError(`config requires a "share" key`))
+			}
 
-				It("errors when binding different details", func() {
-					bindDetails.AppGUID = "different"
-					_, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
-					Expect(err).To(Equal(brokerapi.ErrBindingAlreadyExists))
-				})
-			})
+			Expect(provision("instance-3", "org-b")).To(Succeed())
+			Expect(provision("instance-4", "org-b")).To(Succeed())
+		})
 
-			Context("given another binding with the same share", func() {
-				var (
-					err error
-					bindSpec1 brokerapi.Binding
-				)
+		It("refunds the token of a provision that fails to save", func() {
+			fakeStore.SaveReturns(errors.New("badness"))
+			Expect(provision("instance-3", "org-b")).To(MatchError("badness"))
 
-				BeforeEach(func() {
-					bindSpec1, err = broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
-					Expect(err).NotTo(HaveOccurred())
-				})
+			fakeStore.SaveReturns(nil)
+			Expect(provision("instance-3", "org-b")).To(Succeed())
+			Expect(provision("instance-4", "org-b")).To(Succeed())
+		})
 
-				Context("given different options", func() {
-					var (
-						bindSpec2 brokerapi.Binding
-					)
-					BeforeEach(func() {
-						bindDetails.Parameters["uid"] = "3000"
-						bindDetails.Parameters["gid"] = "3000"
-						bindSpec2, err = broker.Bind(ctx, "some-instance-id", "binding-id-2", bindDetails)
-						Expect(err).NotTo(HaveOccurred())
-					})
+		It("refunds the token of a bind that fails to save", func() {
+			fakeClock.Increment(10 * time.Second)
+			fakeStore.SaveReturns(errors.New("badness"))
+			bindDetails := brokerapi.BindDetails{AppGUID: "guid", Parameters: map[string]interface{}{"uid": "1000", "gid": "1000"}}
+			_, err := broker.Bind(ctx, "instance-1", "binding-id", bindDetails)
+			Expect(err).To(MatchError("badness"))
 
-					It("should issue a volume mount with a different volume ID", func() {
-						Expect(bindSpec1.VolumeMounts[0].Device.VolumeId).NotTo(Equal(bindSpec2.VolumeMounts[0].Device.VolumeId))
-					})
-				})
+			fakeStore.SaveReturns(nil)
+			_, err = broker.Bind(ctx, "instance-1", "binding-id", bindDetails)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("limits an org again after dropping its refilled bucket", func() {
+			fakeClock.Increment(time.Minute)
+			Expect(provision("instance-3", "org-b")).To(Succeed())
+
+			Expect(provision("instance-4", "org-a")).To(Succeed())
+			Expect(provision("instance-5", "org-a")).To(Succeed())
+			Expect(provision("instance-6", "org-a")).NotTo(Succeed())
+		})
+
+		It("refills the bucket over time", func() {
+			fakeClock.Increment(5 * time.Second)
+			Expect(provision("instance-3", "org-a")).To(MatchError("too many requests for this organization, retry after 5s"))
+
+			fakeClock.Increment(5 * time.Second)
+			Expect(provision("instance-3", "org-a")).To(Succeed())
+			Expect(provision("instance-4", "org-a")).NotTo(Succeed())
+
+			fakeClock.Increment(time.Minute)
+			Expect(provision("instance-4", "org-a")).To(Succeed())
+			Expect(provision("instance-5", "org-a")).To(Succeed())
+			Expect(provision("instance-6", "org-a")).NotTo(Succeed())
+		})
+	})
+
+	It("ignores an org rate limit without any burst", func() {
+		broker = nfsbroker.New(
+			logger,
+			"service-name", "service-id", "/fake-dir",
+			fakeOs,
+			fakeClock,
+			fakeStore,
+			nfsbroker.WithOrgRateLimit(10*time.Second, 0),
+		)
+
+		provisionDetails := brokerapi.ProvisionDetails{PlanID: "Existing", OrganizationGUID: "org-a", RawParameters: json.RawMessage(`{"share":"server:/some-share"}`)}
+		_, err := broker.Provision(ctx, "instance-1", provisionDetails, false)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(broker.ActiveConfig().OrgRateInterval).To(BeZero())
+	})
+
+	Context("when a request carries a request identity", func() {
+		var testLogger *lagertest.TestLogger
+
+		BeforeEach(func() {
+			testLogger = lagertest.NewTestLogger("test-broker")
+			broker = nfsbroker.New(
+				testLogger,
+				"service-name", "service-id", "/fake-dir",
+				fakeOs,
+				fakeClock,
+				fakeStore,
+			)
+			ctx = nfsbroker.WithRequestIdentity(ctx, "some-request-id")
+		})
+
+		It("includes it in every log of the request", func() {
+			provisionDetails := brokerapi.ProvisionDetails{PlanID: "Existing", RawParameters: json.RawMessage(`{"share":"server:/some-share"}`)}
+			_, err := broker.Provision(ctx, "some-instance-id", provisionDetails, false)
+			Expect(err).NotTo(HaveOccurred())
+
+			bindDetails := brokerapi.BindDetails{AppGUID: "guid", Parameters: map[string]interface{}{"uid": "1000", "gid": "1000"}}
+			_, err = broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+			Expect(err).NotTo(HaveOccurred())
+
+			var requestLogs int
+			for _, log := range testLogger.Logs() {
+				if strings.HasPrefix(log.Message, "test-broker.provision.") || strings.HasPrefix(log.Message, "test-broker.bind.") {
+					requestLogs++
+					Expect(log.Data).To(HaveKeyWithValue("requestIdentity", "some-request-id"), log.Message)
+				}
+			}
+			Expect(requestLogs).NotTo(BeZero())
+		})
+	})
+
+	Context("when configured with a provision preflight check", func() {
+		var (
+			listener         net.Listener
+			provisionDetails brokerapi.ProvisionDetails
+		)
+
+		BeforeEach(func() {
+			var err error
+			listener, err = net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+
+			broker = nfsbroker.New(
+				logger,
+				"service-name", "service-id", "/fake-dir",
+				fakeOs,
+				fakeClock,
+				fakeStore,
+				nfsbroker.WithProvisionPreflight(time.Second),
+			)
+
+			provisionDetails = brokerapi.ProvisionDetails{PlanID: "Existing", RawParameters: json.RawMessage(fmt.Sprintf(`{"share":"127.0.0.1:/some-share","bind_defaults":{"port":%d}}`, listener.Addr().(*net.TCPAddr).Port))}
+		})
+
+		AfterEach(func() {
+			listener.Close()
+		})
+
+		It("provisions when the nfs server is listening", func() {
+			_, err := broker.Provision(ctx, "some-instance-id", provisionDetails, false)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fakeStore.SaveCallCount()).To(Equal(1))
+		})
+
+		Context("when the nfs server is not listening", func() {
+			BeforeEach(func() {
+				Expect(listener.Close()).To(Succeed())
 			})
 
-			It("errors when the service instance does not exist", func() {
-				_, err := broker.Bind(ctx, "nonexistent-instance-id", "binding-id", brokerapi.BindDetails{AppGUID: "guid"})
-				Expect(err).To(Equal(brokerapi.ErrInstanceDoesNotExist))
+			It("fails with ErrProvisionShareUnreachable without recording the instance", func() {
+				_, err := broker.Provision(ctx, "some-instance-id", provisionDetails, false)
+				Expect(err).To(Equal(nfsbroker.ErrProvisionShareUnreachable))
+				expectFailureResponse(err, logger, http.StatusUnprocessableEntity, "share-unreachable")
+				Expect(fakeStore.SaveCallCount()).To(Equal(0))
+				Expect(broker.Dump().InstanceMap).NotTo(HaveKey("some-instance-id"))
 			})
 
-			It("errors when the app guid is not provided", func() {
-				_, err := broker.Bind(ctx, "some-instance-id", "binding-id", brokerapi.BindDetails{})
-				Expect(err).To(Equal(brokerapi.ErrAppGuidNotProvided))
+			It("fails before taking the lock of a shared store", func() {
+				fakeLocker := &nfsbrokerfakes.FakeLocker{}
+				fakeLocker.TryLockReturns(true, nil)
+				broker = nfsbroker.New(
+					logger,
+					"service-name", "service-id", "/fake-dir",
+					fakeOs,
+					fakeClock,
+					&lockingStore{FakeStore: fakeStore, FakeLocker: fakeLocker},
+					nfsbroker.WithProvisionPreflight(time.Second),
+				)
+
+				_, err := broker.Provision(ctx, "some-instance-id", provisionDetails, false)
+				Expect(err).To(Equal(nfsbroker.ErrProvisionShareUnreachable))
+				Expect(fakeLocker.TryLockCallCount()).To(Equal(0))
 			})
 		})
+	})
 
-		Context(".Unbind", func() {
-			var (
-				instanceID  string
-				err         error
-				bindDetails brokerapi.BindDetails
+	Context("when configured with tls client credentials", func() {
+		var (
+			testLogger  *lagertest.TestLogger
+			credentials nfsbroker.TLSCredentials
+			binding     brokerapi.Binding
+			err         error
+		)
+
+		BeforeEach(func() {
+			testLogger = lagertest.NewTestLogger("test-broker")
+			credentials = nfsbroker.TLSCredentials{Cert: "/certs/client.crt", Key: "/certs/client.key", CA: "/certs/ca.crt"}
+		})
+
+		JustBeforeEach(func() {
+			broker = nfsbroker.New(
+				testLogger,
+				"service-name", "service-id", "/fake-dir",
+				fakeOs,
+				fakeClock,
+				fakeStore,
+				nfsbroker.WithTLSClientCredentials(credentials),
 			)
 
-			BeforeEach(func() {
-				instanceID = "some-instance-id"
+			provisionDetails := brokerapi.ProvisionDetails{PlanID: "Existing", RawParameters: json.RawMessage(`{"share":"server:/some-share"}`)}
+			_, err = broker.Provision(ctx, "some-instance-id", provisionDetails, false)
+			Expect(err).NotTo(HaveOccurred())
 
-				configuration := map[string]interface{}{"share": "server:/some-share"}
+			bindDetails := brokerapi.BindDetails{AppGUID: "guid", Parameters: map[string]interface{}{"uid": "1000", "gid": "1000"}}
+			binding, err = broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+		})
 
-				buf := &bytes.Buffer{}
-				_ = json.NewEncoder(buf).Encode(configuration)
-				provisionDetails := brokerapi.ProvisionDetails{PlanID: "Existing", RawParameters: json.RawMessage(buf.Bytes())}
+		It("passes the file paths to the driver", func() {
+			Expect(err).NotTo(HaveOccurred())
+			mountConfig := binding.VolumeMounts[0].Device.MountConfig
+			Expect(mountConfig["tls_cert"]).To(Equal("/certs/client.crt"))
+			Expect(mountConfig["tls_key"]).To(Equal("/certs/client.key"))
+			Expect(mountConfig["tls_ca"]).To(Equal("/certs/ca.crt"))
+			Expect(fakeOs.StatCallCount()).To(Equal(3))
+		})
 
-				_, err = broker.Provision(ctx, instanceID, provisionDetails, false)
-				Expect(err).NotTo(HaveOccurred())
+		Context("when a file does not exist", func() {
+			BeforeEach(func() {
+				fakeOs.StatStub = func(name string) (os.FileInfo, error) {
+					if name == "/certs/client.key" {
+						return nil, errors.New("no such file")
+					}
+					return nil, nil
+				}
+			})
 
-				bindDetails = brokerapi.BindDetails{AppGUID: "guid", Parameters: map[string]interface{}{nfsbroker.Username: "principal name", nfsbroker.Secret: "some keytab data", "uid": "1000", "gid": "1000"}}
+			It("fails the bind", func() {
+				Expect(err).To(MatchError("the broker's tls client credentials are misconfigured"))
+			})
+		})
 
-				_, err = broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
-				Expect(err).NotTo(HaveOccurred())
+		Context("when the contents are inline", func() {
+			BeforeEach(func() {
+				credentials = nfsbroker.TLSCredentials{Cert: "CLIENT CERTIFICATE", Key: "CLIENT PRIVATE KEY", Inline: true}
 			})
 
-			It("unbinds a bound service instance from an app", func() {
-				err = broker.Unbind(ctx, "some-instance-id", "binding-id", brokerapi.UnbindDetails{})
+			It("passes the contents to the driver without checking for files", func() {
 				Expect(err).NotTo(HaveOccurred())
+				mountConfig := binding.VolumeMounts[0].Device.MountConfig
+				Expect(mountConfig["tls_cert"]).To(Equal("CLIENT CERTIFICATE"))
+				Expect(mountConfig["tls_key"]).To(Equal("CLIENT PRIVATE KEY"))
+				Expect(mountConfig).NotTo(HaveKey("tls_ca"))
+				Expect(fakeOs.StatCallCount()).To(Equal(0))
 			})
 
-			It("fails when trying to unbind a instance that has not been provisioned", func() {
-				err = broker.Unbind(ctx, "some-other-instance-id", "binding-id", brokerapi.UnbindDetails{})
-				Expect(err).To(Equal(brokerapi.ErrInstanceDoesNotExist))
+			It("does not log the contents", func() {
+				Expect(testLogger.Buffer()).NotTo(gbytes.Say("CLIENT PRIVATE KEY"))
 			})
+		})
+	})
 
-			It("fails when trying to unbind a binding that has not been bound", func() {
-				err := broker.Unbind(ctx, "some-instance-id", "some-other-binding-id", brokerapi.UnbindDetails{})
-				Expect(err).To(Equal(brokerapi.ErrBindingDoesNotExist))
+	Context("when generating volume ids", func() {
+		var bindDetails brokerapi.BindDetails
+
+		provisionAndBind := func(instanceID string) string {
+			provisionDetails := brokerapi.ProvisionDetails{PlanID: "Existing", RawParameters: json.RawMessage(`{"share":"server:/some-share"}`)}
+			_, err := broker.Provision(ctx, instanceID, provisionDetails, false)
+			Expect(err).NotTo(HaveOccurred())
+
+			binding, err := broker.Bind(ctx, instanceID, "binding-"+instanceID, bindDetails)
+			Expect(err).NotTo(HaveOccurred())
+			return binding.VolumeMounts[0].Device.VolumeId
+		}
+
+		BeforeEach(func() {
+			bindDetails = brokerapi.BindDetails{AppGUID: "guid", Parameters: map[string]interface{}{"uid": "1000", "gid": "1000"}}
+			broker = nfsbroker.New(
+				logger,
+				"service-name", "service-id", "/fake-dir",
+				fakeOs,
+				fakeClock,
+				fakeStore,
+			)
+		})
+
+		It("keeps safe ids as they are", func() {
+			Expect(provisionAndBind("8f1e4b56-1f2a-4c3d-9e8f-0a1b2c3d4e5f")).To(HavePrefix("8f1e4b56-1f2a-4c3d-9e8f-0a1b2c3d4e5f-"))
+		})
+
+		It("strips characters the driver cannot handle without colliding", func() {
+			unsafe := provisionAndBind("some/instance id")
+			safe := provisionAndBind("some_instance_id")
+			Expect(unsafe).To(MatchRegexp(`^[A-Za-z0-9_.-]+$`))
+			Expect(unsafe).NotTo(Equal(safe))
+		})
+
+		Context("given a maximum length", func() {
+			BeforeEach(func() {
+				broker = nfsbroker.New(
+					logger,
+					"service-name", "service-id", "/fake-dir",
+					fakeOs,
+					fakeClock,
+					fakeStore,
+					nfsbroker.WithMaxVolumeIDLength(48),
+				)
 			})
-			It("should write state", func() {
-				err := broker.Unbind(ctx, "some-instance-id", "binding-id", brokerapi.UnbindDetails{})
-				Expect(err).NotTo(HaveOccurred())
 
-				_, data, _, _ := fakeStore.SaveArgsForCall(fakeStore.SaveCallCount() - 1)
-				Expect(data.InstanceMap[instanceID].PlanID).To(Equal("Existing"))
+			It("bounds the length without colliding", func() {
+				first := provisionAndBind("8f1e4b56-1f2a-4c3d-9e8f-0a1b2c3d4e5f")
+				second := provisionAndBind("8f1e4b56-1f2a-4c3d-9e8f-0a1b2c3d4e60")
+				Expect(len(first)).To(BeNumerically("<=", 48))
+				Expect(len(second)).To(BeNumerically("<=", 48))
+				Expect(first).NotTo(Equal(second))
 			})
-		})
 
+			It("never goes below the minimum length", func() {
+				broker = nfsbroker.New(
+					logger,
+					"service-name", "service-id", "/fake-dir",
+					fakeOs,
+					fakeClock,
+					fakeStore,
+					nfsbroker.WithMaxVolumeIDLength(1),
+				)
+				Expect(provisionAndBind("8f1e4b56-1f2a-4c3d-9e8f-0a1b2c3d4e5f")).To(HaveLen(nfsbroker.MinVolumeIDLength))
+			})
+		})
 	})
 
 	Context("when recreating", func() {
@@ -464,7 +3048,7 @@ var _ = Describe("Broker", func() {
 						Share: "server:/some-share",
 					},
 				},
-				BindingMap: map[string]brokerapi.BindDetails{},
+				BindingMap: map[string]nfsbroker.ServiceBinding{},
 			}
 
 			fakeStore.RestoreStub = func(logger lager.Logger, state *nfsbroker.DynamicState) error {
@@ -476,13 +3060,141 @@ var _ = Describe("Broker", func() {
 				logger,
 				"service-name", "service-id", "/fake-dir",
 				fakeOs,
-				nil,
+				fakeClock,
 				fakeStore,
 			)
 
 			_, err := broker.Bind(ctx, "service-name", "whatever", bindDetails)
 			Expect(err).NotTo(HaveOccurred())
 		})
+
+		Context("given a binding restored without an instance id", func() {
+			BeforeEach(func() {
+				fileContents := nfsbroker.DynamicState{
+					InstanceMap: map[string]nfsbroker.ServiceInstance{
+						"service-name": {
+							Share: "server:/some-share",
+						},
+					},
+					BindingMap: map[string]nfsbroker.ServiceBinding{
+						"legacy-binding": {Details: bindDetails},
+					},
+				}
+
+				fakeStore.RestoreStub = func(logger lager.Logger, state *nfsbroker.DynamicState) error {
+					*state = fileContents
+					return nil
+				}
+
+				broker = nfsbroker.New(
+					logger,
+					"service-name", "service-id", "/fake-dir",
+					fakeOs,
+					fakeClock,
+					fakeStore,
+				)
+			})
+
+			It("accepts a rebind with the same details", func() {
+				_, err := broker.Bind(ctx, "service-name", "legacy-binding", bindDetails)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("can be unbound", func() {
+				err := broker.Unbind(ctx, "service-name", "legacy-binding", brokerapi.UnbindDetails{})
+				Expect(err).NotTo(HaveOccurred())
+			})
+		})
+	})
+
+	Context("when checking volume ids", func() {
+		var bindDetails brokerapi.BindDetails
+
+		BeforeEach(func() {
+			bindDetails = brokerapi.BindDetails{AppGUID: "guid", Parameters: map[string]interface{}{"uid": "1000", "gid": "1000"}}
+
+			fakeStore.RestoreStub = func(logger lager.Logger, state *nfsbroker.DynamicState) error {
+				*state = nfsbroker.DynamicState{
+					InstanceMap: map[string]nfsbroker.ServiceInstance{
+						"service-name": {PlanID: "Existing", Share: "server:/some-share"},
+					},
+					BindingMap: map[string]nfsbroker.ServiceBinding{
+						"drifted-binding": {InstanceID: "service-name", Details: bindDetails, VolumeID: "stale-volume-id"},
+					},
+				}
+				return nil
+			}
+
+			broker = nfsbroker.New(
+				logger,
+				"service-name", "service-id", "/fake-dir",
+				fakeOs,
+				fakeClock,
+				fakeStore,
+			)
+		})
+
+		It("records the volume id of new bindings", func() {
+			binding, err := broker.Bind(ctx, "service-name", "binding-id", bindDetails)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(broker.Dump().BindingMap["binding-id"].VolumeID).To(Equal(binding.VolumeMounts[0].Device.VolumeId))
+		})
+
+		Context("on startup", func() {
+			JustBeforeEach(func() {
+				broker = nfsbroker.New(
+					logger,
+					"service-name", "service-id", "/fake-dir",
+					fakeOs,
+					fakeClock,
+					fakeStore,
+					nfsbroker.WithVolumeIDCheck(false),
+				)
+			})
+
+			It("logs drifted volume ids without changing them", func() {
+				Expect(logger.(*lagertest.TestLogger).LogMessages()).To(ContainElement("test-broker.check-volume-ids.volume-id-drift"))
+				Expect(broker.Dump().BindingMap["drifted-binding"].VolumeID).To(Equal("stale-volume-id"))
+				Expect(fakeStore.SaveCallCount()).To(Equal(0))
+			})
+		})
+
+		It("reports the drifted bindings and leaves the others", func() {
+			_, err := broker.Bind(ctx, "service-name", "binding-id", bindDetails)
+			Expect(err).NotTo(HaveOccurred())
+
+			drifted, err := broker.CheckVolumeIDs(false)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(drifted).To(Equal([]string{"drifted-binding"}))
+		})
+
+		It("repairs drifted volume ids when asked", func() {
+			binding, err := broker.Bind(ctx, "service-name", "binding-id", bindDetails)
+			Expect(err).NotTo(HaveOccurred())
+			saves := fakeStore.SaveCallCount()
+
+			drifted, err := broker.CheckVolumeIDs(true)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(drifted).To(Equal([]string{"drifted-binding"}))
+
+			// both bindings have the same parameters, so the same volume id
+			Expect(broker.Dump().BindingMap["drifted-binding"].VolumeID).To(Equal(binding.VolumeMounts[0].Device.VolumeId))
+			Expect(fakeStore.SaveCallCount()).To(Equal(saves + 1))
+		})
 	})
 
 })
+
+// expectFailureResponse checks err is one brokerapi answers with statusCode,
+// logging code as the failed action
+func expectFailureResponse(err error, logger lager.Logger, statusCode int, code string) {
+	failure, ok := err.(*brokerapi.FailureResponse)
+	ExpectWithOffset(1, ok).To(BeTrue(), fmt.Sprintf("%#v is not a failure response", err))
+	ExpectWithOffset(1, failure.ValidatedStatusCode(logger)).To(Equal(statusCode))
+	ExpectWithOffset(1, failure.LoggerAction()).To(Equal(code))
+}
+
+type lockingStore struct {
+	*nfsbrokerfakes.FakeStore
+	*nfsbrokerfakes.FakeLocker
+}
@@ -0,0 +1,332 @@
+package nfsbroker
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Option customizes optional broker behavior at construction time
+type Option func(*brokerConfig)
+
+type brokerConfig struct {
+	syslogDrainURL            *template.Template
+	deviceName                *template.Template
+	bindTimeout               time.Duration
+	preflightTimeout          time.Duration
+	provisionPreflightTimeout time.Duration
+	lenientDeprovision        bool
+	maxVolumeIDLength         int
+	maxInstances              int
+	maxMountConfigSize        int
+	tlsCredentials            TLSCredentials
+	timeo                     int
+	retrans                   int
+	rsize                     int
+	wsize                     int
+	strictBlockSizes          bool
+	forcedBindParameters      map[string]interface{}
+	exclusiveParameters       [][]string
+	volumeIDCheck             bool
+	volumeIDRepair            bool
+	orgRateInterval           time.Duration
+	orgRateBurst              int
+	plans                     []Plan
+	defaultPlanID             string
+	allowedOrgs               []string
+	allowedSpaces             []string
+	unknownFields             UnknownFieldsMode
+	duplicateShares           DuplicateSharesMode
+	shareNormalizer           ShareNormalizer
+	idResolver                IDResolver
+	containerPathAllow        *regexp.Regexp
+	containerPathDeny         *regexp.Regexp
+}
+
+// UnknownFieldsMode says what Provision does with parameters it does not know
+type UnknownFieldsMode string
+
+const (
+	UnknownFieldsIgnore UnknownFieldsMode = "ignore"
+	UnknownFieldsReject UnknownFieldsMode = "reject"
+	UnknownFieldsStore  UnknownFieldsMode = "store"
+)
+
+// ParseUnknownFieldsMode accepts "ignore", "reject" or "store"
+func ParseUnknownFieldsMode(mode string) (UnknownFieldsMode, error) {
+	switch UnknownFieldsMode(mode) {
+	case UnknownFieldsIgnore, UnknownFieldsReject, UnknownFieldsStore:
+		return UnknownFieldsMode(mode), nil
+	default:
+		return "", fmt.Errorf("unknown fields mode must be one of %q, %q or %q", UnknownFieldsIgnore, UnknownFieldsReject, UnknownFieldsStore)
+	}
+}
+
+// DuplicateSharesMode says what Provision does when another instance already
+// uses the same share
+type DuplicateSharesMode string
+
+const (
+	DuplicateSharesAllow  DuplicateSharesMode = "allow"
+	DuplicateSharesWarn   DuplicateSharesMode = "warn"
+	DuplicateSharesReject DuplicateSharesMode = "reject"
+)
+
+// ParseDuplicateSharesMode accepts "allow", "warn" or "reject"
+func ParseDuplicateSharesMode(mode string) (DuplicateSharesMode, error) {
+	switch DuplicateSharesMode(mode) {
+	case DuplicateSharesAllow, DuplicateSharesWarn, DuplicateSharesReject:
+		return DuplicateSharesMode(mode), nil
+	default:
+		return "", fmt.Errorf("duplicate shares mode must be one of %q, %q or %q", DuplicateSharesAllow, DuplicateSharesWarn, DuplicateSharesReject)
+	}
+}
+
+// ParseExclusiveParameterGroups parses groups of bind parameters that cannot
+// be used together, the groups separated by commas and the parameters within
+// a group by |, e.g. "soft|hard,readonly|rw"
+func ParseExclusiveParameterGroups(groups string) ([][]string, error) {
+	var parsed [][]string
+	for _, group := range strings.Split(groups, ",") {
+		if strings.TrimSpace(group) == "" {
+			continue
+		}
+
+		var keys []string
+		for _, key := range strings.Split(group, "|") {
+			if key = strings.TrimSpace(key); key != "" {
+				keys = append(keys, key)
+			}
+		}
+		if len(keys) < 2 {
+			return nil, fmt.Errorf("exclusive parameter group needs at least two parameters: %s", group)
+		}
+		parsed = append(parsed, keys)
+	}
+	return parsed, nil
+}
+
+// TLSCredentials are the client certificate, key and CA handed to the driver
+// for shares behind a TLS terminating proxy. They are file paths, or PEM
+// contents when Inline is set.
+type TLSCredentials struct {
+	Cert   string
+	Key    string
+	CA     string
+	Inline bool
+}
+
+// WithSyslogDrainURL makes every binding also carry a syslog drain, rendered
+// from the template with the instance and binding details
+func WithSyslogDrainURL(syslogDrainURL *template.Template) Option {
+	return func(c *brokerConfig) {
+		c.syslogDrainURL = syslogDrainURL
+	}
+}
+
+// WithDeviceName gives every binding's mount config a device_name, rendered
+// from the template with the instance and binding details. Templates that only
+// use the instance and binding ids give the same name on every rebind.
+func WithDeviceName(deviceName *template.Template) Option {
+	return func(c *brokerConfig) {
+		c.deviceName = deviceName
+	}
+}
+
+// WithBindTimeout bounds how long a single bind may take, including waiting
+// for the broker lock. Zero means no limit.
+func WithBindTimeout(bindTimeout time.Duration) Option {
+	return func(c *brokerConfig) {
+		c.bindTimeout = bindTimeout
+	}
+}
+
+// WithSharePreflight makes Bind dial the NFS server before returning a
+// binding, failing with ErrShareUnreachable if it cannot connect in time
+func WithSharePreflight(timeout time.Duration) Option {
+	return func(c *brokerConfig) {
+		c.preflightTimeout = timeout
+	}
+}
+
+// WithProvisionPreflight makes Provision dial the NFS server, failing with
+// ErrProvisionShareUnreachable if it cannot connect within timeout, so no
+// instance points at a dead server. The port comes from the instance's bind
+// defaults, if it sets one.
+func WithProvisionPreflight(timeout time.Duration) Option {
+	return func(c *brokerConfig) {
+		c.provisionPreflightTimeout = timeout
+	}
+}
+
+// WithLenientDeprovision makes deprovisioning an instance that is already
+// gone succeed, so that platform retries after a success are harmless
+func WithLenientDeprovision() Option {
+	return func(c *brokerConfig) {
+		c.lenientDeprovision = true
+	}
+}
+
+// WithMaxVolumeIDLength caps the length of generated volume ids for drivers
+// that limit it. Lengths below MinVolumeIDLength are raised to it.
+func WithMaxVolumeIDLength(maxLength int) Option {
+	return func(c *brokerConfig) {
+		c.maxVolumeIDLength = maxLength
+	}
+}
+
+// WithMaxInstances caps how many service instances the broker will hold.
+// Zero means no limit.
+func WithMaxInstances(maxInstances int) Option {
+	return func(c *brokerConfig) {
+		c.maxInstances = maxInstances
+	}
+}
+
+// WithMaxMountConfigSize caps the serialized size in bytes of the mount
+// config a bind may produce. Zero means no limit.
+func WithMaxMountConfigSize(maxMountConfigSize int) Option {
+	return func(c *brokerConfig) {
+		c.maxMountConfigSize = maxMountConfigSize
+	}
+}
+
+// WithTLSClientCredentials adds the credentials to the mount config of every
+// binding. File paths are checked to exist when binding.
+func WithTLSClientCredentials(credentials TLSCredentials) Option {
+	return func(c *brokerConfig) {
+		c.tlsCredentials = credentials
+	}
+}
+
+// WithRetryDefaults sets the NFS timeo and retrans options used by binds that
+// do not choose their own. Zero leaves an option to the driver.
+func WithRetryDefaults(timeo, retrans int) Option {
+	return func(c *brokerConfig) {
+		c.timeo = timeo
+		c.retrans = retrans
+	}
+}
+
+// WithBlockSizeDefaults sets the NFS rsize and wsize options used by binds
+// that do not choose their own. Zero leaves an option to the driver.
+func WithBlockSizeDefaults(rsize, wsize int) Option {
+	return func(c *brokerConfig) {
+		c.rsize = rsize
+		c.wsize = wsize
+	}
+}
+
+// WithStrictBlockSizes rejects binds whose rsize or wsize is not a power of
+// two, rather than just logging them
+func WithStrictBlockSizes() Option {
+	return func(c *brokerConfig) {
+		c.strictBlockSizes = true
+	}
+}
+
+// WithPlans replaces the catalog's single "Existing" plan with plans
+func WithPlans(plans []Plan) Option {
+	return func(c *brokerConfig) {
+		c.plans = plans
+	}
+}
+
+// WithDefaultPlan makes Provision use planID when a request names no plan.
+// Requests naming a plan the broker does not offer are still rejected.
+func WithDefaultPlan(planID string) Option {
+	return func(c *brokerConfig) {
+		c.defaultPlanID = planID
+	}
+}
+
+// WithProvisionAllowlist only lets the listed orgs and spaces provision. An
+// instance is allowed when either its org or its space is listed.
+func WithProvisionAllowlist(orgGUIDs, spaceGUIDs []string) Option {
+	return func(c *brokerConfig) {
+		c.allowedOrgs = orgGUIDs
+		c.allowedSpaces = spaceGUIDs
+	}
+}
+
+// WithUnknownProvisionFields sets what Provision does with parameters other
+// than share. By default they are logged and ignored.
+func WithUnknownProvisionFields(mode UnknownFieldsMode) Option {
+	return func(c *brokerConfig) {
+		c.unknownFields = mode
+	}
+}
+
+// WithDuplicateShares sets what Provision does when another instance already
+// uses the same share. By default duplicates are allowed.
+func WithDuplicateShares(mode DuplicateSharesMode) Option {
+	return func(c *brokerConfig) {
+		c.duplicateShares = mode
+	}
+}
+
+// WithContainerPathPatterns restricts the container paths binds may request
+// with the mount parameter to those matching allow and not matching deny.
+// Either pattern may be nil.
+func WithContainerPathPatterns(allow, deny *regexp.Regexp) Option {
+	return func(c *brokerConfig) {
+		c.containerPathAllow = allow
+		c.containerPathDeny = deny
+	}
+}
+
+// WithShareNormalizer sets how shares are normalized before they are
+// compared. By default NormalizeShare ignores the case of export paths.
+func WithShareNormalizer(normalizer ShareNormalizer) Option {
+	return func(c *brokerConfig) {
+		c.shareNormalizer = normalizer
+	}
+}
+
+// WithForcedBindParameters sets bind parameters that override both the bind's
+// own and the instance's defaults
+func WithForcedBindParameters(parameters map[string]interface{}) Option {
+	return func(c *brokerConfig) {
+		c.forcedBindParameters = parameters
+	}
+}
+
+// WithExclusiveBindParameters rejects binds that set more than one parameter
+// of any of the groups
+func WithExclusiveBindParameters(groups [][]string) Option {
+	return func(c *brokerConfig) {
+		c.exclusiveParameters = groups
+	}
+}
+
+// WithVolumeIDCheck makes New run CheckVolumeIDs once the state is restored,
+// repairing drifted volume ids only if repair is set
+func WithVolumeIDCheck(repair bool) Option {
+	return func(c *brokerConfig) {
+		c.volumeIDCheck = true
+		c.volumeIDRepair = repair
+	}
+}
+
+// WithOrgRateLimit limits how often each organization may provision and bind:
+// up to burst requests at once, then one more every interval. It is ignored
+// unless interval is positive and burst at least one.
+func WithOrgRateLimit(interval time.Duration, burst int) Option {
+	return func(c *brokerConfig) {
+		if interval <= 0 || burst < 1 {
+			return
+		}
+		c.orgRateInterval = interval
+		c.orgRateBurst = burst
+	}
+}
+
+// WithIDResolver asks resolver for a uid and gid when a bind is missing them,
+// instead of failing straight away
+func WithIDResolver(resolver IDResolver) Option {
+	return func(c *brokerConfig) {
+		c.idResolver = resolver
+	}
+}
@@ -0,0 +1,21 @@
+package nfsbroker_test
+
+import (
+	"code.cloudfoundry.org/nfsbroker/nfsbroker"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ParseExclusiveParameterGroups", func() {
+	It("parses groups of parameters", func() {
+		groups, err := nfsbroker.ParseExclusiveParameterGroups("soft|hard, readonly | rw ,")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(groups).To(Equal([][]string{{"soft", "hard"}, {"readonly", "rw"}}))
+	})
+
+	It("errors on a group of one parameter", func() {
+		_, err := nfsbroker.ParseExclusiveParameterGroups("soft|hard,readonly|")
+		Expect(err).To(MatchError("exclusive parameter group needs at least two parameters: readonly|"))
+	})
+})
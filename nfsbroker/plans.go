@@ -0,0 +1,105 @@
+package nfsbroker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// Plan is a service plan offered by the broker, with the bind defaults that
+// come with it
+type Plan struct {
+	ID              string `json:"id"`
+	Name            string `json:"name"`
+	Description     string `json:"description"`
+	DefaultReadonly bool   `json:"default_readonly"`
+
+	// AccessMode is the access_mode binds get when they do not set one
+	AccessMode string `json:"access_mode,omitempty"`
+
+	// RequiredBindParameters must be given by every bind itself; instance
+	// defaults and forced parameters do not count
+	RequiredBindParameters []string `json:"required_bind_parameters,omitempty"`
+
+	// Free defaults to true; Costs are shown to users choosing a plan
+	Free  *bool                       `json:"free,omitempty"`
+	Costs []brokerapi.ServicePlanCost `json:"costs,omitempty"`
+}
+
+// DefaultPlans are offered when no plans are configured
+var DefaultPlans = []Plan{{
+	ID:          "Existing",
+	Name:        "Existing",
+	Description: "A preexisting filesystem",
+}}
+
+// ParsePlans reads a JSON list of plans, as given to the -plansFile flag
+func ParsePlans(data []byte) ([]Plan, error) {
+	var plans []Plan
+	if err := json.Unmarshal(data, &plans); err != nil {
+		return nil, err
+	}
+	if len(plans) == 0 {
+		return nil, errors.New("at least one plan is required")
+	}
+
+	seen := map[string]bool{}
+	for _, plan := range plans {
+		if plan.ID == "" || plan.Name == "" {
+			return nil, errors.New("every plan requires an id and a name")
+		}
+		if plan.AccessMode != "" && !contains(accessModes, plan.AccessMode) {
+			return nil, fmt.Errorf("plan %s: %s", plan.ID, errInvalidAccessMode)
+		}
+		if seen[plan.ID] {
+			return nil, fmt.Errorf("duplicate plan id: %s", plan.ID)
+		}
+		seen[plan.ID] = true
+	}
+	return plans, nil
+}
+
+func (p Plan) servicePlan() brokerapi.ServicePlan {
+	free := p.Free == nil || *p.Free
+	servicePlan := brokerapi.ServicePlan{
+		ID:          p.ID,
+		Name:        p.Name,
+		Description: p.Description,
+		Free:        &free,
+	}
+
+	var bullets []string
+	if p.DefaultReadonly {
+		bullets = append(bullets, "Mounted read-only unless the binding sets readonly to false")
+	}
+	if len(bullets) > 0 || len(p.Costs) > 0 {
+		servicePlan.Metadata = &brokerapi.ServicePlanMetadata{
+			Bullets: bullets,
+			Costs:   p.Costs,
+		}
+	}
+	return servicePlan
+}
+
+// missingBindParameters lists the plan's required bind parameters that
+// parameters lacks
+func (p Plan) missingBindParameters(parameters map[string]interface{}) []string {
+	var missing []string
+	for _, key := range p.RequiredBindParameters {
+		if _, ok := parameters[key]; !ok {
+			missing = append(missing, key)
+		}
+	}
+	return missing
+}
+
+func (b *Broker) plan(planID string) (Plan, bool) {
+	for _, plan := range b.config.plans {
+		if plan.ID == planID {
+			return plan, true
+		}
+	}
+	return Plan{}, false
+}
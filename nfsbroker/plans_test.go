@@ -0,0 +1,67 @@
+package nfsbroker_test
+
+import (
+	"code.cloudfoundry.org/nfsbroker/nfsbroker"
+	"github.com/pivotal-cf/brokerapi"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ParsePlans", func() {
+	It("parses a list of plans", func() {
+		plans, err := nfsbroker.ParsePlans([]byte(`[
+			{"id": "Existing", "name": "Existing", "description": "A preexisting filesystem"},
+			{"id": "ReadOnly", "name": "ReadOnly", "description": "A preexisting filesystem, read-only", "default_readonly": true}
+		]`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(plans).To(Equal([]nfsbroker.Plan{
+			{ID: "Existing", Name: "Existing", Description: "A preexisting filesystem"},
+			{ID: "ReadOnly", Name: "ReadOnly", Description: "A preexisting filesystem, read-only", DefaultReadonly: true},
+		}))
+	})
+
+	It("rejects invalid JSON", func() {
+		_, err := nfsbroker.ParsePlans([]byte(`{not json`))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("rejects an empty list", func() {
+		_, err := nfsbroker.ParsePlans([]byte(`[]`))
+		Expect(err).To(MatchError("at least one plan is required"))
+	})
+
+	It("rejects a plan without an id", func() {
+		_, err := nfsbroker.ParsePlans([]byte(`[{"name": "Existing"}]`))
+		Expect(err).To(MatchError("every plan requires an id and a name"))
+	})
+
+	It("parses a plan's access mode", func() {
+		plans, err := nfsbroker.ParsePlans([]byte(`[{"id": "Single", "name": "Single", "access_mode": "read-write-once"}]`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(plans[0].AccessMode).To(Equal(nfsbroker.AccessModeReadWriteOnce))
+	})
+
+	It("rejects an unknown access mode", func() {
+		_, err := nfsbroker.ParsePlans([]byte(`[{"id": "Single", "name": "Single", "access_mode": "exclusive"}]`))
+		Expect(err).To(MatchError(`plan Single: access_mode must be "read-write-once" or "read-write-many"`))
+	})
+
+	It("parses a plan's pricing", func() {
+		plans, err := nfsbroker.ParsePlans([]byte(`[{"id": "Premium", "name": "Premium", "free": false, "costs": [{"amount": {"usd": 9.99}, "unit": "MONTHLY"}]}]`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(*plans[0].Free).To(BeFalse())
+		Expect(plans[0].Costs).To(Equal([]brokerapi.ServicePlanCost{{Amount: map[string]float64{"usd": 9.99}, Unit: "MONTHLY"}}))
+	})
+
+	It("parses a plan's required bind parameters", func() {
+		plans, err := nfsbroker.ParsePlans([]byte(`[{"id": "Strict", "name": "Strict", "required_bind_parameters": ["uid", "gid"]}]`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(plans[0].RequiredBindParameters).To(Equal([]string{"uid", "gid"}))
+	})
+
+	It("rejects duplicate plan ids", func() {
+		_, err := nfsbroker.ParsePlans([]byte(`[{"id": "Existing", "name": "A"}, {"id": "Existing", "name": "B"}]`))
+		Expect(err).To(MatchError("duplicate plan id: Existing"))
+	})
+})
@@ -0,0 +1,105 @@
+package nfsbroker
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/clock"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// rateLimiter is a token bucket per key: each bucket holds up to burst
+// tokens and gains one every interval. Full buckets are dropped, since a
+// missing bucket starts full anyway.
+type rateLimiter struct {
+	clock    clock.Clock
+	interval time.Duration
+	burst    int
+
+	mutex     sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(clock clock.Clock, interval time.Duration, burst int) *rateLimiter {
+	return &rateLimiter{
+		clock:     clock,
+		interval:  interval,
+		burst:     burst,
+		buckets:   map[string]*tokenBucket{},
+		lastSweep: clock.Now(),
+	}
+}
+
+// take spends a token from key's bucket. When the bucket is empty it returns
+// false and how long until the next token.
+func (r *rateLimiter) take(key string) (bool, time.Duration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := r.clock.Now()
+	r.sweep(now)
+
+	bucket, ok := r.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(r.burst), last: now}
+		r.buckets[key] = bucket
+	}
+
+	bucket.tokens += float64(now.Sub(bucket.last)) / float64(r.interval)
+	if bucket.tokens > float64(r.burst) {
+		bucket.tokens = float64(r.burst)
+	}
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) * float64(r.interval))
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// refund returns a token spent from key's bucket
+func (r *rateLimiter) refund(key string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	// a missing bucket is full already
+	bucket, ok := r.buckets[key]
+	if !ok {
+		return
+	}
+
+	bucket.tokens++
+	if bucket.tokens > float64(r.burst) {
+		bucket.tokens = float64(r.burst)
+	}
+}
+
+// sweep drops the buckets that have refilled, at most once every time it
+// takes an empty bucket to refill
+func (r *rateLimiter) sweep(now time.Time) {
+	if now.Sub(r.lastSweep) < time.Duration(r.burst)*r.interval {
+		return
+	}
+	r.lastSweep = now
+
+	for key, bucket := range r.buckets {
+		if bucket.tokens+float64(now.Sub(bucket.last))/float64(r.interval) >= float64(r.burst) {
+			delete(r.buckets, key)
+		}
+	}
+}
+
+// rateLimited is the error for a request refused by the rate limiter
+func rateLimited(retryAfter time.Duration) error {
+	err := fmt.Errorf("too many requests for this organization, retry after %s", retryAfter)
+	return brokerapi.NewFailureResponse(err, http.StatusTooManyRequests, "rate-limited")
+}
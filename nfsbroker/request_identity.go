@@ -0,0 +1,49 @@
+package nfsbroker
+
+import (
+	"context"
+	"net/http"
+
+	"code.cloudfoundry.org/lager"
+)
+
+// RequestIdentityHeader is the header platforms set to correlate the broker
+// requests made for a single user action
+const RequestIdentityHeader = "X-Broker-API-Request-Identity"
+
+type requestIdentityKey struct{}
+
+// WithRequestIdentity returns a copy of ctx carrying the request identity
+func WithRequestIdentity(ctx context.Context, identity string) context.Context {
+	return context.WithValue(ctx, requestIdentityKey{}, identity)
+}
+
+// RequestIdentity returns the request identity ctx carries, or "" if none
+func RequestIdentity(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	identity, _ := ctx.Value(requestIdentityKey{}).(string)
+	return identity
+}
+
+// RequestIdentityHandler copies the RequestIdentityHeader of each request into
+// its context, where the broker picks it up for its logs
+func RequestIdentityHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if identity := r.Header.Get(RequestIdentityHeader); identity != "" {
+			r = r.WithContext(WithRequestIdentity(r.Context(), identity))
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// requestSession starts a logger session that tags every log with the
+// request identity ctx carries, if any
+func (b *Broker) requestSession(ctx context.Context, task string) lager.Logger {
+	logger := b.logger.Session(task)
+	if identity := RequestIdentity(ctx); identity != "" {
+		logger = logger.WithData(lager.Data{"requestIdentity": identity})
+	}
+	return logger
+}
@@ -0,0 +1,37 @@
+package nfsbroker_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	"code.cloudfoundry.org/nfsbroker/nfsbroker"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("RequestIdentityHandler", func() {
+	var (
+		identity string
+		handler  http.Handler
+	)
+
+	BeforeEach(func() {
+		identity = ""
+		handler = nfsbroker.RequestIdentityHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			identity = nfsbroker.RequestIdentity(r.Context())
+		}))
+	})
+
+	It("puts the request identity header into the request context", func() {
+		request := httptest.NewRequest("PUT", "/v2/service_instances/some-instance-id", nil)
+		request.Header.Set(nfsbroker.RequestIdentityHeader, "some-request-id")
+		handler.ServeHTTP(httptest.NewRecorder(), request)
+		Expect(identity).To(Equal("some-request-id"))
+	})
+
+	It("leaves the context alone when there is no header", func() {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("PUT", "/v2/service_instances/some-instance-id", nil))
+		Expect(identity).To(BeEmpty())
+	})
+})
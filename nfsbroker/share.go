@@ -0,0 +1,42 @@
+package nfsbroker
+
+import (
+	"regexp"
+	"strings"
+)
+
+var repeatedSlashes = regexp.MustCompile(`/{2,}`)
+
+// ShareNormalizer maps the different ways of writing a share onto one, so
+// that shares can be compared
+type ShareNormalizer func(share string) string
+
+// NormalizeShare lowercases the server, collapses repeated slashes and drops
+// trailing ones from the export path. The path is lowercased too unless
+// caseSensitive is set, for servers whose exports differ only by case.
+func NormalizeShare(share string, caseSensitive bool) string {
+	server, exportPath := "", share
+	if i := strings.Index(share, ":/"); i >= 0 {
+		server, exportPath = share[:i+1], share[i+1:]
+	}
+
+	exportPath = repeatedSlashes.ReplaceAllString(exportPath, "/")
+	if len(exportPath) > 1 {
+		exportPath = strings.TrimRight(exportPath, "/")
+	}
+	if !caseSensitive {
+		exportPath = strings.ToLower(exportPath)
+	}
+
+	return strings.ToLower(server) + exportPath
+}
+
+// DefaultShareNormalizer compares export paths without regard to case
+func DefaultShareNormalizer(share string) string {
+	return NormalizeShare(share, false)
+}
+
+// CaseSensitiveShareNormalizer compares export paths exactly, apart from slashes
+func CaseSensitiveShareNormalizer(share string) string {
+	return NormalizeShare(share, true)
+}
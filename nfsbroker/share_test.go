@@ -0,0 +1,27 @@
+package nfsbroker_test
+
+import (
+	"code.cloudfoundry.org/nfsbroker/nfsbroker"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("NormalizeShare", func() {
+	DescribeTable("normalizes shares",
+		func(share string, caseSensitive bool, normalized string) {
+			Expect(nfsbroker.NormalizeShare(share, caseSensitive)).To(Equal(normalized))
+		},
+		Entry("a plain share", "server:/some-share", false, "server:/some-share"),
+		Entry("a trailing slash", "server:/some-share/", false, "server:/some-share"),
+		Entry("several trailing slashes", "server:/some-share//", false, "server:/some-share"),
+		Entry("repeated slashes", "server://some//share", false, "server:/some/share"),
+		Entry("the root export", "server:/", false, "server:/"),
+		Entry("the root export with repeated slashes", "server://", false, "server:/"),
+		Entry("mixed case", "Server:/Some-Share", false, "server:/some-share"),
+		Entry("mixed case, case sensitively", "Server:/Some-Share", true, "server:/Some-Share"),
+		Entry("an ipv6 server", "[FE80::1]:/some-share/", false, "[fe80::1]:/some-share"),
+		Entry("no server", "/some-share/", false, "/some-share"),
+	)
+})
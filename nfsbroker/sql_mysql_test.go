@@ -8,6 +8,7 @@ import (
 	"errors"
 
 	"code.cloudfoundry.org/goshims/sqlshim/sql_fake"
+	"github.com/go-sql-driver/mysql"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
@@ -83,6 +84,26 @@ var _ = Describe("MysqlVariant", func() {
 				})
 			})
 
+			Context("given a password with special characters", func() {
+				BeforeEach(func() {
+					fakeSql.OpenReturns(nil, nil)
+				})
+
+				It("forms a connection string the driver parses back", func() {
+					database = nfsbroker.NewMySqlVariantWithSqlObject("username", "p@ss:w/rd 1", "host", "port", "dbName", cert, fakeSql)
+					_, err = database.Connect(logger)
+					Expect(err).NotTo(HaveOccurred())
+
+					_, connectionString := fakeSql.OpenArgsForCall(fakeSql.OpenCallCount() - 1)
+					cfg, err := mysql.ParseDSN(connectionString)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(cfg.User).To(Equal("username"))
+					Expect(cfg.Passwd).To(Equal("p@ss:w/rd 1"))
+					Expect(cfg.Addr).To(Equal("host:port"))
+					Expect(cfg.DBName).To(Equal("dbName"))
+				})
+			})
+
 			Context("when it cannot connect to a valid database", func() {
 				BeforeEach(func() {
 					fakeSql = &sql_fake.FakeSql{}
@@ -110,4 +131,3 @@ var _ = Describe("MysqlVariant", func() {
 		})
 	})
 })
-
@@ -2,6 +2,8 @@ package nfsbroker
 
 import (
 	"fmt"
+	"net"
+	"net/url"
 	"strings"
 
 	"code.cloudfoundry.org/goshims/ioutilshim"
@@ -29,12 +31,24 @@ func NewPostgresVariantWithShims(username, password, host, port, dbName, caCert
 		sql:                sql,
 		os:                 os,
 		ioutil:             ioutil,
-		dbConnectionString: fmt.Sprintf("postgres://%s:%s@%s:%s/%s", username, password, host, port, dbName),
+		dbConnectionString: postgresConnectionString(username, password, host, port, dbName),
 		caCert:             caCert,
 		dbName:             dbName,
 	}
 }
 
+// postgresConnectionString escapes the credentials and database name, so that
+// passwords containing characters such as @, : or / still form a valid URL
+func postgresConnectionString(username, password, host, port, dbName string) string {
+	connectionURL := url.URL{
+		Scheme: "postgres",
+		User:   url.UserPassword(username, password),
+		Host:   net.JoinHostPort(host, port),
+		Path:   "/" + dbName,
+	}
+	return connectionURL.String()
+}
+
 func (c *postgresVariant) Connect(logger lager.Logger) (sqlshim.SqlDB, error) {
 	logger = logger.Session("postgres-connection-connect")
 	logger.Info("start")
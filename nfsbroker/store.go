@@ -1,30 +1,131 @@
 package nfsbroker
 
 import (
+	"context"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/clock"
 	"code.cloudfoundry.org/goshims/ioutilshim"
 	"code.cloudfoundry.org/lager"
 )
 
 const SQLSTORE = "SQL_Store"
 const FILESTORE = "File_Store"
+const MEMORYSTORE = "Memory_Store"
 
 //go:generate counterfeiter -o ../nfsbrokerfakes/fake_store.go . Store
 type Store interface {
 	GetType() string
 	Restore(logger lager.Logger, state *DynamicState) error
 	Save(logger lager.Logger, state *DynamicState, instanceId, bindingId string) error
+	// SaveAll replaces everything stored with state, all at once
+	SaveAll(logger lager.Logger, state *DynamicState) error
+	InstanceExists(id string) (bool, error)
+	BindingExists(id string) (bool, error)
+	// IsEmpty is true while the store holds no instances or bindings
+	IsEmpty() (bool, error)
 	Cleanup() error
+}
 
+//go:generate counterfeiter -o ../nfsbrokerfakes/fake_locker.go . Locker
+type Locker interface {
+	TryLock(logger lager.Logger, owner string, now time.Time, lease time.Duration) (bool, error)
+	RenewLock(logger lager.Logger, owner string, now time.Time, lease time.Duration) (bool, error)
+	ReleaseLock(logger lager.Logger, owner string) error
 }
 
-func NewStore(logger lager.Logger, dbDriver, dbUsername, dbPassword, dbHostname, dbPort, dbName, dbCACert, fileName string) Store {
-	if dbDriver != "" {
-		store, err := NewSqlStore(logger, dbDriver, dbUsername, dbPassword, dbHostname, dbPort, dbName, dbCACert)
+// StoreConfig says which store NewStore creates: a SQL store when DBDriver
+// is set, and a file store otherwise
+type StoreConfig struct {
+	DBDriver       string
+	DBUsername     string
+	DBPassword     string
+	DBPasswordFile string
+	DBHostname     string
+	DBPort         string
+	DBName         string
+	DBCACert       string
+	DBTablePrefix  string
+	DBQueryTimeout time.Duration
+
+	// SeedFromFile names a file store backup loaded into an empty SQL store
+	SeedFromFile string
+
+	FileName        string
+	IndentFileStore bool
+}
+
+func NewStore(logger lager.Logger, config StoreConfig) Store {
+	if config.DBDriver != "" {
+		dbPassword, err := ResolveDBPassword(&ioutilshim.IoutilShim{}, config.DBPassword, config.DBPasswordFile)
+		if err != nil {
+			logger.Fatal("failed-reading-db-password-file", err, lager.Data{"dbPasswordFile": config.DBPasswordFile})
+		}
+
+		store, err := NewSqlStore(logger, config.DBDriver, config.DBUsername, dbPassword, config.DBHostname, config.DBPort, config.DBName, config.DBCACert, config.DBTablePrefix, config.SeedFromFile, config.DBQueryTimeout)
 		if err != nil {
 			logger.Fatal("failed-creating-sql-store", err)
 		}
 		return store
 	} else {
-		return NewFileStore(fileName, &ioutilshim.IoutilShim{})
+		if config.IndentFileStore {
+			return NewIndentedFileStore(config.FileName, &ioutilshim.IoutilShim{})
+		}
+		return NewFileStore(config.FileName, &ioutilshim.IoutilShim{})
+	}
+}
+
+// ResolveDBPassword returns the contents of passwordFile when one is given,
+// so that secrets can be mounted as files, and password otherwise
+func ResolveDBPassword(ioutil ioutilshim.Ioutil, password, passwordFile string) (string, error) {
+	if passwordFile == "" {
+		return password, nil
+	}
+
+	contents, err := ioutil.ReadFile(passwordFile)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(contents), "\r\n"), nil
+}
+
+// SeedStore copies the state held by seed into store, but only when store
+// holds no instances or bindings yet. A store shared with other brokers is
+// locked meanwhile, so that one starting at the same time cannot save records
+// in between that the seed would replace.
+func SeedStore(logger lager.Logger, store, seed Store) error {
+	logger = logger.Session("seed-store")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	var lock *StoreLock
+	if locker, shared := store.(Locker); shared {
+		lock = NewStoreLock(logger, locker, clock.NewClock(), newLockOwner())
+		if err := lock.LockContext(context.Background()); err != nil {
+			logger.Error("failed-to-acquire-store-lock", err)
+			return err
+		}
+		defer lock.Unlock()
+	}
+
+	empty, err := store.IsEmpty()
+	if err != nil {
+		return err
+	}
+	if !empty {
+		logger.Info("store-not-empty-skipping-seed")
+		return nil
+	}
+
+	state := DynamicState{InstanceMap: map[string]ServiceInstance{}, BindingMap: map[string]ServiceBinding{}}
+	if err := seed.Restore(logger, &state); err != nil {
+		return err
+	}
+
+	logger.Info("seeding", lager.Data{"instances": len(state.InstanceMap), "bindings": len(state.BindingMap)})
+	if lock != nil && lock.Err() != nil {
+		return lock.Err()
 	}
+	return store.SaveAll(logger, &state)
 }
@@ -9,9 +9,10 @@ import (
 )
 
 type fileStore struct {
-	fileName string
-	ioutil   ioutilshim.Ioutil
+	fileName  string
+	ioutil    ioutilshim.Ioutil
 	storeType string
+	indent    bool
 }
 
 func NewFileStore(
@@ -19,9 +20,23 @@ func NewFileStore(
 	ioutil ioutilshim.Ioutil,
 ) Store {
 	return &fileStore{
-		fileName: fileName,
+		fileName:  fileName,
 		storeType: FILESTORE,
-		ioutil:   ioutil,
+		ioutil:    ioutil,
+	}
+}
+
+// NewIndentedFileStore writes indented JSON, which is easier for operators to
+// read than the compact JSON NewFileStore writes
+func NewIndentedFileStore(
+	fileName string,
+	ioutil ioutilshim.Ioutil,
+) Store {
+	return &fileStore{
+		fileName:  fileName,
+		storeType: FILESTORE,
+		ioutil:    ioutil,
+		indent:    true,
 	}
 }
 
@@ -51,7 +66,7 @@ func (s *fileStore) Save(logger lager.Logger, state *DynamicState, _, _ string)
 	logger.Info("start")
 	defer logger.Info("end")
 
-	stateData, err := json.Marshal(state)
+	stateData, err := s.marshal(state)
 	if err != nil {
 		logger.Error("failed-to-marshall-state", err)
 		return err
@@ -68,6 +83,59 @@ func (s *fileStore) Save(logger lager.Logger, state *DynamicState, _, _ string)
 	return nil
 }
 
+func (s *fileStore) marshal(state *DynamicState) ([]byte, error) {
+	if s.indent {
+		return json.MarshalIndent(state, "", "  ")
+	}
+	return json.Marshal(state)
+}
+
+func (s *fileStore) SaveAll(logger lager.Logger, state *DynamicState) error {
+	return s.Save(logger, state, "", "")
+}
+
+func (s *fileStore) InstanceExists(id string) (bool, error) {
+	state, err := s.read()
+	if err != nil {
+		return false, err
+	}
+	_, exists := state.InstanceMap[id]
+	return exists, nil
+}
+
+func (s *fileStore) BindingExists(id string) (bool, error) {
+	state, err := s.read()
+	if err != nil {
+		return false, err
+	}
+	_, exists := state.BindingMap[id]
+	return exists, nil
+}
+
+func (s *fileStore) IsEmpty() (bool, error) {
+	state, err := s.read()
+	if err != nil {
+		return false, err
+	}
+	return len(state.InstanceMap) == 0 && len(state.BindingMap) == 0, nil
+}
+
+// read loads the saved state, which is empty until the first save
+func (s *fileStore) read() (DynamicState, error) {
+	var state DynamicState
+
+	serviceData, err := s.ioutil.ReadFile(s.fileName)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+
+	err = json.Unmarshal(serviceData, &state)
+	return state, err
+}
+
 func (s *fileStore) Cleanup() error {
 	return nil
 }
@@ -2,12 +2,12 @@ package nfsbroker_test
 
 import (
 	"errors"
+	"os"
 
 	"code.cloudfoundry.org/goshims/ioutilshim/ioutil_fake"
 	"code.cloudfoundry.org/lager"
 	"code.cloudfoundry.org/lager/lagertest"
 	"code.cloudfoundry.org/nfsbroker/nfsbroker"
-	"github.com/pivotal-cf/brokerapi"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -31,7 +31,7 @@ var _ = Describe("FileStore", func() {
 					Share: "server:/some-share",
 				},
 			},
-			BindingMap: map[string]brokerapi.BindDetails{},
+			BindingMap: map[string]nfsbroker.ServiceBinding{},
 		}
 	})
 
@@ -52,6 +52,49 @@ var _ = Describe("FileStore", func() {
 			})
 		})
 
+		Context("when bindings were saved with their instance id", func() {
+			BeforeEach(func() {
+				fakeIoutil.ReadFileReturns([]byte(`{"InstanceMap":{},"BindingMap":{"binding-id":{"instance_id":"instance-id","details":{"app_guid":"app-guid","parameters":{"uid":"1000"}}}}}`), nil)
+				err = store.Restore(logger, &state)
+			})
+
+			It("restores the instance id and details", func() {
+				Expect(err).ToNot(HaveOccurred())
+				Expect(state.BindingMap["binding-id"].InstanceID).To(Equal("instance-id"))
+				Expect(state.BindingMap["binding-id"].Details.AppGUID).To(Equal("app-guid"))
+				Expect(state.BindingMap["binding-id"].Details.Parameters).To(HaveKeyWithValue("uid", "1000"))
+			})
+		})
+
+		Context("when records were saved before timestamps were kept", func() {
+			BeforeEach(func() {
+				fakeIoutil.ReadFileReturns([]byte(`{"InstanceMap":{"instance-id":{"Share":"server:/some-share"}},"BindingMap":{"binding-id":{"instance_id":"instance-id","details":{"app_guid":"app-guid"}}}}`), nil)
+				err = store.Restore(logger, &state)
+			})
+
+			It("restores them with zero timestamps", func() {
+				Expect(err).ToNot(HaveOccurred())
+				Expect(state.InstanceMap["instance-id"].Share).To(Equal("server:/some-share"))
+				Expect(state.InstanceMap["instance-id"].CreatedAt.IsZero()).To(BeTrue())
+				Expect(state.BindingMap["binding-id"].UpdatedAt.IsZero()).To(BeTrue())
+			})
+		})
+
+		Context("when bindings were saved as bare bind details", func() {
+			BeforeEach(func() {
+				fakeIoutil.ReadFileReturns([]byte(`{"InstanceMap":{},"BindingMap":{"binding-id":{"app_guid":"app-guid","parameters":{"uid":"1000"}}}}`), nil)
+				err = store.Restore(logger, &state)
+			})
+
+			It("restores the details without an instance id", func() {
+				Expect(err).ToNot(HaveOccurred())
+				Expect(state.BindingMap["binding-id"].InstanceID).To(BeEmpty())
+				Expect(state.BindingMap["binding-id"].CreatedAt.IsZero()).To(BeTrue())
+				Expect(state.BindingMap["binding-id"].Details.AppGUID).To(Equal("app-guid"))
+				Expect(state.BindingMap["binding-id"].Details.Parameters).To(HaveKeyWithValue("uid", "1000"))
+			})
+		})
+
 		Context("when the file system is failing", func() {
 			BeforeEach(func() {
 				fakeIoutil.ReadFileReturns(nil, errors.New("badness"))
@@ -74,6 +117,43 @@ var _ = Describe("FileStore", func() {
 		})
 	})
 
+	Describe("InstanceExists and BindingExists", func() {
+		BeforeEach(func() {
+			fakeIoutil.ReadFileReturns([]byte(`{"InstanceMap":{"instance-id":{}},"BindingMap":{"binding-id":{"instance_id":"instance-id"}}}`), nil)
+		})
+
+		It("finds saved ids", func() {
+			Expect(store.InstanceExists("instance-id")).To(BeTrue())
+			Expect(store.BindingExists("binding-id")).To(BeTrue())
+		})
+
+		It("reports missing ids", func() {
+			Expect(store.InstanceExists("other-instance-id")).To(BeFalse())
+			Expect(store.BindingExists("other-binding-id")).To(BeFalse())
+		})
+
+		Context("before anything has been saved", func() {
+			BeforeEach(func() {
+				fakeIoutil.ReadFileReturns(nil, os.ErrNotExist)
+			})
+
+			It("reports nothing exists", func() {
+				Expect(store.InstanceExists("instance-id")).To(BeFalse())
+			})
+		})
+
+		Context("when the file system is failing", func() {
+			BeforeEach(func() {
+				fakeIoutil.ReadFileReturns(nil, errors.New("badness"))
+			})
+
+			It("returns an error", func() {
+				_, err := store.BindingExists("binding-id")
+				Expect(err).To(MatchError("badness"))
+			})
+		})
+	})
+
 	Describe("Save", func() {
 		var (
 			err error
@@ -89,6 +169,24 @@ var _ = Describe("FileStore", func() {
 				Expect(fakeIoutil.WriteFileCallCount()).To(Equal(1))
 				Expect(err).ToNot(HaveOccurred())
 			})
+
+			It("writes compact json", func() {
+				_, data, _ := fakeIoutil.WriteFileArgsForCall(0)
+				Expect(string(data)).NotTo(ContainSubstring("\n"))
+			})
+		})
+
+		Context("when the store indents", func() {
+			BeforeEach(func() {
+				store = nfsbroker.NewIndentedFileStore("/tmp/whatever", fakeIoutil)
+				err = store.Save(logger, &state, "", "")
+			})
+
+			It("writes indented json", func() {
+				Expect(err).ToNot(HaveOccurred())
+				_, data, _ := fakeIoutil.WriteFileArgsForCall(0)
+				Expect(string(data)).To(HavePrefix("{\n  \"InstanceMap\": {\n"))
+			})
 		})
 
 		Context("when the file system is failing", func() {
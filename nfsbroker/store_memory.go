@@ -0,0 +1,109 @@
+package nfsbroker
+
+import (
+	"encoding/json"
+	"sync"
+
+	"code.cloudfoundry.org/lager"
+)
+
+type memoryStore struct {
+	mutex     sync.Mutex
+	stateData []byte
+}
+
+// NewInMemoryStore returns a Store that keeps the serialized state in memory,
+// as the file store keeps it on disk. It suits tests and ephemeral brokers;
+// a new store restores as empty.
+func NewInMemoryStore() Store {
+	return &memoryStore{}
+}
+
+func (s *memoryStore) Restore(logger lager.Logger, state *DynamicState) error {
+	logger = logger.Session("restore-state")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.stateData == nil {
+		return nil
+	}
+
+	err := json.Unmarshal(s.stateData, state)
+	if err != nil {
+		logger.Error("failed-to-unmarshall-state", err)
+		return err
+	}
+	return nil
+}
+
+func (s *memoryStore) Save(logger lager.Logger, state *DynamicState, _, _ string) error {
+	logger = logger.Session("serialize-state")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	stateData, err := json.Marshal(state)
+	if err != nil {
+		logger.Error("failed-to-marshall-state", err)
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.stateData = stateData
+	return nil
+}
+
+func (s *memoryStore) SaveAll(logger lager.Logger, state *DynamicState) error {
+	return s.Save(logger, state, "", "")
+}
+
+func (s *memoryStore) InstanceExists(id string) (bool, error) {
+	state, err := s.read()
+	if err != nil {
+		return false, err
+	}
+	_, exists := state.InstanceMap[id]
+	return exists, nil
+}
+
+func (s *memoryStore) BindingExists(id string) (bool, error) {
+	state, err := s.read()
+	if err != nil {
+		return false, err
+	}
+	_, exists := state.BindingMap[id]
+	return exists, nil
+}
+
+func (s *memoryStore) IsEmpty() (bool, error) {
+	state, err := s.read()
+	if err != nil {
+		return false, err
+	}
+	return len(state.InstanceMap) == 0 && len(state.BindingMap) == 0, nil
+}
+
+func (s *memoryStore) read() (DynamicState, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var state DynamicState
+	if s.stateData == nil {
+		return state, nil
+	}
+
+	err := json.Unmarshal(s.stateData, &state)
+	return state, err
+}
+
+func (s *memoryStore) Cleanup() error {
+	return nil
+}
+
+func (s *memoryStore) GetType() string {
+	return MEMORYSTORE
+}
@@ -0,0 +1,79 @@
+package nfsbroker_test
+
+import (
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/nfsbroker/nfsbroker"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("InMemoryStore", func() {
+	var (
+		store  nfsbroker.Store
+		logger lager.Logger
+		state  nfsbroker.DynamicState
+	)
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("test-broker")
+		store = nfsbroker.NewInMemoryStore()
+		state = nfsbroker.DynamicState{
+			InstanceMap: map[string]nfsbroker.ServiceInstance{
+				"instance-id": {
+					Share: "server:/some-share",
+				},
+			},
+			BindingMap: map[string]nfsbroker.ServiceBinding{
+				"binding-id": {InstanceID: "instance-id"},
+			},
+		}
+	})
+
+	Describe("Restore", func() {
+		It("restores nothing before the first save", func() {
+			restored := nfsbroker.DynamicState{}
+			Expect(store.Restore(logger, &restored)).To(Succeed())
+			Expect(restored.InstanceMap).To(BeEmpty())
+		})
+
+		It("restores what was saved", func() {
+			Expect(store.Save(logger, &state, "instance-id", "")).To(Succeed())
+
+			restored := nfsbroker.DynamicState{}
+			Expect(store.Restore(logger, &restored)).To(Succeed())
+			Expect(restored).To(Equal(state))
+		})
+
+		It("is not affected by later changes to the saved state", func() {
+			Expect(store.Save(logger, &state, "instance-id", "")).To(Succeed())
+			delete(state.InstanceMap, "instance-id")
+
+			restored := nfsbroker.DynamicState{}
+			Expect(store.Restore(logger, &restored)).To(Succeed())
+			Expect(restored.InstanceMap).To(HaveKey("instance-id"))
+		})
+	})
+
+	Describe("SaveAll", func() {
+		It("saves the whole state", func() {
+			Expect(store.SaveAll(logger, &state)).To(Succeed())
+			Expect(store.InstanceExists("instance-id")).To(BeTrue())
+			Expect(store.BindingExists("binding-id")).To(BeTrue())
+			Expect(store.BindingExists("other-binding-id")).To(BeFalse())
+		})
+	})
+
+	Describe("Cleanup", func() {
+		It("doesn't error", func() {
+			Expect(store.Cleanup()).To(Succeed())
+		})
+	})
+
+	Describe("GetType", func() {
+		It("returns a memory store type", func() {
+			Expect(store.GetType()).To(Equal(nfsbroker.MEMORYSTORE))
+		})
+	})
+})
@@ -1,21 +1,49 @@
 package nfsbroker
 
 import (
+	"database/sql"
+	"errors"
 	"fmt"
+	"regexp"
+	"strings"
+	"time"
 
 	"encoding/json"
 
+	"code.cloudfoundry.org/goshims/ioutilshim"
 	"code.cloudfoundry.org/lager"
-	"github.com/pivotal-cf/brokerapi"
-	"database/sql"
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+)
+
+const brokerLockID = "nfsbroker"
+
+const (
+	mysqlDuplicateEntry     = 1062
+	postgresUniqueViolation = "23505"
 )
 
+// ErrDatabaseTimeout is returned when a query takes longer than the store's
+// query timeout, usually because the connection pool is saturated
+var ErrDatabaseTimeout = errors.New("timed out waiting for the database")
+
 type sqlStore struct {
-  storeType string
-	database SqlConnection
+	storeType string
+	database  SqlConnection
+	variant   SqlVariant
+
+	instancesTable string
+	bindingsTable  string
+	locksTable     string
+
+	queryTimeout time.Duration
 }
 
-func NewSqlStore(logger lager.Logger, dbDriver, username, password, host, port, dbName, caCert string) (Store, error) {
+var tablePrefixPattern = regexp.MustCompile(`^[A-Za-z0-9_]*$`)
+
+// NewSqlStore connects to the database. When seedFromFile names a file store
+// backup, its state is loaded into the database if the tables are empty.
+func NewSqlStore(logger lager.Logger, dbDriver, username, password, host, port, dbName, caCert, tablePrefix, seedFromFile string, queryTimeout time.Duration) (Store, error) {
 
 	var err error
 	var toDatabase SqlVariant
@@ -29,26 +57,55 @@ func NewSqlStore(logger lager.Logger, dbDriver, username, password, host, port,
 		logger.Error("db-driver-unrecognized", err)
 		return nil, err
 	}
-	return NewSqlStoreWithVariant(logger, toDatabase)
+	store, err := NewSqlStoreWithVariant(logger, toDatabase, tablePrefix, queryTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if seedFromFile != "" {
+		err = SeedStore(logger, store, NewFileStore(seedFromFile, &ioutilshim.IoutilShim{}))
+		if err != nil {
+			logger.Error("failed-to-seed-from-file", err, lager.Data{"file": seedFromFile})
+			return nil, err
+		}
+	}
+	return store, nil
 }
 
-func NewSqlStoreWithVariant(logger lager.Logger, toDatabase SqlVariant) (Store, error) {
-	database := NewSqlConnection(toDatabase)
+// NewSqlStoreWithVariant prefixes every table name with tablePrefix, so that
+// several brokers can share one database. Reads that take longer than a
+// non-zero queryTimeout fail with ErrDatabaseTimeout, as do lock statements
+// and saves that wait that long for a connection. Once started, saves are
+// never abandoned, since they could still commit after the caller gave up on
+// them.
+func NewSqlStoreWithVariant(logger lager.Logger, toDatabase SqlVariant, tablePrefix string, queryTimeout time.Duration) (Store, error) {
+	if !tablePrefixPattern.MatchString(tablePrefix) {
+		err := fmt.Errorf("invalid table prefix %q: only letters, digits and underscores are allowed", tablePrefix)
+		logger.Error("sql-invalid-table-prefix", err)
+		return nil, err
+	}
 
-	err := initialize(logger, database)
+	store := &sqlStore{
+		storeType:      SQLSTORE,
+		database:       NewSqlConnection(toDatabase),
+		variant:        toDatabase,
+		instancesTable: tablePrefix + "service_instances",
+		bindingsTable:  tablePrefix + "service_bindings",
+		locksTable:     tablePrefix + "service_locks",
+		queryTimeout:   queryTimeout,
+	}
 
+	err := store.initialize(logger)
 	if err != nil {
 		logger.Error("sql-failed-to-initialize-database", err)
 		return nil, err
 	}
 
-	return &sqlStore{
-		storeType: SQLSTORE,
-		database: database,
-	}, nil
+	return store, nil
 }
 
-func initialize(logger lager.Logger, db SqlConnection) error {
+func (s *sqlStore) initialize(logger lager.Logger) error {
+	db := s.database
 	logger = logger.Session("initialize-database")
 	logger.Info("start")
 	defer logger.Info("end")
@@ -60,101 +117,124 @@ func initialize(logger lager.Logger, db SqlConnection) error {
 		return err
 	}
 
-	// TODO: uniquify table names?
-	_, err = db.Exec(`
-			CREATE TABLE IF NOT EXISTS service_instances(
+	_, err = db.Exec(fmt.Sprintf(`
+			CREATE TABLE IF NOT EXISTS %s(
 				id VARCHAR(255) PRIMARY KEY,
 				value VARCHAR(4096)
 			)
-		`)
+		`, s.instancesTable))
 	if err != nil {
 		return err
 	}
-	_, err = db.Exec(`
-			CREATE TABLE IF NOT EXISTS service_bindings(
+	_, err = db.Exec(fmt.Sprintf(`
+			CREATE TABLE IF NOT EXISTS %s(
 				id VARCHAR(255) PRIMARY KEY,
 				value VARCHAR(4096)
 			)
-		`)
+		`, s.bindingsTable))
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(fmt.Sprintf(`
+			CREATE TABLE IF NOT EXISTS %s(
+				id VARCHAR(255) PRIMARY KEY,
+				owner VARCHAR(255),
+				expires BIGINT
+			)
+		`, s.locksTable))
 	return err
 }
 
+// RestoreErrors lists the records Restore had to skip. Every other record was
+// still restored.
+type RestoreErrors []error
+
+func (e RestoreErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return fmt.Sprintf("failed to restore %d record(s): %s", len(e), strings.Join(messages, "; "))
+}
+
 func (s *sqlStore) Restore(logger lager.Logger, state *DynamicState) error {
 	logger = logger.Session("restore-state")
 	logger.Info("start")
 	defer logger.Info("end")
 
-	query := `SELECT id, value FROM service_instances`
-	rows, err := s.database.Query(query)
+	failures, err := s.restoreTable(logger, s.instancesTable, func(id, value string) error {
+		var serviceInstance ServiceInstance
+		if err := json.Unmarshal([]byte(value), &serviceInstance); err != nil {
+			return err
+		}
+		state.InstanceMap[id] = serviceInstance
+		return nil
+	})
 	if err != nil {
-		logger.Error("failed-query", err)
 		return err
 	}
-	if rows != nil {
-		for rows.Next() {
-			var (
-				id, value       string
-				serviceInstance ServiceInstance
-			)
-
-			err := rows.Scan(
-				&id,
-				&value,
-			)
-			if err != nil {
-				logger.Error("failed-scanning", err)
-				continue
-			}
 
-			err = json.Unmarshal([]byte(value), &serviceInstance)
-			if err != nil {
-				logger.Error("failed-unmarshaling", err)
-				continue
-			}
-			state.InstanceMap[id] = serviceInstance
+	// binding rows written before instance ids were recorded hold bare bind details; see ServiceBinding.UnmarshalJSON
+	bindingFailures, err := s.restoreTable(logger, s.bindingsTable, func(id, value string) error {
+		var serviceBinding ServiceBinding
+		if err := json.Unmarshal([]byte(value), &serviceBinding); err != nil {
+			return err
 		}
+		state.BindingMap[id] = serviceBinding
+		return nil
+	})
+	if err != nil {
+		return err
+	}
 
-		if rows.Err() != nil {
-			logger.Error("failed-getting-next-row", rows.Err())
-		}
+	if failures = append(failures, bindingFailures...); len(failures) > 0 {
+		return failures
 	}
+	return nil
+}
 
-	query = `SELECT id, value FROM service_bindings`
-	_, err = s.database.Query(query)
+// restoreTable hands every row of table to restore, collecting the rows that
+// cannot be read instead of giving up on the rest
+func (s *sqlStore) restoreTable(logger lager.Logger, table string, restore func(id, value string) error) (RestoreErrors, error) {
+	query := fmt.Sprintf(`SELECT id, value FROM %s`, table)
+	rows, err := s.query(query)
 	if err != nil {
-		logger.Error("failed-query", err)
-		return err
+		logger.Error("failed-query", err, lager.Data{"table": table})
+		return nil, err
 	}
-	if rows != nil {
-		for rows.Next() {
-			var (
-				id, value      string
-				serviceBinding brokerapi.BindDetails
-			)
+	if rows == nil {
+		return nil, nil
+	}
+	defer rows.Close()
 
-			err := rows.Scan(
-				&id,
-				&value,
-			)
-			if err != nil {
-				logger.Error("failed-scanning", err)
-				continue
-			}
+	var failures RestoreErrors
+	for rows.Next() {
+		var id, value string
 
-			err = json.Unmarshal([]byte(value), &serviceBinding)
-			if err != nil {
-				logger.Error("failed-unmarshaling", err)
-				continue
-			}
-			state.BindingMap[id] = serviceBinding
+		err := rows.Scan(
+			&id,
+			&value,
+		)
+		if err != nil {
+			logger.Error("failed-scanning", err, lager.Data{"table": table})
+			failures = append(failures, fmt.Errorf("%s: %s", table, err))
+			continue
 		}
 
-		if rows.Err() != nil {
-			logger.Error("failed-getting-next-row", rows.Err())
+		err = restore(id, value)
+		if err != nil {
+			logger.Error("failed-unmarshaling", err, lager.Data{"table": table, "id": id})
+			failures = append(failures, fmt.Errorf("%s %s: %s", table, id, err))
+			continue
 		}
 	}
 
-	return nil
+	if rows.Err() != nil {
+		logger.Error("failed-getting-next-row", rows.Err(), lager.Data{"table": table})
+		failures = append(failures, fmt.Errorf("%s: %s", table, rows.Err()))
+	}
+
+	return failures, nil
 }
 
 func (s *sqlStore) Save(logger lager.Logger, state *DynamicState, instanceId, bindingId string) error {
@@ -163,86 +243,345 @@ func (s *sqlStore) Save(logger lager.Logger, state *DynamicState, instanceId, bi
 	defer logger.Info("end")
 
 	if instanceId != "" {
-		var queriedServiceID sql.NullString
-		query := `SELECT TOP 1 service_instances.id FROM service_instances WHERE service_instance.id = ?`
-		returnedRows, err := s.database.Query(query, instanceId)
+		instance, exists := state.InstanceMap[instanceId]
+		if err := s.saveRecord(logger, s.instancesTable, instanceId, instance, exists); err != nil {
+			return err
+		}
+	}
+
+	if bindingId != "" {
+		binding, exists := state.BindingMap[bindingId]
+		if err := s.saveRecord(logger, s.bindingsTable, bindingId, binding, exists); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SaveAll replaces the contents of both tables in a single transaction
+func (s *sqlStore) SaveAll(logger lager.Logger, state *DynamicState) error {
+	logger = logger.Session("save-all-state")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	instances := make(map[string]string, len(state.InstanceMap))
+	for id, instance := range state.InstanceMap {
+		jsonValue, err := json.Marshal(instance)
 		if err != nil {
-			logger.Error("failed-query", err)
+			logger.Error("failed-marshaling", err, lager.Data{"table": s.instancesTable, "id": id})
 			return err
 		}
-		if returnedRows != nil {
-			returnedRows.Next()
-			err := returnedRows.Scan(&queriedServiceID)
-			if err != nil {
-				logger.Error("failed-scanning", err)
-				return err
-			}
+		instances[id] = string(jsonValue)
+	}
+
+	bindings := make(map[string]string, len(state.BindingMap))
+	for id, binding := range state.BindingMap {
+		jsonValue, err := json.Marshal(binding)
+		if err != nil {
+			logger.Error("failed-marshaling", err, lager.Data{"table": s.bindingsTable, "id": id})
+			return err
 		}
-		instance, _ := state.InstanceMap[instanceId]
-		if !queriedServiceID.Valid {
-			logger.Info("instance-found", lager.Data{"instance": instance})
-			jsonValue, err := json.Marshal(&instance)
-			if err != nil {
-				logger.Error("failed-marshaling", err)
-				return err
-			}
-			query := `INSERT INTO service_instances (id, value) VALUES (?, ?)`
+		bindings[id] = string(jsonValue)
+	}
 
-			_, err = s.database.Exec(query, instanceId, jsonValue)
+	return s.transaction(logger, func(tx *sql.Tx) error {
+		for table, values := range map[string]map[string]string{s.instancesTable: instances, s.bindingsTable: bindings} {
+			_, err := s.txExec(tx, fmt.Sprintf(`DELETE FROM %s`, table))
 			if err != nil {
-				logger.Error("failed-exec", err)
+				logger.Error("failed-exec", err, lager.Data{"table": table})
 				return err
 			}
-			state.InstanceMap = make(map[string]ServiceInstance)
-		} else {
-			query := `DELETE FROM service_instances WHERE id=?`
-			_, err := s.database.Exec(query, instanceId)
-			if err != nil {
-				logger.Error("failed-exec", err)
-				return err
+
+			query := fmt.Sprintf(`INSERT INTO %s (id, value) VALUES (?, ?)`, table)
+			for id, value := range values {
+				_, err := s.txExec(tx, query, id, value)
+				if err != nil {
+					logger.Error("failed-exec", err, lager.Data{"table": table, "id": id})
+					return err
+				}
 			}
 		}
+		return nil
+	})
+}
+
+// saveRecord replaces the row for id with value, or just removes it when the
+// record no longer exists. The row is replaced in a transaction, so that a
+// failed insert leaves the old row in place.
+func (s *sqlStore) saveRecord(logger lager.Logger, table, id string, value interface{}, exists bool) error {
+	var jsonValue []byte
+	if exists {
+		var err error
+		jsonValue, err = json.Marshal(value)
+		if err != nil {
+			logger.Error("failed-marshaling", err, lager.Data{"table": table, "id": id})
+			return err
+		}
 	}
 
-	if bindingId != "" {
+	return s.transaction(logger, func(tx *sql.Tx) error {
+		query := fmt.Sprintf(`DELETE FROM %s WHERE id=?`, table)
+		_, err := s.txExec(tx, query, id)
+		if err != nil {
+			logger.Error("failed-exec", err, lager.Data{"table": table, "id": id})
+			return err
+		}
 
-		var queriedBindingID sql.NullString
-		query := `SELECT TOP 1 service_bindings.id FROM service_bindings WHERE service_bindings.id = ?`
-		err := s.database.QueryRow(query, bindingId).Scan(&queriedBindingID)
+		if !exists {
+			return nil
+		}
+
+		query = fmt.Sprintf(`INSERT INTO %s (id, value) VALUES (?, ?)`, table)
+		_, err = s.txExec(tx, query, id, string(jsonValue))
 		if err != nil {
-			logger.Error("failed-exec", err)
+			logger.Error("failed-exec", err, lager.Data{"table": table, "id": id})
 			return err
 		}
-		binding, _ := state.BindingMap[bindingId]
-		if !queriedBindingID.Valid {
-			jsonValue, err := json.Marshal(&binding)
-			if err != nil {
-				logger.Error("failed-marshaling", err)
-				return err
-			}
-			query := `INSERT INTO service_bindings (id, value) VALUES (?, ?)`
-			_, err = s.database.Exec(query, bindingId, jsonValue)
-			if err != nil {
-				logger.Error("failed-exec", err)
-				return err
-			}
-		} else {
-			query := `DELETE FROM service_bindings WHERE id=?`
-			_, err := s.database.Exec(query, bindingId)
-			if err != nil {
-				logger.Error("failed-exec", err)
-				return err
-			}
+		return nil
+	})
+}
+
+// transaction runs write in a transaction, which is committed only if write
+// succeeds
+func (s *sqlStore) transaction(logger lager.Logger, write func(tx *sql.Tx) error) error {
+	tx, err := s.begin()
+	if err != nil {
+		logger.Error("failed-to-begin-transaction", err)
+		return err
+	}
+
+	if err := write(tx); err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			logger.Error("failed-to-rollback-transaction", rollbackErr)
 		}
+		return err
 	}
 
+	if err := tx.Commit(); err != nil {
+		logger.Error("failed-to-commit-transaction", err)
+		return err
+	}
 	return nil
 }
 
+// txExec runs query in tx. Unlike the connection, a transaction does not
+// rewrite queries for the database, so this does.
+func (s *sqlStore) txExec(tx *sql.Tx, query string, args ...interface{}) (sql.Result, error) {
+	return tx.Exec(s.variant.Flavorify(query), args...)
+}
+
+func (s *sqlStore) InstanceExists(id string) (bool, error) {
+	return s.recordExists(s.instancesTable, id)
+}
+
+func (s *sqlStore) BindingExists(id string) (bool, error) {
+	return s.recordExists(s.bindingsTable, id)
+}
+
+// IsEmpty looks for any row in either table, without reading them all
+func (s *sqlStore) IsEmpty() (bool, error) {
+	for _, table := range []string{s.instancesTable, s.bindingsTable} {
+		rows, err := s.query(fmt.Sprintf(`SELECT 1 FROM %s LIMIT 1`, table))
+		if err != nil {
+			return false, err
+		}
+		if rows == nil {
+			continue
+		}
+		exists := rows.Next()
+		err = rows.Err()
+		rows.Close()
+		if err != nil || exists {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// recordExists checks for the row for id without reading its value
+func (s *sqlStore) recordExists(table, id string) (bool, error) {
+	query := fmt.Sprintf(`SELECT 1 FROM %s WHERE id = ? LIMIT 1`, table)
+	rows, err := s.query(query, id)
+	if err != nil {
+		return false, err
+	}
+	if rows == nil {
+		return false, nil
+	}
+	defer rows.Close()
+
+	exists := rows.Next()
+	return exists, rows.Err()
+}
+
+// TryLock inserts the lock row for owner, after removing it when it expired.
+// A row owner holds already is removed too: it is left by an earlier attempt
+// that timed out but still completed.
+func (s *sqlStore) TryLock(logger lager.Logger, owner string, now time.Time, lease time.Duration) (bool, error) {
+	logger = logger.Session("try-lock")
+
+	query := fmt.Sprintf(`DELETE FROM %s WHERE id = ? AND (expires < ? OR owner = ?)`, s.locksTable)
+	_, err := s.exec(query, brokerLockID, now.Unix(), owner)
+	if err != nil {
+		logger.Error("failed-exec", err)
+		return false, err
+	}
+
+	query = fmt.Sprintf(`INSERT INTO %s (id, owner, expires) VALUES (?, ?, ?)`, s.locksTable)
+	_, err = s.exec(query, brokerLockID, owner, now.Add(lease).Unix())
+	if isDuplicateKey(err) {
+		logger.Debug("lock-held")
+		return false, nil
+	}
+	if err != nil {
+		logger.Error("failed-exec", err)
+		return false, err
+	}
+
+	return true, nil
+}
+
+// RenewLock extends the lease on the lock owner holds. It returns false when
+// owner no longer holds the lock.
+func (s *sqlStore) RenewLock(logger lager.Logger, owner string, now time.Time, lease time.Duration) (bool, error) {
+	logger = logger.Session("renew-lock")
+
+	query := fmt.Sprintf(`UPDATE %s SET expires = ? WHERE id = ? AND owner = ?`, s.locksTable)
+	result, err := s.exec(query, now.Add(lease).Unix(), brokerLockID, owner)
+	if err != nil {
+		logger.Error("failed-exec", err)
+		return false, err
+	}
+
+	renewed, err := result.RowsAffected()
+	if err != nil {
+		logger.Error("failed-reading-rows-affected", err)
+		return false, err
+	}
+	return renewed > 0, nil
+}
+
+func (s *sqlStore) ReleaseLock(logger lager.Logger, owner string) error {
+	logger = logger.Session("release-lock")
+
+	query := fmt.Sprintf(`DELETE FROM %s WHERE id = ? AND owner = ?`, s.locksTable)
+	_, err := s.exec(query, brokerLockID, owner)
+	if err != nil {
+		logger.Error("failed-exec", err)
+		return err
+	}
+	return nil
+}
+
+// isDuplicateKey is true for the error a database returns on inserting a row
+// whose primary key is taken
+func isDuplicateKey(err error) bool {
+	switch err := err.(type) {
+	case *mysql.MySQLError:
+		return err.Number == mysqlDuplicateEntry
+	case *pq.Error:
+		return err.Code == postgresUniqueViolation
+	default:
+		return false
+	}
+}
+
 func (s *sqlStore) Cleanup() error {
 	return s.database.Close()
 }
 
 func (s *sqlStore) GetType() string {
-  return s.storeType
-}
\ No newline at end of file
+	return s.storeType
+}
+
+type queryResult struct {
+	rows *sql.Rows
+	err  error
+}
+
+// query runs Query, giving up after the query timeout. Rows that arrive
+// after giving up are closed.
+func (s *sqlStore) query(query string, args ...interface{}) (*sql.Rows, error) {
+	if s.queryTimeout <= 0 {
+		return s.database.Query(query, args...)
+	}
+
+	done := make(chan queryResult, 1)
+	go func() {
+		rows, err := s.database.Query(query, args...)
+		done <- queryResult{rows: rows, err: err}
+	}()
+
+	select {
+	case result := <-done:
+		return result.rows, result.err
+	case <-time.After(s.queryTimeout):
+		go func() {
+			if result := <-done; result.rows != nil {
+				result.rows.Close()
+			}
+		}()
+		return nil, ErrDatabaseTimeout
+	}
+}
+
+type execResult struct {
+	result sql.Result
+	err    error
+}
+
+// exec runs Exec, giving up after the query timeout. Only the lock statements
+// use it: one that completes after giving up leaves at most a lease behind,
+// which expires.
+func (s *sqlStore) exec(query string, args ...interface{}) (sql.Result, error) {
+	if s.queryTimeout <= 0 {
+		return s.database.Exec(query, args...)
+	}
+
+	done := make(chan execResult, 1)
+	go func() {
+		result, err := s.database.Exec(query, args...)
+		done <- execResult{result: result, err: err}
+	}()
+
+	select {
+	case result := <-done:
+		return result.result, result.err
+	case <-time.After(s.queryTimeout):
+		return nil, ErrDatabaseTimeout
+	}
+}
+
+type beginResult struct {
+	tx  *sql.Tx
+	err error
+}
+
+// begin starts a transaction, giving up after the query timeout. The timeout
+// only covers waiting for a connection: a transaction that starts after
+// giving up is rolled back unused, so nothing is written behind the caller's
+// back.
+func (s *sqlStore) begin() (*sql.Tx, error) {
+	if s.queryTimeout <= 0 {
+		return s.database.Begin()
+	}
+
+	done := make(chan beginResult, 1)
+	go func() {
+		tx, err := s.database.Begin()
+		done <- beginResult{tx: tx, err: err}
+	}()
+
+	select {
+	case result := <-done:
+		return result.tx, result.err
+	case <-time.After(s.queryTimeout):
+		go func() {
+			if result := <-done; result.tx != nil {
+				result.tx.Rollback()
+			}
+		}()
+		return nil, ErrDatabaseTimeout
+	}
+}
@@ -1,13 +1,22 @@
 package nfsbroker_test
 
 import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
 	"code.cloudfoundry.org/lager"
 	"code.cloudfoundry.org/lager/lagertest"
 	"code.cloudfoundry.org/nfsbroker/nfsbroker"
-	"github.com/pivotal-cf/brokerapi"
 
 	"code.cloudfoundry.org/goshims/sqlshim/sql_fake"
 	"code.cloudfoundry.org/nfsbroker/nfsbrokerfakes"
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
@@ -19,14 +28,23 @@ var _ = Describe("SqlStore", func() {
 		state       nfsbroker.DynamicState
 		fakeSqlDb   = &sql_fake.FakeSqlDB{}
 		fakeVariant = &nfsbrokerfakes.FakeSqlVariant{}
+		rowsDB      *sql.DB
 		err         error
 	)
 
 	BeforeEach(func() {
 		logger = lagertest.NewTestLogger("test-broker")
+
+		rowsDB, err = sql.Open("nfsbroker-fake-rows", "")
+		Expect(err).NotTo(HaveOccurred())
+		resetFakeRows()
+		fakeSqlDb.BeginStub = func() (*sql.Tx, error) {
+			return rowsDB.Begin()
+		}
+
 		fakeVariant.ConnectReturns(fakeSqlDb, nil)
 		fakeVariant.FlavorifyStub = func(query string) string { return query }
-		store, err = nfsbroker.NewSqlStoreWithVariant(logger, fakeVariant)
+		store, err = nfsbroker.NewSqlStoreWithVariant(logger, fakeVariant, "", 0)
 		Expect(err).ToNot(HaveOccurred())
 		state = nfsbroker.DynamicState{
 			InstanceMap: map[string]nfsbroker.ServiceInstance{
@@ -34,7 +52,7 @@ var _ = Describe("SqlStore", func() {
 					Share: "server:/some-share",
 				},
 			},
-			BindingMap: map[string]brokerapi.BindDetails{},
+			BindingMap: map[string]nfsbroker.ServiceBinding{},
 		}
 	})
 
@@ -46,6 +64,203 @@ var _ = Describe("SqlStore", func() {
 		Expect(fakeSqlDb.ExecCallCount()).To(BeNumerically(">=", 2))
 		Expect(fakeSqlDb.ExecArgsForCall(0)).To(ContainSubstring("CREATE TABLE IF NOT EXISTS service_instances"))
 		Expect(fakeSqlDb.ExecArgsForCall(1)).To(ContainSubstring("CREATE TABLE IF NOT EXISTS service_bindings"))
+		Expect(fakeSqlDb.ExecArgsForCall(2)).To(ContainSubstring("CREATE TABLE IF NOT EXISTS service_locks"))
+	})
+
+	Context("given a table prefix", func() {
+		BeforeEach(func() {
+			store, err = nfsbroker.NewSqlStoreWithVariant(logger, fakeVariant, "nfs_", 0)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("prefixes the created tables", func() {
+			query, _ := fakeSqlDb.ExecArgsForCall(fakeSqlDb.ExecCallCount() - 3)
+			Expect(query).To(ContainSubstring("CREATE TABLE IF NOT EXISTS nfs_service_instances"))
+			query, _ = fakeSqlDb.ExecArgsForCall(fakeSqlDb.ExecCallCount() - 2)
+			Expect(query).To(ContainSubstring("CREATE TABLE IF NOT EXISTS nfs_service_bindings"))
+			query, _ = fakeSqlDb.ExecArgsForCall(fakeSqlDb.ExecCallCount() - 1)
+			Expect(query).To(ContainSubstring("CREATE TABLE IF NOT EXISTS nfs_service_locks"))
+		})
+
+		It("prefixes the tables it saves to", func() {
+			Expect(store.Save(logger, &state, "service-name", "")).To(Succeed())
+			Expect(fakeExecs).To(HaveLen(2))
+			Expect(fakeExecs[0].query).To(ContainSubstring("DELETE FROM nfs_service_instances"))
+			Expect(fakeExecs[1].query).To(ContainSubstring("INSERT INTO nfs_service_instances"))
+		})
+
+		It("prefixes the tables it restores from", func() {
+			Expect(store.Restore(logger, &state)).To(Succeed())
+			query, _ := fakeSqlDb.QueryArgsForCall(fakeSqlDb.QueryCallCount() - 2)
+			Expect(query).To(ContainSubstring("FROM nfs_service_instances"))
+			query, _ = fakeSqlDb.QueryArgsForCall(fakeSqlDb.QueryCallCount() - 1)
+			Expect(query).To(ContainSubstring("FROM nfs_service_bindings"))
+		})
+
+		It("prefixes the lock table", func() {
+			_, err := store.(nfsbroker.Locker).TryLock(logger, "some-owner", time.Unix(1000, 0), time.Minute)
+			Expect(err).NotTo(HaveOccurred())
+			query, _ := fakeSqlDb.ExecArgsForCall(fakeSqlDb.ExecCallCount() - 1)
+			Expect(query).To(ContainSubstring("INSERT INTO nfs_service_locks"))
+		})
+	})
+
+	It("rejects a table prefix that is not a plain identifier", func() {
+		_, err := nfsbroker.NewSqlStoreWithVariant(logger, fakeVariant, "nfs; DROP TABLE service_instances; --", 0)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("can be used as a broker lock", func() {
+		_, ok := store.(nfsbroker.Locker)
+		Expect(ok).To(BeTrue())
+	})
+
+	Describe("TryLock", func() {
+		var (
+			locker   nfsbroker.Locker
+			acquired bool
+			now      time.Time
+		)
+
+		BeforeEach(func() {
+			locker = store.(nfsbroker.Locker)
+			now = time.Unix(1000, 0)
+		})
+
+		Context("when the lock row can be inserted", func() {
+			BeforeEach(func() {
+				fakeSqlDb.ExecReturns(nil, nil)
+				acquired, err = locker.TryLock(logger, "some-owner", now, time.Minute)
+			})
+
+			It("acquires the lock", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(acquired).To(BeTrue())
+
+				query, args := fakeSqlDb.ExecArgsForCall(fakeSqlDb.ExecCallCount() - 1)
+				Expect(query).To(ContainSubstring("INSERT INTO service_locks"))
+				Expect(args).To(ContainElement("some-owner"))
+				Expect(args).To(ContainElement(int64(1060)))
+			})
+
+			It("expires stale locks first", func() {
+				query, args := fakeSqlDb.ExecArgsForCall(fakeSqlDb.ExecCallCount() - 2)
+				Expect(query).To(ContainSubstring("DELETE FROM service_locks"))
+				Expect(args).To(ContainElement(int64(1000)))
+			})
+
+			It("clears a lock row the owner left behind", func() {
+				query, args := fakeSqlDb.ExecArgsForCall(fakeSqlDb.ExecCallCount() - 2)
+				Expect(query).To(ContainSubstring("OR owner = ?"))
+				Expect(args).To(ContainElement("some-owner"))
+			})
+		})
+
+		Context("when inserting the lock row fails", func() {
+			var insertErr error
+
+			JustBeforeEach(func() {
+				fakeSqlDb.ExecStub = func(query string, args ...interface{}) (sql.Result, error) {
+					if strings.Contains(query, "INSERT INTO service_locks") {
+						return nil, insertErr
+					}
+					return nil, nil
+				}
+				acquired, err = locker.TryLock(logger, "some-owner", now, time.Minute)
+			})
+
+			AfterEach(func() {
+				fakeSqlDb.ExecStub = nil
+			})
+
+			Context("because another broker holds the lock in mysql", func() {
+				BeforeEach(func() {
+					insertErr = &mysql.MySQLError{Number: 1062, Message: "Duplicate entry 'nfsbroker' for key 'PRIMARY'"}
+				})
+
+				It("does not acquire the lock", func() {
+					Expect(err).NotTo(HaveOccurred())
+					Expect(acquired).To(BeFalse())
+				})
+			})
+
+			Context("because another broker holds the lock in postgres", func() {
+				BeforeEach(func() {
+					insertErr = &pq.Error{Code: "23505", Message: "duplicate key value violates unique constraint"}
+				})
+
+				It("does not acquire the lock", func() {
+					Expect(err).NotTo(HaveOccurred())
+					Expect(acquired).To(BeFalse())
+				})
+			})
+
+			Context("for any other reason", func() {
+				BeforeEach(func() {
+					insertErr = errors.New("connection refused")
+				})
+
+				It("returns the error", func() {
+					Expect(err).To(MatchError("connection refused"))
+					Expect(acquired).To(BeFalse())
+				})
+			})
+		})
+	})
+
+	Describe("RenewLock", func() {
+		var renewed bool
+
+		JustBeforeEach(func() {
+			renewed, err = store.(nfsbroker.Locker).RenewLock(logger, "some-owner", time.Unix(1000, 0), time.Minute)
+		})
+
+		Context("when the owner holds the lock", func() {
+			BeforeEach(func() {
+				fakeSqlDb.ExecReturns(driver.RowsAffected(1), nil)
+			})
+
+			AfterEach(func() {
+				fakeSqlDb.ExecReturns(nil, nil)
+			})
+
+			It("extends the lease", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(renewed).To(BeTrue())
+
+				query, args := fakeSqlDb.ExecArgsForCall(fakeSqlDb.ExecCallCount() - 1)
+				Expect(query).To(ContainSubstring("UPDATE service_locks SET expires = ?"))
+				Expect(args).To(Equal([]interface{}{int64(1060), "nfsbroker", "some-owner"}))
+			})
+		})
+
+		Context("when the lock has passed to another owner", func() {
+			BeforeEach(func() {
+				fakeSqlDb.ExecReturns(driver.RowsAffected(0), nil)
+			})
+
+			AfterEach(func() {
+				fakeSqlDb.ExecReturns(nil, nil)
+			})
+
+			It("reports the lock lost", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(renewed).To(BeFalse())
+			})
+		})
+	})
+
+	Describe("ReleaseLock", func() {
+		BeforeEach(func() {
+			err = store.(nfsbroker.Locker).ReleaseLock(logger, "some-owner")
+		})
+
+		It("deletes the lock row held by the owner", func() {
+			Expect(err).NotTo(HaveOccurred())
+			query, args := fakeSqlDb.ExecArgsForCall(fakeSqlDb.ExecCallCount() - 1)
+			Expect(query).To(ContainSubstring("DELETE FROM service_locks"))
+			Expect(args).To(ContainElement("some-owner"))
+		})
 	})
 
 	Describe("Restore", func() {
@@ -58,27 +273,296 @@ var _ = Describe("SqlStore", func() {
 				Expect(fakeSqlDb.QueryCallCount()).To(BeNumerically(">=", 2))
 			})
 		})
+
+		Context("when some rows are corrupt", func() {
+			var restored nfsbroker.DynamicState
+
+			BeforeEach(func() {
+				fakeTableRows = map[string][][]string{
+					"service_instances": {
+						{"good-instance", `{"Share":"server:/some-share"}`},
+						{"bad-instance", `{"Share":`},
+					},
+					"service_bindings": {
+						{"bad-binding", `not json`},
+						{"good-binding", `{"instance_id":"good-instance","details":{"app_guid":"app-guid"}}`},
+					},
+				}
+				fakeSqlDb.QueryStub = func(query string, args ...interface{}) (*sql.Rows, error) {
+					return rowsDB.Query(query, args...)
+				}
+
+				restored = nfsbroker.DynamicState{
+					InstanceMap: map[string]nfsbroker.ServiceInstance{},
+					BindingMap:  map[string]nfsbroker.ServiceBinding{},
+				}
+				err = store.Restore(logger, &restored)
+			})
+
+			AfterEach(func() {
+				fakeSqlDb.QueryStub = nil
+			})
+
+			It("restores the good records", func() {
+				Expect(restored.InstanceMap).To(HaveKey("good-instance"))
+				Expect(restored.BindingMap).To(HaveKey("good-binding"))
+				Expect(restored.InstanceMap).NotTo(HaveKey("bad-instance"))
+				Expect(restored.BindingMap).NotTo(HaveKey("bad-binding"))
+			})
+
+			It("reports every corrupt record", func() {
+				Expect(err).To(HaveOccurred())
+				restoreErrors, ok := err.(nfsbroker.RestoreErrors)
+				Expect(ok).To(BeTrue())
+				Expect(restoreErrors).To(HaveLen(2))
+				Expect(err.Error()).To(ContainSubstring("service_instances bad-instance"))
+				Expect(err.Error()).To(ContainSubstring("service_bindings bad-binding"))
+			})
+		})
 	})
 
 	Describe("Save", func() {
 		Context("when the row is added", func() {
 			BeforeEach(func() {
-				store.Save(logger, &state, "service-name", "")
+				err = store.Save(logger, &state, "service-name", "")
 			})
-			It("is inserted", func() {
-				Expect(fakeSqlDb.ExecCallCount()).To(BeNumerically(">=", 3))
+			It("replaces it in a transaction", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(fakeExecs).To(HaveLen(2))
+				Expect(fakeExecs[0].query).To(ContainSubstring("DELETE FROM service_instances"))
+				Expect(fakeExecs[0].args).To(Equal([]driver.Value{"service-name"}))
+				Expect(fakeExecs[1].query).To(ContainSubstring("INSERT INTO service_instances"))
+				Expect(fakeExecs[1].args[0]).To(Equal("service-name"))
+				Expect(fakeExecs[1].args[1]).To(ContainSubstring("server:/some-share"))
+				Expect(fakeCommits).To(Equal(1))
+			})
+			It("keeps the in memory state", func() {
+				Expect(state.InstanceMap).To(HaveKey("service-name"))
+			})
+		})
+		Context("when the row cannot be inserted", func() {
+			BeforeEach(func() {
+				fakeExecErrs = map[string]error{"INSERT": errors.New("badness")}
+				err = store.Save(logger, &state, "service-name", "")
+			})
+			It("rolls back the delete", func() {
+				Expect(err).To(MatchError("badness"))
+				Expect(fakeCommits).To(Equal(0))
+				Expect(fakeRollbacks).To(Equal(1))
 			})
 		})
 		Context("when the row is removed", func() {
 			BeforeEach(func() {
-				store.Save(logger, &state, "non-existent-service-name", "")
+				err = store.Save(logger, &state, "non-existent-service-name", "")
+			})
+			It("is deleted", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(fakeExecs).To(HaveLen(1))
+				Expect(fakeExecs[0].query).To(ContainSubstring("DELETE FROM service_instances"))
+				Expect(fakeExecs[0].args).To(Equal([]driver.Value{"non-existent-service-name"}))
+				Expect(fakeCommits).To(Equal(1))
+			})
+		})
+		Context("when a binding is added", func() {
+			BeforeEach(func() {
+				state.BindingMap["binding-id"] = nfsbroker.ServiceBinding{InstanceID: "service-name"}
+				err = store.Save(logger, &state, "", "binding-id")
+			})
+			It("is inserted with its instance id", func() {
+				Expect(err).NotTo(HaveOccurred())
+				insert := fakeExecs[len(fakeExecs)-1]
+				Expect(insert.query).To(ContainSubstring("INSERT INTO service_bindings"))
+				Expect(insert.args[0]).To(Equal("binding-id"))
+				Expect(insert.args[1]).To(ContainSubstring(`"instance_id":"service-name"`))
+			})
+		})
+		Context("when a binding is removed", func() {
+			BeforeEach(func() {
+				err = store.Save(logger, &state, "", "binding-id")
 			})
 			It("is deleted", func() {
-				Expect(fakeSqlDb.ExecCallCount()).To(BeNumerically(">=", 3))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(fakeExecs).To(HaveLen(1))
+				Expect(fakeExecs[0].query).To(ContainSubstring("DELETE FROM service_bindings"))
+				Expect(fakeExecs[0].args).To(Equal([]driver.Value{"binding-id"}))
+			})
+		})
+		Context("when the database needs its queries rewritten", func() {
+			BeforeEach(func() {
+				fakeVariant.FlavorifyStub = func(query string) string { return strings.Replace(query, "?", "$1", 1) }
+				err = store.Save(logger, &state, "", "binding-id")
+			})
+			It("rewrites the queries it runs in a transaction", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(fakeExecs[0].query).To(ContainSubstring("WHERE id=$1"))
 			})
 		})
 	})
 
+	Describe("SaveAll", func() {
+		JustBeforeEach(func() {
+			state.BindingMap["binding-id"] = nfsbroker.ServiceBinding{InstanceID: "service-name"}
+			err = store.SaveAll(logger, &state)
+		})
+
+		It("replaces the contents of both tables in one transaction", func() {
+			Expect(err).NotTo(HaveOccurred())
+
+			var queries, inserts []string
+			for _, exec := range fakeExecs {
+				queries = append(queries, exec.query)
+				if strings.HasPrefix(exec.query, "INSERT INTO service_") {
+					inserts = append(inserts, exec.args[0].(string))
+				}
+			}
+			Expect(queries).To(ContainElement("DELETE FROM service_instances"))
+			Expect(queries).To(ContainElement("DELETE FROM service_bindings"))
+			Expect(inserts).To(ConsistOf("service-name", "binding-id"))
+			Expect(fakeCommits).To(Equal(1))
+		})
+
+		Context("when a record cannot be inserted", func() {
+			BeforeEach(func() {
+				fakeExecErrs = map[string]error{"INSERT INTO service_bindings": errors.New("badness")}
+			})
+
+			It("rolls back the whole save", func() {
+				Expect(err).To(MatchError("badness"))
+				Expect(fakeCommits).To(Equal(0))
+				Expect(fakeRollbacks).To(Equal(1))
+			})
+		})
+	})
+
+	Describe("InstanceExists and BindingExists", func() {
+		var exists bool
+
+		BeforeEach(func() {
+			fakeTableRows = map[string][][]string{
+				"service_instances": {{"instance-id", "1"}},
+			}
+			fakeSqlDb.QueryStub = func(query string, args ...interface{}) (*sql.Rows, error) {
+				return rowsDB.Query(query, args...)
+			}
+		})
+
+		AfterEach(func() {
+			fakeSqlDb.QueryStub = nil
+		})
+
+		It("selects a single row by id", func() {
+			exists, err = store.InstanceExists("instance-id")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(exists).To(BeTrue())
+
+			query, args := fakeSqlDb.QueryArgsForCall(fakeSqlDb.QueryCallCount() - 1)
+			Expect(query).To(Equal("SELECT 1 FROM service_instances WHERE id = ? LIMIT 1"))
+			Expect(args).To(Equal([]interface{}{"instance-id"}))
+		})
+
+		It("reports a missing binding", func() {
+			exists, err = store.BindingExists("binding-id")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(exists).To(BeFalse())
+
+			query, _ := fakeSqlDb.QueryArgsForCall(fakeSqlDb.QueryCallCount() - 1)
+			Expect(query).To(ContainSubstring("FROM service_bindings"))
+		})
+	})
+
+	Describe("IsEmpty", func() {
+		BeforeEach(func() {
+			fakeSqlDb.QueryStub = func(query string, args ...interface{}) (*sql.Rows, error) {
+				return rowsDB.Query(query, args...)
+			}
+		})
+
+		AfterEach(func() {
+			fakeSqlDb.QueryStub = nil
+		})
+
+		It("is empty when neither table has rows", func() {
+			empty, err := store.IsEmpty()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(empty).To(BeTrue())
+
+			query, _ := fakeSqlDb.QueryArgsForCall(fakeSqlDb.QueryCallCount() - 2)
+			Expect(query).To(Equal("SELECT 1 FROM service_instances LIMIT 1"))
+			query, _ = fakeSqlDb.QueryArgsForCall(fakeSqlDb.QueryCallCount() - 1)
+			Expect(query).To(Equal("SELECT 1 FROM service_bindings LIMIT 1"))
+		})
+
+		It("is not empty when only bindings remain", func() {
+			fakeTableRows = map[string][][]string{
+				"service_bindings": {{"binding-id", "1"}},
+			}
+
+			empty, err := store.IsEmpty()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(empty).To(BeFalse())
+		})
+	})
+
+	Context("given a query timeout", func() {
+		var release chan struct{}
+
+		BeforeEach(func() {
+			store, err = nfsbroker.NewSqlStoreWithVariant(logger, fakeVariant, "", 10*time.Millisecond)
+			Expect(err).ToNot(HaveOccurred())
+
+			release = make(chan struct{})
+			fakeSqlDb.BeginStub = func() (*sql.Tx, error) {
+				<-release
+				return rowsDB.Begin()
+			}
+			fakeSqlDb.ExecStub = func(query string, args ...interface{}) (sql.Result, error) {
+				<-release
+				return nil, nil
+			}
+			fakeSqlDb.QueryStub = func(query string, args ...interface{}) (*sql.Rows, error) {
+				<-release
+				return nil, nil
+			}
+		})
+
+		AfterEach(func() {
+			close(release)
+			fakeSqlDb.ExecStub = nil
+			fakeSqlDb.QueryStub = nil
+		})
+
+		It("fails a save that cannot get a connection in time", func() {
+			Expect(store.Save(logger, &state, "service-name", "")).To(Equal(nfsbroker.ErrDatabaseTimeout))
+		})
+
+		It("rolls back a transaction that starts too late, unused", func() {
+			Expect(store.Save(logger, &state, "service-name", "")).To(Equal(nfsbroker.ErrDatabaseTimeout))
+			close(release)
+			release = make(chan struct{})
+			Eventually(func() int { return fakeRollbacks }).Should(Equal(1))
+			Expect(fakeExecs).To(BeEmpty())
+		})
+
+		It("fails a slow restore", func() {
+			Expect(store.Restore(logger, &state)).To(Equal(nfsbroker.ErrDatabaseTimeout))
+		})
+
+		It("fails a slow attempt to take the lock", func() {
+			acquired, err := store.(nfsbroker.Locker).TryLock(logger, "some-owner", time.Unix(1000, 0), time.Minute)
+			Expect(err).To(Equal(nfsbroker.ErrDatabaseTimeout))
+			Expect(acquired).To(BeFalse())
+		})
+
+		It("lets queries that finish in time succeed", func() {
+			close(release)
+			release = make(chan struct{})
+			fakeSqlDb.BeginStub = func() (*sql.Tx, error) {
+				return rowsDB.Begin()
+			}
+			Expect(store.Save(logger, &state, "service-name", "")).To(Succeed())
+		})
+	})
+
 	Describe("Cleanup", func() {
 		var (
 			err error
@@ -111,3 +595,102 @@ var _ = Describe("SqlStore", func() {
 		})
 	})
 })
+
+// fakeTableRows holds the rows the nfsbroker-fake-rows driver returns, by table
+var fakeTableRows map[string][][]string
+
+// fakeExecs records the statements run through the nfsbroker-fake-rows driver,
+// and fakeExecErrs fails those starting with a key with its error
+var (
+	fakeExecs    []fakeExec
+	fakeExecErrs map[string]error
+
+	fakeCommits   int
+	fakeRollbacks int
+	fakeTxMutex   sync.Mutex
+)
+
+type fakeExec struct {
+	query string
+	args  []driver.Value
+}
+
+func resetFakeRows() {
+	fakeTxMutex.Lock()
+	defer fakeTxMutex.Unlock()
+
+	fakeTableRows = nil
+	fakeExecs = nil
+	fakeExecErrs = nil
+	fakeCommits = 0
+	fakeRollbacks = 0
+}
+
+func init() {
+	sql.Register("nfsbroker-fake-rows", fakeRowsDriver{})
+}
+
+type fakeRowsDriver struct{}
+
+func (fakeRowsDriver) Open(name string) (driver.Conn, error) { return fakeRowsConn{}, nil }
+
+type fakeRowsConn struct{}
+
+func (fakeRowsConn) Prepare(query string) (driver.Stmt, error) { return fakeRowsStmt{query}, nil }
+func (fakeRowsConn) Close() error                              { return nil }
+func (fakeRowsConn) Begin() (driver.Tx, error)                 { return fakeRowsTx{}, nil }
+
+type fakeRowsTx struct{}
+
+func (fakeRowsTx) Commit() error {
+	fakeTxMutex.Lock()
+	defer fakeTxMutex.Unlock()
+	fakeCommits++
+	return nil
+}
+
+func (fakeRowsTx) Rollback() error {
+	fakeTxMutex.Lock()
+	defer fakeTxMutex.Unlock()
+	fakeRollbacks++
+	return nil
+}
+
+type fakeRowsStmt struct{ query string }
+
+func (fakeRowsStmt) Close() error  { return nil }
+func (fakeRowsStmt) NumInput() int { return -1 }
+func (s fakeRowsStmt) Exec(args []driver.Value) (driver.Result, error) {
+	fakeTxMutex.Lock()
+	defer fakeTxMutex.Unlock()
+
+	fakeExecs = append(fakeExecs, fakeExec{query: s.query, args: args})
+	for prefix, err := range fakeExecErrs {
+		if strings.HasPrefix(s.query, prefix) {
+			return nil, err
+		}
+	}
+	return driver.RowsAffected(1), nil
+}
+func (s fakeRowsStmt) Query(args []driver.Value) (driver.Rows, error) {
+	fields := strings.Fields(s.query)
+	for i, field := range fields[:len(fields)-1] {
+		if field == "FROM" {
+			return &fakeRows{rows: fakeTableRows[fields[i+1]]}, nil
+		}
+	}
+	return nil, errors.New("no table in query")
+}
+
+type fakeRows struct{ rows [][]string }
+
+func (r *fakeRows) Columns() []string { return []string{"id", "value"} }
+func (r *fakeRows) Close() error      { return nil }
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	dest[0], dest[1] = r.rows[0][0], r.rows[0][1]
+	r.rows = r.rows[1:]
+	return nil
+}
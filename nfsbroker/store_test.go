@@ -0,0 +1,141 @@
+package nfsbroker_test
+
+import (
+	"errors"
+	"time"
+
+	"code.cloudfoundry.org/goshims/ioutilshim/ioutil_fake"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/nfsbroker/nfsbroker"
+	"code.cloudfoundry.org/nfsbroker/nfsbrokerfakes"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("SeedStore", func() {
+	var (
+		logger      lager.Logger
+		store, seed *nfsbrokerfakes.FakeStore
+		seeded      nfsbroker.Store
+		err         error
+	)
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("test-broker")
+		store = &nfsbrokerfakes.FakeStore{}
+		store.IsEmptyReturns(true, nil)
+		seeded = store
+		seed = &nfsbrokerfakes.FakeStore{}
+		seed.RestoreStub = func(logger lager.Logger, state *nfsbroker.DynamicState) error {
+			state.InstanceMap["instance-id"] = nfsbroker.ServiceInstance{Share: "server:/some-share"}
+			state.BindingMap["binding-id"] = nfsbroker.ServiceBinding{InstanceID: "instance-id"}
+			return nil
+		}
+	})
+
+	JustBeforeEach(func() {
+		err = nfsbroker.SeedStore(logger, seeded, seed)
+	})
+
+	Context("when the store is empty", func() {
+		It("saves the seed state into the store", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(store.SaveAllCallCount()).To(Equal(1))
+
+			_, state := store.SaveAllArgsForCall(0)
+			Expect(state.InstanceMap).To(HaveKey("instance-id"))
+			Expect(state.BindingMap).To(HaveKey("binding-id"))
+		})
+	})
+
+	Context("when the store already has records", func() {
+		BeforeEach(func() {
+			store.IsEmptyReturns(false, nil)
+		})
+
+		It("skips seeding without reading them", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(store.RestoreCallCount()).To(Equal(0))
+			Expect(seed.RestoreCallCount()).To(Equal(0))
+			Expect(store.SaveAllCallCount()).To(Equal(0))
+		})
+	})
+
+	Context("when the store cannot be checked", func() {
+		BeforeEach(func() {
+			store.IsEmptyReturns(false, errors.New("connection refused"))
+		})
+
+		It("fails without seeding", func() {
+			Expect(err).To(MatchError("connection refused"))
+			Expect(store.SaveAllCallCount()).To(Equal(0))
+		})
+	})
+
+	Context("when the store is shared with other brokers", func() {
+		var (
+			locker *nfsbrokerfakes.FakeLocker
+			calls  []string
+		)
+
+		BeforeEach(func() {
+			calls = nil
+			locker = &nfsbrokerfakes.FakeLocker{}
+			locker.TryLockStub = func(lager.Logger, string, time.Time, time.Duration) (bool, error) {
+				calls = append(calls, "lock")
+				return true, nil
+			}
+			locker.ReleaseLockStub = func(lager.Logger, string) error {
+				calls = append(calls, "release")
+				return nil
+			}
+			store.IsEmptyStub = func() (bool, error) {
+				calls = append(calls, "check")
+				return true, nil
+			}
+			store.SaveAllStub = func(lager.Logger, *nfsbroker.DynamicState) error {
+				calls = append(calls, "save")
+				return nil
+			}
+			seeded = &lockingStore{FakeStore: store, FakeLocker: locker}
+		})
+
+		It("holds the lock from checking the store until the seed is saved", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(calls).To(Equal([]string{"lock", "check", "save", "release"}))
+		})
+	})
+})
+
+var _ = Describe("ResolveDBPassword", func() {
+	var fakeIoutil *ioutil_fake.FakeIoutil
+
+	BeforeEach(func() {
+		fakeIoutil = &ioutil_fake.FakeIoutil{}
+	})
+
+	It("uses the password when there is no password file", func() {
+		password, err := nfsbroker.ResolveDBPassword(fakeIoutil, "some-password", "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(password).To(Equal("some-password"))
+		Expect(fakeIoutil.ReadFileCallCount()).To(Equal(0))
+	})
+
+	It("prefers the contents of the password file", func() {
+		fakeIoutil.ReadFileReturns([]byte("file-password\n"), nil)
+
+		password, err := nfsbroker.ResolveDBPassword(fakeIoutil, "some-password", "/secrets/db-password")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(password).To(Equal("file-password"))
+		Expect(fakeIoutil.ReadFileArgsForCall(0)).To(Equal("/secrets/db-password"))
+	})
+
+	It("errors when the password file cannot be read", func() {
+		fakeIoutil.ReadFileReturns(nil, errors.New("no such file"))
+
+		_, err := nfsbroker.ResolveDBPassword(fakeIoutil, "some-password", "/secrets/missing")
+		Expect(err).To(MatchError("no such file"))
+	})
+})
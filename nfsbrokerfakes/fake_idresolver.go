@@ -0,0 +1,82 @@
+// This file was generated by counterfeiter
+package nfsbrokerfakes
+
+import (
+	"sync"
+
+	"code.cloudfoundry.org/nfsbroker/nfsbroker"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+type FakeIDResolver struct {
+	ResolveIDsStub        func(instance nfsbroker.ServiceInstance, details brokerapi.BindDetails) (uid string, gid string, err error)
+	resolveIDsMutex       sync.RWMutex
+	resolveIDsArgsForCall []struct {
+		instance nfsbroker.ServiceInstance
+		details  brokerapi.BindDetails
+	}
+	resolveIDsReturns struct {
+		result1 string
+		result2 string
+		result3 error
+	}
+	invocations      map[string][][]interface{}
+	invocationsMutex sync.RWMutex
+}
+
+func (fake *FakeIDResolver) ResolveIDs(instance nfsbroker.ServiceInstance, details brokerapi.BindDetails) (string, string, error) {
+	fake.resolveIDsMutex.Lock()
+	fake.resolveIDsArgsForCall = append(fake.resolveIDsArgsForCall, struct {
+		instance nfsbroker.ServiceInstance
+		details  brokerapi.BindDetails
+	}{instance, details})
+	fake.recordInvocation("ResolveIDs", []interface{}{instance, details})
+	fake.resolveIDsMutex.Unlock()
+	if fake.ResolveIDsStub != nil {
+		return fake.ResolveIDsStub(instance, details)
+	}
+	return fake.resolveIDsReturns.result1, fake.resolveIDsReturns.result2, fake.resolveIDsReturns.result3
+}
+
+func (fake *FakeIDResolver) ResolveIDsCallCount() int {
+	fake.resolveIDsMutex.RLock()
+	defer fake.resolveIDsMutex.RUnlock()
+	return len(fake.resolveIDsArgsForCall)
+}
+
+func (fake *FakeIDResolver) ResolveIDsArgsForCall(i int) (nfsbroker.ServiceInstance, brokerapi.BindDetails) {
+	fake.resolveIDsMutex.RLock()
+	defer fake.resolveIDsMutex.RUnlock()
+	return fake.resolveIDsArgsForCall[i].instance, fake.resolveIDsArgsForCall[i].details
+}
+
+func (fake *FakeIDResolver) ResolveIDsReturns(result1 string, result2 string, result3 error) {
+	fake.ResolveIDsStub = nil
+	fake.resolveIDsReturns = struct {
+		result1 string
+		result2 string
+		result3 error
+	}{result1, result2, result3}
+}
+
+func (fake *FakeIDResolver) Invocations() map[string][][]interface{} {
+	fake.invocationsMutex.RLock()
+	defer fake.invocationsMutex.RUnlock()
+	fake.resolveIDsMutex.RLock()
+	defer fake.resolveIDsMutex.RUnlock()
+	return fake.invocations
+}
+
+func (fake *FakeIDResolver) recordInvocation(key string, args []interface{}) {
+	fake.invocationsMutex.Lock()
+	defer fake.invocationsMutex.Unlock()
+	if fake.invocations == nil {
+		fake.invocations = map[string][][]interface{}{}
+	}
+	if fake.invocations[key] == nil {
+		fake.invocations[key] = [][]interface{}{}
+	}
+	fake.invocations[key] = append(fake.invocations[key], args)
+}
+
+var _ nfsbroker.IDResolver = new(FakeIDResolver)
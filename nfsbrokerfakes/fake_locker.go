@@ -0,0 +1,179 @@
+// This file was generated by counterfeiter
+package nfsbrokerfakes
+
+import (
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/nfsbroker/nfsbroker"
+)
+
+type FakeLocker struct {
+	TryLockStub        func(logger lager.Logger, owner string, now time.Time, lease time.Duration) (bool, error)
+	tryLockMutex       sync.RWMutex
+	tryLockArgsForCall []struct {
+		logger lager.Logger
+		owner  string
+		now    time.Time
+		lease  time.Duration
+	}
+	tryLockReturns struct {
+		result1 bool
+		result2 error
+	}
+	RenewLockStub        func(logger lager.Logger, owner string, now time.Time, lease time.Duration) (bool, error)
+	renewLockMutex       sync.RWMutex
+	renewLockArgsForCall []struct {
+		logger lager.Logger
+		owner  string
+		now    time.Time
+		lease  time.Duration
+	}
+	renewLockReturns struct {
+		result1 bool
+		result2 error
+	}
+	ReleaseLockStub        func(logger lager.Logger, owner string) error
+	releaseLockMutex       sync.RWMutex
+	releaseLockArgsForCall []struct {
+		logger lager.Logger
+		owner  string
+	}
+	releaseLockReturns struct {
+		result1 error
+	}
+	invocations      map[string][][]interface{}
+	invocationsMutex sync.RWMutex
+}
+
+func (fake *FakeLocker) TryLock(logger lager.Logger, owner string, now time.Time, lease time.Duration) (bool, error) {
+	fake.tryLockMutex.Lock()
+	fake.tryLockArgsForCall = append(fake.tryLockArgsForCall, struct {
+		logger lager.Logger
+		owner  string
+		now    time.Time
+		lease  time.Duration
+	}{logger, owner, now, lease})
+	fake.recordInvocation("TryLock", []interface{}{logger, owner, now, lease})
+	fake.tryLockMutex.Unlock()
+	if fake.TryLockStub != nil {
+		return fake.TryLockStub(logger, owner, now, lease)
+	}
+	return fake.tryLockReturns.result1, fake.tryLockReturns.result2
+}
+
+func (fake *FakeLocker) TryLockCallCount() int {
+	fake.tryLockMutex.RLock()
+	defer fake.tryLockMutex.RUnlock()
+	return len(fake.tryLockArgsForCall)
+}
+
+func (fake *FakeLocker) TryLockArgsForCall(i int) (lager.Logger, string, time.Time, time.Duration) {
+	fake.tryLockMutex.RLock()
+	defer fake.tryLockMutex.RUnlock()
+	return fake.tryLockArgsForCall[i].logger, fake.tryLockArgsForCall[i].owner, fake.tryLockArgsForCall[i].now, fake.tryLockArgsForCall[i].lease
+}
+
+func (fake *FakeLocker) TryLockReturns(result1 bool, result2 error) {
+	fake.TryLockStub = nil
+	fake.tryLockReturns = struct {
+		result1 bool
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeLocker) RenewLock(logger lager.Logger, owner string, now time.Time, lease time.Duration) (bool, error) {
+	fake.renewLockMutex.Lock()
+	fake.renewLockArgsForCall = append(fake.renewLockArgsForCall, struct {
+		logger lager.Logger
+		owner  string
+		now    time.Time
+		lease  time.Duration
+	}{logger, owner, now, lease})
+	fake.recordInvocation("RenewLock", []interface{}{logger, owner, now, lease})
+	fake.renewLockMutex.Unlock()
+	if fake.RenewLockStub != nil {
+		return fake.RenewLockStub(logger, owner, now, lease)
+	}
+	return fake.renewLockReturns.result1, fake.renewLockReturns.result2
+}
+
+func (fake *FakeLocker) RenewLockCallCount() int {
+	fake.renewLockMutex.RLock()
+	defer fake.renewLockMutex.RUnlock()
+	return len(fake.renewLockArgsForCall)
+}
+
+func (fake *FakeLocker) RenewLockArgsForCall(i int) (lager.Logger, string, time.Time, time.Duration) {
+	fake.renewLockMutex.RLock()
+	defer fake.renewLockMutex.RUnlock()
+	return fake.renewLockArgsForCall[i].logger, fake.renewLockArgsForCall[i].owner, fake.renewLockArgsForCall[i].now, fake.renewLockArgsForCall[i].lease
+}
+
+func (fake *FakeLocker) RenewLockReturns(result1 bool, result2 error) {
+	fake.RenewLockStub = nil
+	fake.renewLockReturns = struct {
+		result1 bool
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeLocker) ReleaseLock(logger lager.Logger, owner string) error {
+	fake.releaseLockMutex.Lock()
+	fake.releaseLockArgsForCall = append(fake.releaseLockArgsForCall, struct {
+		logger lager.Logger
+		owner  string
+	}{logger, owner})
+	fake.recordInvocation("ReleaseLock", []interface{}{logger, owner})
+	fake.releaseLockMutex.Unlock()
+	if fake.ReleaseLockStub != nil {
+		return fake.ReleaseLockStub(logger, owner)
+	}
+	return fake.releaseLockReturns.result1
+}
+
+func (fake *FakeLocker) ReleaseLockCallCount() int {
+	fake.releaseLockMutex.RLock()
+	defer fake.releaseLockMutex.RUnlock()
+	return len(fake.releaseLockArgsForCall)
+}
+
+func (fake *FakeLocker) ReleaseLockArgsForCall(i int) (lager.Logger, string) {
+	fake.releaseLockMutex.RLock()
+	defer fake.releaseLockMutex.RUnlock()
+	return fake.releaseLockArgsForCall[i].logger, fake.releaseLockArgsForCall[i].owner
+}
+
+func (fake *FakeLocker) ReleaseLockReturns(result1 error) {
+	fake.ReleaseLockStub = nil
+	fake.releaseLockReturns = struct {
+		result1 error
+	}{result1}
+}
+
+func (fake *FakeLocker) Invocations() map[string][][]interface{} {
+	fake.invocationsMutex.RLock()
+	defer fake.invocationsMutex.RUnlock()
+	fake.tryLockMutex.RLock()
+	defer fake.tryLockMutex.RUnlock()
+	fake.renewLockMutex.RLock()
+	defer fake.renewLockMutex.RUnlock()
+	fake.releaseLockMutex.RLock()
+	defer fake.releaseLockMutex.RUnlock()
+	return fake.invocations
+}
+
+func (fake *FakeLocker) recordInvocation(key string, args []interface{}) {
+	fake.invocationsMutex.Lock()
+	defer fake.invocationsMutex.Unlock()
+	if fake.invocations == nil {
+		fake.invocations = map[string][][]interface{}{}
+	}
+	if fake.invocations[key] == nil {
+		fake.invocations[key] = [][]interface{}{}
+	}
+	fake.invocations[key] = append(fake.invocations[key], args)
+}
+
+var _ nfsbroker.Locker = new(FakeLocker)
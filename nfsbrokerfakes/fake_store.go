@@ -35,6 +35,40 @@ type FakeStore struct {
 	saveReturns struct {
 		result1 error
 	}
+	SaveAllStub        func(logger lager.Logger, state *nfsbroker.DynamicState) error
+	saveAllMutex       sync.RWMutex
+	saveAllArgsForCall []struct {
+		logger lager.Logger
+		state  *nfsbroker.DynamicState
+	}
+	saveAllReturns struct {
+		result1 error
+	}
+	InstanceExistsStub        func(id string) (bool, error)
+	instanceExistsMutex       sync.RWMutex
+	instanceExistsArgsForCall []struct {
+		id string
+	}
+	instanceExistsReturns struct {
+		result1 bool
+		result2 error
+	}
+	BindingExistsStub        func(id string) (bool, error)
+	bindingExistsMutex       sync.RWMutex
+	bindingExistsArgsForCall []struct {
+		id string
+	}
+	bindingExistsReturns struct {
+		result1 bool
+		result2 error
+	}
+	IsEmptyStub        func() (bool, error)
+	isEmptyMutex       sync.RWMutex
+	isEmptyArgsForCall []struct{}
+	isEmptyReturns     struct {
+		result1 bool
+		result2 error
+	}
 	CleanupStub        func() error
 	cleanupMutex       sync.RWMutex
 	cleanupArgsForCall []struct{}
@@ -137,6 +171,130 @@ func (fake *FakeStore) SaveReturns(result1 error) {
 	}{result1}
 }
 
+func (fake *FakeStore) SaveAll(logger lager.Logger, state *nfsbroker.DynamicState) error {
+	fake.saveAllMutex.Lock()
+	fake.saveAllArgsForCall = append(fake.saveAllArgsForCall, struct {
+		logger lager.Logger
+		state  *nfsbroker.DynamicState
+	}{logger, state})
+	fake.recordInvocation("SaveAll", []interface{}{logger, state})
+	fake.saveAllMutex.Unlock()
+	if fake.SaveAllStub != nil {
+		return fake.SaveAllStub(logger, state)
+	}
+	return fake.saveAllReturns.result1
+}
+
+func (fake *FakeStore) SaveAllCallCount() int {
+	fake.saveAllMutex.RLock()
+	defer fake.saveAllMutex.RUnlock()
+	return len(fake.saveAllArgsForCall)
+}
+
+func (fake *FakeStore) SaveAllArgsForCall(i int) (lager.Logger, *nfsbroker.DynamicState) {
+	fake.saveAllMutex.RLock()
+	defer fake.saveAllMutex.RUnlock()
+	return fake.saveAllArgsForCall[i].logger, fake.saveAllArgsForCall[i].state
+}
+
+func (fake *FakeStore) SaveAllReturns(result1 error) {
+	fake.SaveAllStub = nil
+	fake.saveAllReturns = struct {
+		result1 error
+	}{result1}
+}
+
+func (fake *FakeStore) InstanceExists(id string) (bool, error) {
+	fake.instanceExistsMutex.Lock()
+	fake.instanceExistsArgsForCall = append(fake.instanceExistsArgsForCall, struct {
+		id string
+	}{id})
+	fake.recordInvocation("InstanceExists", []interface{}{id})
+	fake.instanceExistsMutex.Unlock()
+	if fake.InstanceExistsStub != nil {
+		return fake.InstanceExistsStub(id)
+	}
+	return fake.instanceExistsReturns.result1, fake.instanceExistsReturns.result2
+}
+
+func (fake *FakeStore) InstanceExistsCallCount() int {
+	fake.instanceExistsMutex.RLock()
+	defer fake.instanceExistsMutex.RUnlock()
+	return len(fake.instanceExistsArgsForCall)
+}
+
+func (fake *FakeStore) InstanceExistsArgsForCall(i int) string {
+	fake.instanceExistsMutex.RLock()
+	defer fake.instanceExistsMutex.RUnlock()
+	return fake.instanceExistsArgsForCall[i].id
+}
+
+func (fake *FakeStore) InstanceExistsReturns(result1 bool, result2 error) {
+	fake.InstanceExistsStub = nil
+	fake.instanceExistsReturns = struct {
+		result1 bool
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeStore) BindingExists(id string) (bool, error) {
+	fake.bindingExistsMutex.Lock()
+	fake.bindingExistsArgsForCall = append(fake.bindingExistsArgsForCall, struct {
+		id string
+	}{id})
+	fake.recordInvocation("BindingExists", []interface{}{id})
+	fake.bindingExistsMutex.Unlock()
+	if fake.BindingExistsStub != nil {
+		return fake.BindingExistsStub(id)
+	}
+	return fake.bindingExistsReturns.result1, fake.bindingExistsReturns.result2
+}
+
+func (fake *FakeStore) BindingExistsCallCount() int {
+	fake.bindingExistsMutex.RLock()
+	defer fake.bindingExistsMutex.RUnlock()
+	return len(fake.bindingExistsArgsForCall)
+}
+
+func (fake *FakeStore) BindingExistsArgsForCall(i int) string {
+	fake.bindingExistsMutex.RLock()
+	defer fake.bindingExistsMutex.RUnlock()
+	return fake.bindingExistsArgsForCall[i].id
+}
+
+func (fake *FakeStore) BindingExistsReturns(result1 bool, result2 error) {
+	fake.BindingExistsStub = nil
+	fake.bindingExistsReturns = struct {
+		result1 bool
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeStore) IsEmpty() (bool, error) {
+	fake.isEmptyMutex.Lock()
+	fake.isEmptyArgsForCall = append(fake.isEmptyArgsForCall, struct{}{})
+	fake.recordInvocation("IsEmpty", []interface{}{})
+	fake.isEmptyMutex.Unlock()
+	if fake.IsEmptyStub != nil {
+		return fake.IsEmptyStub()
+	}
+	return fake.isEmptyReturns.result1, fake.isEmptyReturns.result2
+}
+
+func (fake *FakeStore) IsEmptyCallCount() int {
+	fake.isEmptyMutex.RLock()
+	defer fake.isEmptyMutex.RUnlock()
+	return len(fake.isEmptyArgsForCall)
+}
+
+func (fake *FakeStore) IsEmptyReturns(result1 bool, result2 error) {
+	fake.IsEmptyStub = nil
+	fake.isEmptyReturns = struct {
+		result1 bool
+		result2 error
+	}{result1, result2}
+}
+
 func (fake *FakeStore) Cleanup() error {
 	fake.cleanupMutex.Lock()
 	fake.cleanupArgsForCall = append(fake.cleanupArgsForCall, struct{}{})
@@ -170,6 +328,14 @@ func (fake *FakeStore) Invocations() map[string][][]interface{} {
 	defer fake.restoreMutex.RUnlock()
 	fake.saveMutex.RLock()
 	defer fake.saveMutex.RUnlock()
+	fake.saveAllMutex.RLock()
+	defer fake.saveAllMutex.RUnlock()
+	fake.instanceExistsMutex.RLock()
+	defer fake.instanceExistsMutex.RUnlock()
+	fake.bindingExistsMutex.RLock()
+	defer fake.bindingExistsMutex.RUnlock()
+	fake.isEmptyMutex.RLock()
+	defer fake.isEmptyMutex.RUnlock()
 	fake.cleanupMutex.RLock()
 	defer fake.cleanupMutex.RUnlock()
 	return fake.invocations